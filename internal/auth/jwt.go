@@ -0,0 +1,408 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// Errors returned by JWTVerifier.Verify besides ErrForbidden. Both are authentication
+// failures (401).
+var (
+	ErrInvalidToken = errors.New("invalid bearer token")
+	ErrTokenExpired = errors.New("bearer token expired")
+)
+
+// JWTConfig configures a JWTVerifier. At least one of JWKSFile and PublicKeyFile is required, and
+// so are Issuer and Audience.
+type JWTConfig struct {
+	// JWKSFile is a JSON Web Key Set ({"keys": [...]}) with RSA, EC (P-256/384/521) or Ed25519 keys.
+	JWKSFile string
+	// PublicKeyFile holds PEM public keys or certificates, used for tokens without a matching kid.
+	PublicKeyFile string
+	Issuer        string
+	Audience      string
+	// ScopeClaim names the claim listing scopes, as a space-separated string or an array
+	// (default "scope"). With ScopePrefix set only entries carrying the prefix count, e.g.
+	// "herald-dingtalk:send".
+	ScopeClaim  string
+	ScopePrefix string
+	// CallerClaim names the claim used as caller name in logs and rate limits (default "sub").
+	CallerClaim string
+	// Leeway tolerates clock skew when checking exp and nbf.
+	Leeway time.Duration
+}
+
+// jwtKey is a verification key; kid and alg are empty for keys from PEM files.
+type jwtKey struct {
+	kid string
+	alg string
+	pub crypto.PublicKey
+}
+
+// JWTVerifier verifies "Authorization: Bearer" JWTs issued by the platform's identity provider.
+// It is safe for concurrent use; Reload swaps the keys atomically.
+type JWTVerifier struct {
+	cfg  JWTConfig
+	keys atomic.Pointer[[]jwtKey]
+}
+
+// NewJWTVerifier loads the configured keys.
+func NewJWTVerifier(cfg JWTConfig) (*JWTVerifier, error) {
+	if cfg.JWKSFile == "" && cfg.PublicKeyFile == "" {
+		return nil, errors.New("jwt: a JWKS file or public key file is required")
+	}
+	if cfg.Issuer == "" || cfg.Audience == "" {
+		return nil, errors.New("jwt: issuer and audience are required")
+	}
+	if cfg.ScopeClaim == "" {
+		cfg.ScopeClaim = "scope"
+	}
+	if cfg.CallerClaim == "" {
+		cfg.CallerClaim = "sub"
+	}
+	v := &JWTVerifier{cfg: cfg}
+	if err := v.Reload(); err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+// Reload re-reads the key files, e.g. after the identity provider rotated its signing key. On
+// error the current keys stay in effect.
+func (v *JWTVerifier) Reload() error {
+	var keys []jwtKey
+	if v.cfg.JWKSFile != "" {
+		k, err := loadJWKS(v.cfg.JWKSFile)
+		if err != nil {
+			return err
+		}
+		keys = append(keys, k...)
+	}
+	if v.cfg.PublicKeyFile != "" {
+		k, err := loadPublicKeys(v.cfg.PublicKeyFile)
+		if err != nil {
+			return err
+		}
+		keys = append(keys, k...)
+	}
+	v.keys.Store(&keys)
+	return nil
+}
+
+// jwtMethods are the signing algorithms accepted; "none" and HMAC are never accepted.
+var jwtMethods = []string{"RS256", "RS384", "RS512", "ES256", "ES384", "ES512", "EdDSA"}
+
+// minRSABits is the smallest RSA modulus accepted for verification keys.
+const minRSABits = 2048
+
+// maxNumericDate bounds exp, nbf and iat (9999-12-31) so they convert to a time without overflow.
+const maxNumericDate = 253402300799
+
+// errCritHeader rejects tokens relying on JWS extensions (RFC 7515 "crit"); none are supported.
+var errCritHeader = errors.New("unsupported critical header")
+
+// Verify checks the token's signature, iss, aud, exp and nbf, and that its scope claim grants
+// scope. It returns the caller claim as name (also when the scope is missing, for logs).
+func (v *JWTVerifier) Verify(token string, scope Scope, now time.Time) (string, error) {
+	parser := jwt.NewParser(
+		jwt.WithValidMethods(jwtMethods),
+		jwt.WithJSONNumber(),
+		jwt.WithIssuer(v.cfg.Issuer),
+		jwt.WithAudience(v.cfg.Audience),
+		jwt.WithExpirationRequired(),
+		jwt.WithLeeway(v.cfg.Leeway),
+		jwt.WithTimeFunc(func() time.Time { return now }),
+	)
+	claims := jwtClaims{}
+	_, err := parser.ParseWithClaims(token, &claims, v.keyFunc)
+	switch {
+	case errors.Is(err, jwt.ErrTokenMalformed):
+		return "", fmt.Errorf("%w: malformed", ErrInvalidToken)
+	case errors.Is(err, errCritHeader):
+		return "", fmt.Errorf("%w: %v", ErrInvalidToken, errCritHeader)
+	case err != nil && !errors.Is(err, jwt.ErrTokenInvalidClaims):
+		return "", fmt.Errorf("%w: bad signature", ErrInvalidToken)
+	}
+	// The signature is valid, so the claims can be trusted for logs even if they are rejected.
+	name, _ := claims[v.cfg.CallerClaim].(string)
+	if name == "" {
+		return "", fmt.Errorf("%w: missing %s claim", ErrInvalidToken, v.cfg.CallerClaim)
+	}
+	switch {
+	case errors.Is(err, jwt.ErrTokenExpired):
+		return name, ErrTokenExpired
+	case errors.Is(err, jwt.ErrTokenInvalidIssuer):
+		return name, fmt.Errorf("%w: unexpected issuer", ErrInvalidToken)
+	case errors.Is(err, jwt.ErrTokenInvalidAudience):
+		return name, fmt.Errorf("%w: unexpected audience", ErrInvalidToken)
+	case errors.Is(err, jwt.ErrTokenNotValidYet):
+		return name, fmt.Errorf("%w: not valid yet", ErrInvalidToken)
+	case errors.Is(err, jwt.ErrTokenRequiredClaimMissing):
+		return name, fmt.Errorf("%w: missing exp claim", ErrInvalidToken)
+	case err != nil:
+		return name, fmt.Errorf("%w: invalid claims", ErrInvalidToken)
+	}
+	if !slices.Contains(v.scopes(claims), scope) {
+		return name, ErrForbidden
+	}
+	return name, nil
+}
+
+// scopes returns the scopes granted by the scope claim.
+func (v *JWTVerifier) scopes(claims jwtClaims) []Scope {
+	raw := stringList(claims[v.cfg.ScopeClaim])
+	if len(raw) == 1 {
+		raw = strings.Fields(raw[0])
+	}
+	var scopes []Scope
+	for _, s := range raw {
+		if rest, ok := strings.CutPrefix(s, v.cfg.ScopePrefix); ok && rest != "" {
+			scopes = append(scopes, Scope(rest))
+		}
+	}
+	return scopes
+}
+
+// keyFunc returns the key with the token's kid or, failing that, every key without a kid, keeping
+// only keys whose type, curve and alg fit the token's algorithm.
+func (v *JWTVerifier) keyFunc(t *jwt.Token) (any, error) {
+	if _, ok := t.Header["crit"]; ok {
+		return nil, errCritHeader
+	}
+	alg := t.Method.Alg()
+	kid, _ := t.Header["kid"].(string)
+	var candidates []jwtKey
+	for _, k := range *v.keys.Load() {
+		if kid != "" && k.kid == kid {
+			candidates = []jwtKey{k}
+			break
+		}
+		if k.kid == "" {
+			candidates = append(candidates, k)
+		}
+	}
+	var set jwt.VerificationKeySet
+	for _, k := range candidates {
+		if (k.alg == "" || k.alg == alg) && keyFitsAlg(k.pub, alg) {
+			set.Keys = append(set.Keys, k.pub)
+		}
+	}
+	if len(set.Keys) == 0 {
+		return nil, fmt.Errorf("no %s key for kid %q", alg, kid)
+	}
+	return set, nil
+}
+
+// keyFitsAlg reports whether pub may verify alg. ECDSA keys must be on the algorithm's curve,
+// which the jwt library does not check.
+func keyFitsAlg(pub crypto.PublicKey, alg string) bool {
+	switch pub := pub.(type) {
+	case *rsa.PublicKey:
+		return strings.HasPrefix(alg, "RS")
+	case *ecdsa.PublicKey:
+		curves := map[string]elliptic.Curve{"ES256": elliptic.P256(), "ES384": elliptic.P384(), "ES512": elliptic.P521()}
+		return curves[alg] == pub.Curve
+	case ed25519.PublicKey:
+		return alg == "EdDSA"
+	}
+	return false
+}
+
+// jwtClaims are a token's claims. The numeric dates are range-checked before the jwt library
+// converts them, whose float to int64 conversion is undefined for huge values.
+type jwtClaims map[string]any
+
+func (c jwtClaims) GetExpirationTime() (*jwt.NumericDate, error) {
+	if err := c.checkDate("exp"); err != nil {
+		return nil, err
+	}
+	return jwt.MapClaims(c).GetExpirationTime()
+}
+
+func (c jwtClaims) GetNotBefore() (*jwt.NumericDate, error) {
+	if err := c.checkDate("nbf"); err != nil {
+		return nil, err
+	}
+	return jwt.MapClaims(c).GetNotBefore()
+}
+
+func (c jwtClaims) GetIssuedAt() (*jwt.NumericDate, error) {
+	if err := c.checkDate("iat"); err != nil {
+		return nil, err
+	}
+	return jwt.MapClaims(c).GetIssuedAt()
+}
+
+func (c jwtClaims) GetIssuer() (string, error)             { return jwt.MapClaims(c).GetIssuer() }
+func (c jwtClaims) GetSubject() (string, error)            { return jwt.MapClaims(c).GetSubject() }
+func (c jwtClaims) GetAudience() (jwt.ClaimStrings, error) { return jwt.MapClaims(c).GetAudience() }
+
+// checkDate rejects a numeric date claim that is NaN, infinite or beyond maxNumericDate.
+func (c jwtClaims) checkDate(key string) error {
+	n, ok := c[key].(json.Number)
+	if !ok {
+		return nil
+	}
+	f, err := n.Float64()
+	if err != nil || !(f >= -maxNumericDate && f <= maxNumericDate) {
+		return fmt.Errorf("%w: %s is out of range", jwt.ErrInvalidType, key)
+	}
+	return nil
+}
+
+// stringList reads a claim that is a string or an array of strings.
+func stringList(v any) []string {
+	switch v := v.(type) {
+	case string:
+		return []string{v}
+	case []any:
+		var out []string
+		for _, e := range v {
+			if s, ok := e.(string); ok {
+				out = append(out, s)
+			}
+		}
+		return out
+	}
+	return nil
+}
+
+// jwk is the subset of RFC 7517 fields used for RSA, EC and OKP public keys.
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Alg string `json:"alg"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// loadJWKS reads the signing keys of a JWKS file; keys for other uses are skipped.
+func loadJWKS(path string) ([]jwtKey, error) {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := json.Unmarshal(raw, &set); err != nil {
+		return nil, fmt.Errorf("parse %s: %w", path, err)
+	}
+	var keys []jwtKey
+	for i, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		pub, err := k.publicKey()
+		if err != nil {
+			return nil, fmt.Errorf("%s: key %d (%q): %w", path, i, k.Kid, err)
+		}
+		keys = append(keys, jwtKey{kid: k.Kid, alg: k.Alg, pub: pub})
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("%s: no signing keys", path)
+	}
+	return keys, nil
+}
+
+func (k jwk) publicKey() (crypto.PublicKey, error) {
+	b64 := base64.RawURLEncoding
+	switch k.Kty {
+	case "RSA":
+		n, err1 := b64.DecodeString(k.N)
+		e, err2 := b64.DecodeString(k.E)
+		if err1 != nil || err2 != nil || len(n) == 0 || len(e) == 0 || len(e) > 4 {
+			return nil, errors.New("invalid RSA key")
+		}
+		pub := &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+		return pub, checkRSASize(pub)
+	case "EC":
+		curves := map[string]elliptic.Curve{"P-256": elliptic.P256(), "P-384": elliptic.P384(), "P-521": elliptic.P521()}
+		curve, ok := curves[k.Crv]
+		if !ok {
+			return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		x, err1 := b64.DecodeString(k.X)
+		y, err2 := b64.DecodeString(k.Y)
+		size := (curve.Params().BitSize + 7) / 8
+		if err1 != nil || err2 != nil || len(x) != size || len(y) != size {
+			return nil, errors.New("invalid EC key")
+		}
+		return ecdsa.ParseUncompressedPublicKey(curve, append(append([]byte{4}, x...), y...))
+	case "OKP":
+		x, err := b64.DecodeString(k.X)
+		if k.Crv != "Ed25519" || err != nil || len(x) != ed25519.PublicKeySize {
+			return nil, errors.New("invalid Ed25519 key")
+		}
+		return ed25519.PublicKey(x), nil
+	}
+	return nil, fmt.Errorf("unsupported key type %q", k.Kty)
+}
+
+// loadPublicKeys reads PEM "PUBLIC KEY" and "CERTIFICATE" blocks.
+func loadPublicKeys(path string) ([]jwtKey, error) {
+	rest, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var keys []jwtKey
+	for {
+		var block *pem.Block
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			break
+		}
+		var pub crypto.PublicKey
+		switch block.Type {
+		case "PUBLIC KEY":
+			pub, err = x509.ParsePKIXPublicKey(block.Bytes)
+		case "CERTIFICATE":
+			var cert *x509.Certificate
+			if cert, err = x509.ParseCertificate(block.Bytes); err == nil {
+				pub = cert.PublicKey
+			}
+		default:
+			continue
+		}
+		if rsaPub, ok := pub.(*rsa.PublicKey); ok && err == nil {
+			err = checkRSASize(rsaPub)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		keys = append(keys, jwtKey{pub: pub})
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("%s: no public keys", path)
+	}
+	return keys, nil
+}
+
+// checkRSASize rejects RSA keys shorter than minRSABits, which can be factored.
+func checkRSASize(pub *rsa.PublicKey) error {
+	if bits := pub.N.BitLen(); bits < minRSABits {
+		return fmt.Errorf("RSA key of %d bits, at least %d required", bits, minRSABits)
+	}
+	return nil
+}
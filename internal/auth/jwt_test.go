@@ -0,0 +1,204 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+var b64 = base64.RawURLEncoding
+
+// signJWT builds a token with header {alg, kid} and claims, signed by key.
+func signJWT(t *testing.T, alg, kid string, claims map[string]any, key crypto.Signer) string {
+	t.Helper()
+	return signJWTHeader(t, map[string]any{"alg": alg, "kid": kid, "typ": "JWT"}, claims, key)
+}
+
+// signJWTHeader is signJWT with a caller-supplied header.
+func signJWTHeader(t *testing.T, h map[string]any, claims map[string]any, key crypto.Signer) string {
+	t.Helper()
+	header, _ := json.Marshal(h)
+	payload, _ := json.Marshal(claims)
+	signed := b64.EncodeToString(header) + "." + b64.EncodeToString(payload)
+	var sig []byte
+	var err error
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		sum := sha256.Sum256([]byte(signed))
+		sig, err = rsa.SignPKCS1v15(rand.Reader, k, crypto.SHA256, sum[:])
+	case *ecdsa.PrivateKey:
+		sum := sha256.Sum256([]byte(signed))
+		r, s, e := ecdsa.Sign(rand.Reader, k, sum[:])
+		sig, err = append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...), e
+	case ed25519.PrivateKey:
+		sig = ed25519.Sign(k, []byte(signed))
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed + "." + b64.EncodeToString(sig)
+}
+
+func writeJSON(t *testing.T, path string, v any) {
+	t.Helper()
+	raw, _ := json.Marshal(v)
+	if err := os.WriteFile(path, raw, 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestJWTVerifier_Verify(t *testing.T) {
+	rsaKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	ecKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	edPub, edKey, _ := ed25519.GenerateKey(rand.Reader)
+	ecPoint, _ := ecKey.PublicKey.Bytes()
+	dir := t.TempDir()
+	jwks := filepath.Join(dir, "jwks.json")
+	writeJSON(t, jwks, map[string]any{"keys": []map[string]string{
+		{"kty": "RSA", "kid": "rsa-1", "alg": "RS256", "use": "sig",
+			"n": b64.EncodeToString(rsaKey.N.Bytes()), "e": b64.EncodeToString([]byte{1, 0, 1})},
+		{"kty": "EC", "kid": "ec-1", "crv": "P-256", "x": b64.EncodeToString(ecPoint[1:33]), "y": b64.EncodeToString(ecPoint[33:])},
+		{"kty": "RSA", "kid": "enc", "use": "enc", "n": "AQAB", "e": "AQAB"},
+	}})
+	pubDER, _ := x509.MarshalPKIXPublicKey(edPub)
+	pemFile := filepath.Join(dir, "keys.pem")
+	if err := os.WriteFile(pemFile, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: pubDER}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	v, err := NewJWTVerifier(JWTConfig{
+		JWKSFile: jwks, PublicKeyFile: pemFile, Issuer: "https://id.example.com", Audience: "herald-dingtalk",
+		ScopePrefix: "herald-dingtalk:", Leeway: 30 * time.Second,
+	})
+	if err != nil {
+		t.Fatalf("NewJWTVerifier: %v", err)
+	}
+	now := time.Now()
+	claims := func(edit func(map[string]any)) map[string]any {
+		c := map[string]any{
+			"iss": "https://id.example.com", "aud": []string{"other", "herald-dingtalk"}, "sub": "herald-prod",
+			"exp": now.Add(5 * time.Minute).Unix(), "scope": "openid herald-dingtalk:send",
+		}
+		if edit != nil {
+			edit(c)
+		}
+		return c
+	}
+	good := signJWT(t, "RS256", "rsa-1", claims(nil), rsaKey)
+	tests := []struct {
+		name     string
+		token    string
+		scope    Scope
+		wantName string
+		wantErr  error
+	}{
+		{"rsa jwks", good, ScopeSend, "herald-prod", nil},
+		{"ec jwks", signJWT(t, "ES256", "ec-1", claims(nil), ecKey), ScopeSend, "herald-prod", nil},
+		{"ed25519 pem without kid", signJWT(t, "EdDSA", "", claims(nil), edKey), ScopeSend, "herald-prod", nil},
+		{"scope array", signJWT(t, "RS256", "rsa-1", claims(func(c map[string]any) {
+			c["scope"] = []string{"herald-dingtalk:resolve"}
+		}), rsaKey), ScopeResolve, "herald-prod", nil},
+		{"missing scope", good, ScopeAdmin, "herald-prod", ErrForbidden},
+		{"unprefixed scope", signJWT(t, "RS256", "rsa-1", claims(func(c map[string]any) { c["scope"] = "send" }), rsaKey), ScopeSend, "herald-prod", ErrForbidden},
+		{"expired", signJWT(t, "RS256", "rsa-1", claims(func(c map[string]any) { c["exp"] = now.Add(-time.Minute).Unix() }), rsaKey), ScopeSend, "herald-prod", ErrTokenExpired},
+		{"within leeway", signJWT(t, "RS256", "rsa-1", claims(func(c map[string]any) { c["exp"] = now.Add(-10 * time.Second).Unix() }), rsaKey), ScopeSend, "herald-prod", nil},
+		{"no exp", signJWT(t, "RS256", "rsa-1", claims(func(c map[string]any) { delete(c, "exp") }), rsaKey), ScopeSend, "herald-prod", ErrInvalidToken},
+		{"not yet valid", signJWT(t, "RS256", "rsa-1", claims(func(c map[string]any) { c["nbf"] = now.Add(time.Hour).Unix() }), rsaKey), ScopeSend, "herald-prod", ErrInvalidToken},
+		{"wrong issuer", signJWT(t, "RS256", "rsa-1", claims(func(c map[string]any) { c["iss"] = "https://evil" }), rsaKey), ScopeSend, "herald-prod", ErrInvalidToken},
+		{"wrong audience", signJWT(t, "RS256", "rsa-1", claims(func(c map[string]any) { c["aud"] = "stargate" }), rsaKey), ScopeSend, "herald-prod", ErrInvalidToken},
+		{"no subject", signJWT(t, "RS256", "rsa-1", claims(func(c map[string]any) { delete(c, "sub") }), rsaKey), ScopeSend, "", ErrInvalidToken},
+		{"kid of another key", signJWT(t, "RS256", "ec-1", claims(nil), rsaKey), ScopeSend, "", ErrInvalidToken},
+		{"alg differs from jwk", signJWT(t, "RS384", "rsa-1", claims(nil), rsaKey), ScopeSend, "", ErrInvalidToken},
+		{"unknown signer", signJWT(t, "EdDSA", "", claims(nil), ed25519.NewKeyFromSeed(make([]byte, 32))), ScopeSend, "", ErrInvalidToken},
+		{"tampered", good[:len(good)-4] + "AAAA", ScopeSend, "", ErrInvalidToken},
+		{"alg none", b64.EncodeToString([]byte(`{"alg":"none"}`)) + "." + b64.EncodeToString([]byte(`{"sub":"x"}`)) + ".", ScopeSend, "", ErrInvalidToken},
+		{"garbage", "not-a-jwt", ScopeSend, "", ErrInvalidToken},
+		{"unknown crit header", signJWTHeader(t, map[string]any{"alg": "RS256", "kid": "rsa-1", "crit": []string{"exp"}, "exp": 1}, claims(nil), rsaKey), ScopeSend, "", ErrInvalidToken},
+		{"exp overflows int64", signJWT(t, "RS256", "rsa-1", claims(func(c map[string]any) { c["exp"] = 1e300 }), rsaKey), ScopeSend, "herald-prod", ErrInvalidToken},
+		{"exp beyond float64", signJWT(t, "RS256", "rsa-1", claims(func(c map[string]any) { c["exp"] = json.Number("1e400") }), rsaKey), ScopeSend, "herald-prod", ErrInvalidToken},
+		{"nbf far in the past", signJWT(t, "RS256", "rsa-1", claims(func(c map[string]any) { c["nbf"] = -1e300 }), rsaKey), ScopeSend, "herald-prod", ErrInvalidToken},
+	}
+	for _, tt := range tests {
+		name, err := v.Verify(tt.token, tt.scope, now)
+		if name != tt.wantName || !errors.Is(err, tt.wantErr) {
+			t.Errorf("%s: Verify = %q, %v; want %q, %v", tt.name, name, err, tt.wantName, tt.wantErr)
+		}
+	}
+}
+
+func TestJWTVerifier_ConfigAndReload(t *testing.T) {
+	dir := t.TempDir()
+	jwks := filepath.Join(dir, "jwks.json")
+	if _, err := NewJWTVerifier(JWTConfig{JWKSFile: jwks, Issuer: "i"}); err == nil {
+		t.Error("expected error without audience")
+	}
+	if _, err := NewJWTVerifier(JWTConfig{Issuer: "i", Audience: "a"}); err == nil {
+		t.Error("expected error without keys")
+	}
+	if _, err := NewJWTVerifier(JWTConfig{JWKSFile: jwks, Issuer: "i", Audience: "a"}); err == nil {
+		t.Error("expected error for missing JWKS file")
+	}
+
+	_, k1, _ := ed25519.GenerateKey(rand.Reader)
+	_, k2, _ := ed25519.GenerateKey(rand.Reader)
+	okp := func(k ed25519.PrivateKey) map[string]any {
+		return map[string]any{"keys": []map[string]string{{"kty": "OKP", "crv": "Ed25519", "kid": "k", "x": b64.EncodeToString(k.Public().(ed25519.PublicKey))}}}
+	}
+	writeJSON(t, jwks, okp(k1))
+	v, err := NewJWTVerifier(JWTConfig{JWKSFile: jwks, Issuer: "i", Audience: "a"})
+	if err != nil {
+		t.Fatalf("NewJWTVerifier: %v", err)
+	}
+	claims := map[string]any{"iss": "i", "aud": "a", "sub": "svc", "exp": time.Now().Add(time.Minute).Unix(), "scope": "send"}
+	if _, err := v.Verify(signJWT(t, "EdDSA", "k", claims, k2), ScopeSend, time.Now()); !errors.Is(err, ErrInvalidToken) {
+		t.Fatalf("token from rotated-in key before reload = %v", err)
+	}
+	writeJSON(t, jwks, okp(k2))
+	if err := v.Reload(); err != nil {
+		t.Fatalf("Reload: %v", err)
+	}
+	if name, err := v.Verify(signJWT(t, "EdDSA", "k", claims, k2), ScopeSend, time.Now()); name != "svc" || err != nil {
+		t.Errorf("after reload = %q, %v", name, err)
+	}
+	writeJSON(t, jwks, map[string]any{"keys": []map[string]string{{"kty": "EC", "crv": "P-256", "x": "AA", "y": "AA"}}})
+	if err := v.Reload(); err == nil {
+		t.Error("expected error for invalid EC key")
+	}
+	if _, err := v.Verify(signJWT(t, "EdDSA", "k", claims, k2), ScopeSend, time.Now()); err != nil {
+		t.Errorf("failed reload should keep previous keys: %v", err)
+	}
+}
+
+func TestJWTVerifier_RejectsShortRSAKeys(t *testing.T) {
+	short, _ := rsa.GenerateKey(rand.Reader, 1024)
+	dir := t.TempDir()
+	jwks := filepath.Join(dir, "jwks.json")
+	writeJSON(t, jwks, map[string]any{"keys": []map[string]string{
+		{"kty": "RSA", "kid": "rsa-1024", "n": b64.EncodeToString(short.N.Bytes()), "e": b64.EncodeToString([]byte{1, 0, 1})},
+	}})
+	if _, err := NewJWTVerifier(JWTConfig{JWKSFile: jwks, Issuer: "i", Audience: "a"}); err == nil || !strings.Contains(err.Error(), "at least 2048") {
+		t.Errorf("1024-bit JWKS key: err = %v, want a key size error", err)
+	}
+
+	der, _ := x509.MarshalPKIXPublicKey(&short.PublicKey)
+	pemFile := filepath.Join(dir, "keys.pem")
+	if err := os.WriteFile(pemFile, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewJWTVerifier(JWTConfig{PublicKeyFile: pemFile, Issuer: "i", Audience: "a"}); err == nil || !strings.Contains(err.Error(), "at least 2048") {
+		t.Errorf("1024-bit PEM key: err = %v, want a key size error", err)
+	}
+}
@@ -0,0 +1,247 @@
+package auth
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"sync/atomic"
+	"time"
+)
+
+// Scope is a permission granted to an API key.
+type Scope string
+
+// Scopes checked by the handlers.
+const (
+	// ScopeSend covers POST /v1/send, GET /v1/jobs/:id and DELETE /v1/scheduled/:key.
+	ScopeSend Scope = "send"
+	// ScopeResolve covers POST /v1/resolve.
+	ScopeResolve Scope = "resolve"
+	// ScopeAdmin covers /v1/admin/* and GET /v1/idempotency/stats.
+	ScopeAdmin Scope = "admin"
+	// ScopeMetrics covers GET /metrics when METRICS_REQUIRE_AUTH is on.
+	ScopeMetrics Scope = "metrics"
+)
+
+// AllScopes lists every scope, e.g. for the legacy API_KEY.
+var AllScopes = []Scope{ScopeSend, ScopeResolve, ScopeAdmin, ScopeMetrics}
+
+// LegacyKeyName is the caller name of the key configured with API_KEY.
+const LegacyKeyName = "default"
+
+// Errors returned by Authorize. ErrMissingKey, ErrInvalidKey and ErrKeyExpired are
+// authentication failures (401); ErrForbidden means the key lacks the scope (403).
+var (
+	ErrMissingKey = errors.New("missing API key")
+	ErrInvalidKey = errors.New("invalid API key")
+	ErrKeyExpired = errors.New("API key expired")
+	ErrForbidden  = errors.New("API key not allowed for this endpoint")
+)
+
+// Key is a named API key as stored in the keys file. Either Key (the secret itself) or KeySHA256
+// (hex SHA-256 of the secret, to keep it out of the file) is set, and/or ClientCertCN: the
+// subject common name of a TLS client certificate that identifies the caller without a secret.
+type Key struct {
+	Name         string    `json:"name"`
+	Key          string    `json:"key,omitempty"`
+	KeySHA256    string    `json:"key_sha256,omitempty"`
+	ClientCertCN string    `json:"client_cert_cn,omitempty"`
+	Scopes       []Scope   `json:"scopes"`
+	ExpiresAt    time.Time `json:"expires_at,omitzero"`
+}
+
+type keyEntry struct {
+	name   string
+	digest [sha256.Size]byte
+	// hasDigest is false for entries identified only by a client certificate.
+	hasDigest bool
+	// secret is the plain key, needed to verify HMAC signatures; empty for key_sha256 entries.
+	secret    []byte
+	certCN    string
+	scopes    []Scope
+	expiresAt time.Time
+}
+
+type keysFile struct {
+	Keys []Key `json:"keys"`
+}
+
+// KeyRing holds the API keys callers may present. An empty ring disables authentication.
+// It is safe for concurrent use; Reload swaps the keys atomically.
+type KeyRing struct {
+	path   string
+	legacy string
+	keys   atomic.Pointer[[]keyEntry]
+}
+
+// NewKeyRing creates a ring from keys. A non-empty legacy secret (API_KEY) is added as the
+// "default" key with all scopes.
+func NewKeyRing(legacy string, keys ...Key) (*KeyRing, error) {
+	r := &KeyRing{legacy: legacy}
+	if err := r.set(keys); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// LoadKeyRing reads keys from a JSON file ({"keys": [...]}) and adds the legacy secret as
+// NewKeyRing does. Reload re-reads the same file.
+func LoadKeyRing(path, legacy string) (*KeyRing, error) {
+	r := &KeyRing{path: path, legacy: legacy}
+	if err := r.Reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Reload re-reads the keys file, so one caller's key can be rotated without a restart. On error
+// the current keys stay in effect. It is a no-op for rings not loaded from a file.
+func (r *KeyRing) Reload() error {
+	if r.path == "" {
+		return nil
+	}
+	raw, err := os.ReadFile(r.path)
+	if err != nil {
+		return err
+	}
+	var f keysFile
+	if err := json.Unmarshal(raw, &f); err != nil {
+		return fmt.Errorf("parse %s: %w", r.path, err)
+	}
+	return r.set(f.Keys)
+}
+
+// set validates keys and installs them together with the legacy key.
+func (r *KeyRing) set(keys []Key) error {
+	entries := make([]keyEntry, 0, len(keys)+1)
+	seen, seenCN := make(map[string]bool), make(map[string]bool)
+	for i, k := range keys {
+		if k.Name == "" {
+			return fmt.Errorf("key %d: name is required", i)
+		}
+		if seen[k.Name] || (k.Name == LegacyKeyName && r.legacy != "") {
+			return fmt.Errorf("key %q: duplicate name", k.Name)
+		}
+		seen[k.Name] = true
+		e := keyEntry{name: k.Name, hasDigest: true, certCN: k.ClientCertCN, scopes: k.Scopes, expiresAt: k.ExpiresAt}
+		if k.ClientCertCN != "" {
+			if seenCN[k.ClientCertCN] {
+				return fmt.Errorf("key %q: duplicate client_cert_cn %q", k.Name, k.ClientCertCN)
+			}
+			seenCN[k.ClientCertCN] = true
+		}
+		switch {
+		case k.Key != "" && k.KeySHA256 != "":
+			return fmt.Errorf("key %q: set only one of key and key_sha256", k.Name)
+		case k.Key != "":
+			e.digest = sha256.Sum256([]byte(k.Key))
+			e.secret = []byte(k.Key)
+		case k.KeySHA256 != "":
+			b, err := hex.DecodeString(k.KeySHA256)
+			if err != nil || len(b) != sha256.Size {
+				return fmt.Errorf("key %q: key_sha256 must be 64 hex characters", k.Name)
+			}
+			copy(e.digest[:], b)
+		case k.ClientCertCN != "":
+			e.hasDigest = false
+		default:
+			return fmt.Errorf("key %q: key, key_sha256 or client_cert_cn is required", k.Name)
+		}
+		for _, s := range k.Scopes {
+			if !slices.Contains(AllScopes, s) {
+				return fmt.Errorf("key %q: unknown scope %q", k.Name, s)
+			}
+		}
+		entries = append(entries, e)
+	}
+	if r.legacy != "" {
+		entries = append(entries, keyEntry{name: LegacyKeyName, hasDigest: true, digest: sha256.Sum256([]byte(r.legacy)), secret: []byte(r.legacy), scopes: AllScopes})
+	}
+	r.keys.Store(&entries)
+	return nil
+}
+
+// Enabled reports whether any key is configured; without keys every request is allowed.
+func (r *KeyRing) Enabled() bool {
+	return r != nil && len(*r.keys.Load()) > 0
+}
+
+// Names returns the configured caller names.
+func (r *KeyRing) Names() []string {
+	if r == nil {
+		return nil
+	}
+	var names []string
+	for _, e := range *r.keys.Load() {
+		names = append(names, e.name)
+	}
+	return names
+}
+
+// Authorize checks secret against every key in constant time and returns the matching caller
+// name if the key is unexpired and has scope. With no keys configured it returns "" and nil.
+func (r *KeyRing) Authorize(secret string, scope Scope, now time.Time) (string, error) {
+	if !r.Enabled() {
+		return "", nil
+	}
+	if secret == "" {
+		return "", ErrMissingKey
+	}
+	// Compare digests so timing depends neither on the secret's length nor on which key matched.
+	digest := sha256.Sum256([]byte(secret))
+	var match *keyEntry
+	entries := *r.keys.Load()
+	for i := range entries {
+		if subtle.ConstantTimeCompare(digest[:], entries[i].digest[:]) == 1 && entries[i].hasDigest {
+			match = &entries[i]
+		}
+	}
+	if match == nil {
+		return "", ErrInvalidKey
+	}
+	return match.name, match.check(scope, now)
+}
+
+// AuthorizeCert returns the caller whose client_cert_cn is cn (the subject of a client certificate
+// the TLS layer already verified) if the key is unexpired and has scope. ok is false when no key
+// claims cn, so the caller can fall back to X-API-Key.
+func (r *KeyRing) AuthorizeCert(cn string, scope Scope, now time.Time) (name string, ok bool, err error) {
+	if cn == "" || r == nil {
+		return "", false, nil
+	}
+	for _, e := range *r.keys.Load() {
+		if e.certCN == cn {
+			return e.name, true, e.check(scope, now)
+		}
+	}
+	return "", false, nil
+}
+
+// lookup returns the key named name.
+func (r *KeyRing) lookup(name string) (keyEntry, bool) {
+	if r == nil {
+		return keyEntry{}, false
+	}
+	for _, e := range *r.keys.Load() {
+		if e.name == name {
+			return e, true
+		}
+	}
+	return keyEntry{}, false
+}
+
+// check reports whether the key may be used for scope at now.
+func (e *keyEntry) check(scope Scope, now time.Time) error {
+	if !e.expiresAt.IsZero() && !now.Before(e.expiresAt) {
+		return ErrKeyExpired
+	}
+	if !slices.Contains(e.scopes, scope) {
+		return ErrForbidden
+	}
+	return nil
+}
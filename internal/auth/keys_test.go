@@ -0,0 +1,143 @@
+package auth
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestKeyRing_Authorize(t *testing.T) {
+	now := time.Now()
+	sum := sha256.Sum256([]byte("stargate-secret"))
+	ring, err := NewKeyRing("", Key{Name: "herald-prod", Key: "herald-secret", Scopes: []Scope{ScopeSend}},
+		Key{Name: "stargate", KeySHA256: hex.EncodeToString(sum[:]), Scopes: []Scope{ScopeResolve}},
+		Key{Name: "old", Key: "old-secret", Scopes: AllScopes, ExpiresAt: now.Add(-time.Minute)})
+	if err != nil {
+		t.Fatalf("NewKeyRing: %v", err)
+	}
+	tests := []struct {
+		secret   string
+		scope    Scope
+		wantName string
+		wantErr  error
+	}{
+		{"herald-secret", ScopeSend, "herald-prod", nil},
+		{"herald-secret", ScopeAdmin, "herald-prod", ErrForbidden},
+		{"stargate-secret", ScopeResolve, "stargate", nil},
+		{"stargate-secret", ScopeSend, "stargate", ErrForbidden},
+		{"old-secret", ScopeSend, "old", ErrKeyExpired},
+		{"", ScopeSend, "", ErrMissingKey},
+		{"herald-secret-x", ScopeSend, "", ErrInvalidKey},
+	}
+	for _, tt := range tests {
+		name, err := ring.Authorize(tt.secret, tt.scope, now)
+		if name != tt.wantName || !errors.Is(err, tt.wantErr) {
+			t.Errorf("Authorize(%q, %s) = %q, %v; want %q, %v", tt.secret, tt.scope, name, err, tt.wantName, tt.wantErr)
+		}
+	}
+}
+
+func TestKeyRing_DisabledAndLegacy(t *testing.T) {
+	empty, _ := NewKeyRing("")
+	if empty.Enabled() {
+		t.Error("empty ring should be disabled")
+	}
+	if name, err := empty.Authorize("", ScopeAdmin, time.Now()); name != "" || err != nil {
+		t.Errorf("disabled ring Authorize = %q, %v; want allowed", name, err)
+	}
+	legacy, _ := NewKeyRing("shared")
+	for _, scope := range AllScopes {
+		if name, err := legacy.Authorize("shared", scope, time.Now()); name != LegacyKeyName || err != nil {
+			t.Errorf("legacy key for %s = %q, %v", scope, name, err)
+		}
+	}
+	if _, err := NewKeyRing("shared", Key{Name: LegacyKeyName, Key: "x", Scopes: AllScopes}); err == nil {
+		t.Error("a file key named default must not shadow API_KEY")
+	}
+}
+
+func TestKeyRing_AuthorizeCert(t *testing.T) {
+	now := time.Now()
+	ring, err := NewKeyRing("", Key{Name: "herald-prod", ClientCertCN: "herald.internal", Scopes: []Scope{ScopeSend}},
+		Key{Name: "stargate", Key: "sg", ClientCertCN: "stargate.internal", Scopes: []Scope{ScopeResolve}, ExpiresAt: now.Add(-time.Minute)})
+	if err != nil {
+		t.Fatalf("NewKeyRing: %v", err)
+	}
+	if name, ok, err := ring.AuthorizeCert("herald.internal", ScopeSend, now); name != "herald-prod" || !ok || err != nil {
+		t.Errorf("cert for send = %q, %v, %v", name, ok, err)
+	}
+	if _, _, err := ring.AuthorizeCert("herald.internal", ScopeAdmin, now); !errors.Is(err, ErrForbidden) {
+		t.Errorf("cert for admin = %v, want ErrForbidden", err)
+	}
+	if _, _, err := ring.AuthorizeCert("stargate.internal", ScopeResolve, now); !errors.Is(err, ErrKeyExpired) {
+		t.Errorf("expired cert key = %v, want ErrKeyExpired", err)
+	}
+	if _, ok, _ := ring.AuthorizeCert("unknown", ScopeSend, now); ok {
+		t.Error("unknown CN should not match")
+	}
+	// A certificate-only key has no secret: the zero digest must never match X-API-Key.
+	if _, err := ring.Authorize("", ScopeSend, now); !errors.Is(err, ErrMissingKey) {
+		t.Errorf("empty secret = %v", err)
+	}
+	if name, err := ring.Authorize("anything", ScopeSend, now); name != "" || !errors.Is(err, ErrInvalidKey) {
+		t.Errorf("secret against cert-only key = %q, %v", name, err)
+	}
+}
+
+func TestNewKeyRing_Validation(t *testing.T) {
+	bad := [][]Key{
+		{{Key: "s", Scopes: AllScopes}},
+		{{Name: "a", Scopes: AllScopes}},
+		{{Name: "a", Key: "s", KeySHA256: "00", Scopes: AllScopes}},
+		{{Name: "a", KeySHA256: "zz", Scopes: AllScopes}},
+		{{Name: "a", Key: "s", Scopes: []Scope{"root"}}},
+		{{Name: "a", Key: "s"}, {Name: "a", Key: "t"}},
+		{{Name: "a", ClientCertCN: "svc"}, {Name: "b", ClientCertCN: "svc"}},
+	}
+	for i, keys := range bad {
+		if _, err := NewKeyRing("", keys...); err == nil {
+			t.Errorf("case %d: expected validation error", i)
+		}
+	}
+}
+
+func TestLoadKeyRing_Reload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "keys.json")
+	write := func(body string) {
+		if err := os.WriteFile(path, []byte(body), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write(`{"keys":[{"name":"herald-prod","key":"v1","scopes":["send"]},{"name":"stargate","key":"sg","scopes":["resolve"],"expires_at":"2099-01-01T00:00:00Z"}]}`)
+	ring, err := LoadKeyRing(path, "")
+	if err != nil {
+		t.Fatalf("LoadKeyRing: %v", err)
+	}
+	if name, err := ring.Authorize("v1", ScopeSend, time.Now()); name != "herald-prod" || err != nil {
+		t.Fatalf("v1 = %q, %v", name, err)
+	}
+	write(`{"keys":[{"name":"herald-prod","key":"v2","scopes":["send"]},{"name":"stargate","key":"sg","scopes":["resolve"]}]}`)
+	if err := ring.Reload(); err != nil {
+		t.Fatalf("Reload: %v", err)
+	}
+	if _, err := ring.Authorize("v1", ScopeSend, time.Now()); !errors.Is(err, ErrInvalidKey) {
+		t.Errorf("rotated-out key = %v, want ErrInvalidKey", err)
+	}
+	if name, err := ring.Authorize("sg", ScopeResolve, time.Now()); name != "stargate" || err != nil {
+		t.Errorf("untouched key = %q, %v", name, err)
+	}
+	write(`{"keys":[{"name":"","key":"x"}]}`)
+	if err := ring.Reload(); err == nil {
+		t.Error("expected error for invalid file")
+	}
+	if name, _ := ring.Authorize("v2", ScopeSend, time.Now()); name != "herald-prod" {
+		t.Error("failed reload must keep the previous keys")
+	}
+	if _, err := LoadKeyRing(filepath.Join(t.TempDir(), "missing.json"), ""); err == nil {
+		t.Error("expected error for missing file")
+	}
+}
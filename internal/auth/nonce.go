@@ -0,0 +1,68 @@
+package auth
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// MemoryNonceStore is the default process-local NonceStore.
+type MemoryNonceStore struct {
+	mu    sync.Mutex
+	seen  map[string]time.Time
+	swept time.Time
+}
+
+// nonceSweepEvery is how often MemoryNonceStore drops expired nonces.
+const nonceSweepEvery = time.Minute
+
+// NewMemoryNonceStore creates an empty nonce store. Only signed requests with a valid signature
+// reach it, so its size is bounded by what authenticated callers send within the TTL.
+func NewMemoryNonceStore() *MemoryNonceStore {
+	return &MemoryNonceStore{seen: make(map[string]time.Time)}
+}
+
+// Use implements NonceStore.
+func (m *MemoryNonceStore) Use(_ context.Context, key string, ttl time.Duration) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := time.Now()
+	if now.Sub(m.swept) >= nonceSweepEvery {
+		m.swept = now
+		for k, exp := range m.seen {
+			if !now.Before(exp) {
+				delete(m.seen, k)
+			}
+		}
+	}
+	if exp, ok := m.seen[key]; ok && now.Before(exp) {
+		return false, nil
+	}
+	m.seen[key] = now.Add(ttl)
+	return true, nil
+}
+
+// Len returns the number of recorded nonces, including expired ones not yet swept.
+func (m *MemoryNonceStore) Len() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return len(m.seen)
+}
+
+// RedisNonceStore is a NonceStore shared by all replicas through Redis (SET NX PX).
+type RedisNonceStore struct {
+	rdb    redis.UniversalClient
+	prefix string
+}
+
+// NewRedisNonceStore creates a Redis-backed nonce store. prefix is prepended to every key.
+func NewRedisNonceStore(rdb redis.UniversalClient, prefix string) *RedisNonceStore {
+	return &RedisNonceStore{rdb: rdb, prefix: prefix}
+}
+
+// Use implements NonceStore.
+func (r *RedisNonceStore) Use(ctx context.Context, key string, ttl time.Duration) (bool, error) {
+	return r.rdb.SetNX(ctx, r.prefix+"nonce:"+key, 1, ttl).Result()
+}
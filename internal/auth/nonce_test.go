@@ -0,0 +1,50 @@
+package auth
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+)
+
+func TestRedisNonceStore(t *testing.T) {
+	mr := miniredis.RunT(t)
+	rdb := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	defer func() { _ = rdb.Close() }()
+	ctx := context.Background()
+	a, b := NewRedisNonceStore(rdb, "p:"), NewRedisNonceStore(rdb, "p:")
+	if fresh, err := a.Use(ctx, "k:n1", time.Minute); !fresh || err != nil {
+		t.Fatalf("first use = %v, %v", fresh, err)
+	}
+	if fresh, err := b.Use(ctx, "k:n1", time.Minute); fresh || err != nil {
+		t.Fatalf("replay on another replica = %v, %v; want not fresh", fresh, err)
+	}
+	mr.FastForward(2 * time.Minute)
+	if fresh, _ := a.Use(ctx, "k:n1", time.Minute); !fresh {
+		t.Error("nonce should expire after ttl")
+	}
+}
+
+func TestMemoryNonceStore(t *testing.T) {
+	m := NewMemoryNonceStore()
+	ctx := context.Background()
+	if fresh, _ := m.Use(ctx, "a", time.Hour); !fresh {
+		t.Fatal("first use not fresh")
+	}
+	if fresh, _ := m.Use(ctx, "a", time.Hour); fresh {
+		t.Fatal("second use fresh")
+	}
+	if fresh, _ := m.Use(ctx, "b", -time.Second); !fresh {
+		t.Fatal("b not fresh")
+	}
+	if fresh, _ := m.Use(ctx, "b", time.Hour); !fresh {
+		t.Error("expired nonce should be usable again")
+	}
+	m.swept = time.Time{}
+	_, _ = m.Use(ctx, "c", -time.Second)
+	if n := m.Len(); n != 3 {
+		t.Errorf("Len = %d, want 3 (a, b, c)", n)
+	}
+}
@@ -0,0 +1,79 @@
+package auth
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func signed(secret, keyID, nonce string, ts time.Time, body string) SignedRequest {
+	stamp := strconv.FormatInt(ts.Unix(), 10)
+	return SignedRequest{
+		Method: "POST", Target: "/v1/send", Body: []byte(body),
+		KeyID: keyID, Timestamp: stamp, Nonce: nonce,
+		Signature: Sign([]byte(secret), "POST", "/v1/send", stamp, nonce, []byte(body)),
+	}
+}
+
+func TestSign(t *testing.T) {
+	// HMAC-SHA256("secret", "POST\n/v1/send\n1700000000\nn1\n" + hex(SHA-256("{}"))).
+	const want = "7fd3b6486792f7de0a5b87fab3a90a7febf21948adf9ddc1c5ebc1a3922da308"
+	if got := Sign([]byte("secret"), "post", "/v1/send", "1700000000", "n1", []byte("{}")); got != want {
+		t.Fatalf("Sign = %q, want %q", got, want)
+	}
+	if want == Sign([]byte("secret"), "POST", "/v1/send", "1700000000", "n1", []byte("{ }")) {
+		t.Error("signature must cover the body")
+	}
+}
+
+func TestVerifier_Verify(t *testing.T) {
+	sum := sha256.Sum256([]byte("hashed-secret"))
+	keys, err := NewKeyRing("",
+		Key{Name: "herald-prod", Key: "s3cret", Scopes: []Scope{ScopeSend}},
+		Key{Name: "hash-only", KeySHA256: hex.EncodeToString(sum[:]), Scopes: AllScopes},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	v := NewVerifier(keys, NewMemoryNonceStore(), 5*time.Minute)
+	ctx := context.Background()
+	now := time.Now()
+
+	if name, err := v.Verify(ctx, signed("s3cret", "herald-prod", "n1", now, `{"to":"u1"}`), ScopeSend, now); name != "herald-prod" || err != nil {
+		t.Fatalf("valid request = %q, %v", name, err)
+	}
+	if _, err := v.Verify(ctx, signed("s3cret", "herald-prod", "n1", now, `{"to":"u1"}`), ScopeSend, now); !errors.Is(err, ErrReplayed) {
+		t.Errorf("replay = %v, want ErrReplayed", err)
+	}
+	tampered := signed("s3cret", "herald-prod", "n2", now, `{"to":"u1"}`)
+	tampered.Body = []byte(`{"to":"u2"}`)
+	if _, err := v.Verify(ctx, tampered, ScopeSend, now); !errors.Is(err, ErrBadSignature) {
+		t.Errorf("tampered body = %v, want ErrBadSignature", err)
+	}
+	// The rejected request did not burn its nonce.
+	if _, err := v.Verify(ctx, signed("s3cret", "herald-prod", "n2", now, `{"to":"u1"}`), ScopeSend, now); err != nil {
+		t.Errorf("nonce of a forged request = %v, want usable", err)
+	}
+	if _, err := v.Verify(ctx, signed("s3cret", "herald-prod", "n3", now.Add(-10*time.Minute), "{}"), ScopeSend, now); !errors.Is(err, ErrStaleTimestamp) {
+		t.Errorf("old timestamp = %v, want ErrStaleTimestamp", err)
+	}
+	if _, err := v.Verify(ctx, signed("s3cret", "herald-prod", "n4", now.Add(10*time.Minute), "{}"), ScopeSend, now); !errors.Is(err, ErrStaleTimestamp) {
+		t.Errorf("future timestamp = %v, want ErrStaleTimestamp", err)
+	}
+	if _, err := v.Verify(ctx, signed("s3cret", "nobody", "n5", now, "{}"), ScopeSend, now); !errors.Is(err, ErrInvalidKey) {
+		t.Errorf("unknown key id = %v, want ErrInvalidKey", err)
+	}
+	if _, err := v.Verify(ctx, signed("hashed-secret", "hash-only", "n6", now, "{}"), ScopeSend, now); !errors.Is(err, ErrInvalidKey) {
+		t.Errorf("key_sha256-only key = %v, want ErrInvalidKey (cannot sign)", err)
+	}
+	if _, err := v.Verify(ctx, signed("s3cret", "herald-prod", "n7", now, "{}"), ScopeResolve, now); !errors.Is(err, ErrForbidden) {
+		t.Errorf("missing scope = %v, want ErrForbidden", err)
+	}
+	if _, err := v.Verify(ctx, SignedRequest{KeyID: "herald-prod"}, ScopeSend, now); !errors.Is(err, ErrMissingKey) {
+		t.Errorf("missing headers = %v, want ErrMissingKey", err)
+	}
+}
@@ -1,6 +1,10 @@
 package config
 
 import (
+	"errors"
+	"fmt"
+	"strconv"
+
 	"github.com/soulteary/cli-kit/env"
 )
 
@@ -10,14 +14,148 @@ const LookupModeNone = "none"
 // LookupModeMobile 表示 to 支持 userid 或手机号；为手机号时调用钉钉 API 查 userid 再发送。
 const LookupModeMobile = "mobile"
 
+// TokenCacheMemory 表示 access_token 仅缓存在本进程内存中。
+const TokenCacheMemory = "memory"
+
+// TokenCacheRedis 表示 access_token 缓存在 Redis 中，由所有副本共享。
+const TokenCacheRedis = "redis"
+
+// RateLimitStoreMemory 表示 /v1/send 限流令牌桶保存在本进程内存中（每个副本各自限流）。
+const RateLimitStoreMemory = "memory"
+
+// RateLimitStoreRedis 表示限流令牌桶保存在 Redis 中，由所有副本共享。
+const RateLimitStoreRedis = "redis"
+
+// RequestSigningOff 表示不接受 HMAC 签名请求，仅使用 X-API-Key。
+const RequestSigningOff = "off"
+
+// RequestSigningOptional 表示同时接受 HMAC 签名请求与 X-API-Key。
+const RequestSigningOptional = "optional"
+
+// RequestSigningRequired 表示需要 send 或 resolve scope 的端点只接受 HMAC 签名请求（管理端点仍接受 X-API-Key）。
+const RequestSigningRequired = "required"
+
+// NonceStoreMemory 表示签名请求的 nonce 记录在本进程内存中。
+const NonceStoreMemory = "memory"
+
+// NonceStoreRedis 表示 nonce 记录在 Redis 中，由所有副本共享，防止跨副本重放。
+const NonceStoreRedis = "redis"
+
+// maxTokenRefreshLeadSec 是 DINGTALK_TOKEN_REFRESH_AHEAD_SECONDS 与 DINGTALK_TOKEN_REFRESH_JITTER_SECONDS 之和的上限：钉钉 access_token 有效期 7200 秒的一半。
+const maxTokenRefreshLeadSec = 3600
+
+// TLSClientAuthRequire 表示配置 TLS_CLIENT_CA_FILE 后，客户端必须出示由该 CA 签发的证书（mTLS）。
+const TLSClientAuthRequire = "require"
+
+// TLSClientAuthOptional 表示客户端证书可选：出示则校验，未出示则回退到 X-API-Key / 签名认证。
+const TLSClientAuthOptional = "optional"
+
 var (
-	Port       = env.Get("PORT", ":8083")
-	APIKey     = env.Get("API_KEY", "")
-	AppKey     = env.Get("DINGTALK_APP_KEY", "")
-	AppSecret  = env.Get("DINGTALK_APP_SECRET", "")
-	AgentID    = env.Get("DINGTALK_AGENT_ID", "")
-	LogLevel   = env.Get("LOG_LEVEL", "info")
-	IdemTTLSec = env.GetInt("IDEMPOTENCY_TTL_SECONDS", 300)
+	Port      = env.Get("PORT", ":8083")
+	APIKey    = env.Get("API_KEY", "")
+	AppKey    = env.Get("DINGTALK_APP_KEY", "")
+	AppSecret = env.Get("DINGTALK_APP_SECRET", "")
+	AgentID   = env.Get("DINGTALK_AGENT_ID", "")
+	LogLevel  = env.Get("LOG_LEVEL", "info")
+	// LogRedaction: 日志脱敏级别。off=原样记录（仅限本地调试）；partial=手机号、userid 保留首尾，auth_code、token 与消息内容完全遮盖；full=全部遮盖
+	LogRedaction = env.Get("LOG_REDACTION", "partial")
+	IdemTTLSec   = env.GetInt("IDEMPOTENCY_TTL_SECONDS", 300)
+	// BodyLimitBytes: 请求体上限（字节），超出时在认证与解析之前直接返回 413
+	BodyLimitBytes = env.GetInt("HTTP_BODY_LIMIT_BYTES", 1<<20)
+	// IdemWaitSec: 相同 Idempotency-Key 的并发请求等待首个请求完成的最长秒数；0 表示直接返回 409
+	IdemWaitSec = env.GetInt("IDEMPOTENCY_WAIT_SECONDS", 5)
+	// IdemMaxEntries: 幂等缓存最大条目数，超出后按 LRU 淘汰；0 表示不限制
+	IdemMaxEntries = env.GetInt("IDEMPOTENCY_MAX_ENTRIES", 10000)
+	// IdemSweepSec: 后台清理过期幂等条目的间隔（秒）
+	IdemSweepSec = env.GetInt("IDEMPOTENCY_SWEEP_SECONDS", 60)
+	// IdemPersistFile: 幂等缓存快照文件；非空时启动加载、退出时写入，使 TTL 内的 key 跨重启保留（单节点部署）
+	IdemPersistFile = env.Get("IDEMPOTENCY_PERSIST_FILE", "")
+	// IdemCacheTransientFailures: 是否缓存确定未送达钉钉的失败（限流、熔断、钉钉 429/503/-1）；默认不缓存，使用相同 key 重试会真正重发
+	IdemCacheTransientFailures = getBool("IDEMPOTENCY_CACHE_TRANSIENT_FAILURES", false)
+	// TokenRefreshAheadSec: 后台在 access_token 过期前多少秒主动刷新（与 TokenRefreshJitterSec 之和须小于 3600）；0 表示关闭后台刷新（仅在请求时刷新）
+	TokenRefreshAheadSec = env.GetInt("DINGTALK_TOKEN_REFRESH_AHEAD_SECONDS", 300)
+	// TokenRefreshJitterSec: 主动刷新时间的随机提前量上限（秒），避免多副本同时刷新
+	TokenRefreshJitterSec = env.GetInt("DINGTALK_TOKEN_REFRESH_JITTER_SECONDS", 60)
+	// TokenCache: memory=每个进程各自缓存 access_token；redis=多副本通过 Redis 共享同一 token（需 REDIS_URL）
+	TokenCache = env.Get("DINGTALK_TOKEN_CACHE", TokenCacheMemory)
+	// RetryMaxAttempts: 调用钉钉 API 遇到临时失败（网络错误、5xx、errcode=-1 系统繁忙）时的总尝试次数；1 表示不重试
+	RetryMaxAttempts = env.GetInt("DINGTALK_RETRY_MAX_ATTEMPTS", 3)
+	// RetryBaseDelayMs: 首次重试前的退避时间（毫秒），之后每次翻倍并加随机抖动
+	RetryBaseDelayMs = env.GetInt("DINGTALK_RETRY_BASE_DELAY_MS", 200)
+	// RetryMaxDelayMs: 单次退避时间上限（毫秒）
+	RetryMaxDelayMs = env.GetInt("DINGTALK_RETRY_MAX_DELAY_MS", 2000)
+	// RetryMaxElapsedMs: 一次调用（含全部重试）的总时长上限（毫秒），同时受请求上下文约束
+	RetryMaxElapsedMs = env.GetInt("DINGTALK_RETRY_MAX_ELAPSED_MS", 10000)
+	// BreakerThreshold: 连续多少次临时失败后熔断（直接返回 provider_down，不再请求钉钉）；0 表示关闭熔断
+	BreakerThreshold = env.GetInt("DINGTALK_BREAKER_THRESHOLD", 5)
+	// BreakerOpenSec: 熔断持续秒数，之后放行一个探测请求（半开），成功即恢复
+	BreakerOpenSec = env.GetInt("DINGTALK_BREAKER_OPEN_SECONDS", 30)
+	// QPSSend / QPSLookup / QPSOAuth: 调用钉钉发送、手机号查询、OAuth 接口的每秒请求上限（本进程），突发请求排队等待而非触发钉钉限流；0 表示不限制
+	QPSSend   = env.GetInt("DINGTALK_QPS_SEND", 20)
+	QPSLookup = env.GetInt("DINGTALK_QPS_LOOKUP", 20)
+	QPSOAuth  = env.GetInt("DINGTALK_QPS_OAUTH", 20)
+	// QueueFile: 异步发送队列的 WAL 文件；为空时不启用 mode=async 与定时发送
+	QueueFile = env.Get("QUEUE_FILE", "")
+	// QueueWorkers: 异步队列并发投递数
+	QueueWorkers = env.GetInt("QUEUE_WORKERS", 4)
+	// QueueMaxAttempts: 异步任务最多投递次数，超过后标记为 failed
+	QueueMaxAttempts = env.GetInt("QUEUE_MAX_ATTEMPTS", 5)
+	// QueueRetryBaseSec / QueueRetryMaxSec: 异步任务重试的指数退避起始值与上限（秒）
+	QueueRetryBaseSec = env.GetInt("QUEUE_RETRY_BASE_SECONDS", 5)
+	QueueRetryMaxSec  = env.GetInt("QUEUE_RETRY_MAX_SECONDS", 300)
+	// QueueRetentionSec: 成功任务保留多久（秒）以供 GET /v1/jobs/:id 查询；失败任务作为死信保留直至清除
+	QueueRetentionSec = env.GetInt("QUEUE_RETENTION_SECONDS", 86400)
+	// QuotaPerUser: 每个钉钉用户在一个窗口内最多发送的工作通知数（与钉钉套餐限制一致）；0 表示不限制
+	QuotaPerUser = env.GetInt("DINGTALK_QUOTA_PER_USER", 500)
+	// QuotaWindowSec: 配额窗口（秒），按北京时间对齐；默认一天，与钉钉每日零点重置一致
+	QuotaWindowSec = env.GetInt("DINGTALK_QUOTA_WINDOW_SECONDS", 86400)
+	// QuotaDedupContent: 同一窗口内向同一用户发送相同内容时直接拒绝（钉钉会静默去重）
+	QuotaDedupContent = getBool("DINGTALK_QUOTA_DEDUP_CONTENT", true)
+	// APIKeysFile: 多个具名 API Key 的 JSON 文件（名称、密钥或其 SHA-256、scopes、可选过期时间）；收到 SIGHUP 时重新加载。API_KEY 仍作为名为 default、拥有全部 scope 的密钥生效
+	APIKeysFile = env.Get("API_KEYS_FILE", "")
+	// RequestSigning: off=仅 X-API-Key；optional=也接受 HMAC-SHA256 签名请求；required=需要 send / resolve scope 的端点必须签名
+	RequestSigning = env.Get("REQUEST_SIGNING", RequestSigningOff)
+	// RequestSigningMaxSkewSec: 签名请求时间戳与服务器时间允许的最大偏差（秒）；nonce 保留其两倍时长
+	RequestSigningMaxSkewSec = env.GetInt("REQUEST_SIGNING_MAX_SKEW_SECONDS", 300)
+	// RequestSigningNonceStore: memory=每个副本各自记录 nonce；redis=多副本共享（需 REDIS_URL）
+	RequestSigningNonceStore = env.Get("REQUEST_SIGNING_NONCE_STORE", NonceStoreMemory)
+	// TLSCertFile / TLSKeyFile: 同时设置时直接以 HTTPS 提供服务；文件更新（如证书续期）后自动加载，无需重启
+	TLSCertFile = env.Get("TLS_CERT_FILE", "")
+	TLSKeyFile  = env.Get("TLS_KEY_FILE", "")
+	// TLSClientCAFile: 客户端证书 CA（PEM）；设置后启用 mTLS，证书主题 CN 可在 API_KEYS_FILE 中以 client_cert_cn 映射为调用方身份
+	TLSClientCAFile = env.Get("TLS_CLIENT_CA_FILE", "")
+	// TLSClientAuth: require=必须出示客户端证书；optional=可不出示，回退到 X-API-Key / 签名认证
+	TLSClientAuth = env.Get("TLS_CLIENT_AUTH", TLSClientAuthRequire)
+	// JWTJWKSFile / JWTPublicKeyFile: 校验 Authorization: Bearer JWT 的本地 JWKS 文件、PEM 公钥（或证书）文件，任设其一即启用 JWT 认证；收到 SIGHUP 时重新加载
+	JWTJWKSFile      = env.Get("JWT_JWKS_FILE", "")
+	JWTPublicKeyFile = env.Get("JWT_PUBLIC_KEY_FILE", "")
+	// JWTIssuer / JWTAudience: JWT 的 iss 必须等于 JWTIssuer，aud 必须包含 JWTAudience；启用 JWT 时必填
+	JWTIssuer   = env.Get("JWT_ISSUER", "")
+	JWTAudience = env.Get("JWT_AUDIENCE", "")
+	// JWTScopeClaim: 列出 scope（send、resolve、admin、metrics）的 claim，可为空格分隔的字符串或数组
+	JWTScopeClaim = env.Get("JWT_SCOPE_CLAIM", "scope")
+	// JWTScopePrefix: scope 前缀，如 herald-dingtalk: 时仅 herald-dingtalk:send 等带前缀的条目生效；默认无前缀
+	JWTScopePrefix = env.Get("JWT_SCOPE_PREFIX", "")
+	// JWTCallerClaim: 作为调用方名称（日志、按调用方限流）的 claim
+	JWTCallerClaim = env.Get("JWT_CALLER_CLAIM", "sub")
+	// JWTLeewaySec: 校验 exp / nbf 时允许的时钟偏差（秒）
+	JWTLeewaySec = env.GetInt("JWT_LEEWAY_SECONDS", 60)
+	// MetricsEnabled: 在 GET /metrics 以 Prometheus 文本格式暴露指标（标签含已配置的密钥名称，JWT 调用方记为 jwt，不含手机号、userid 等个人信息）
+	MetricsEnabled = getBool("METRICS_ENABLED", true)
+	// MetricsRequireAuth: /metrics 需要拥有 metrics scope 的凭据；默认与 /healthz 一样无需认证
+	MetricsRequireAuth = getBool("METRICS_REQUIRE_AUTH", false)
+	// RateLimitPerCaller / RateLimitPerIP / RateLimitPerTo: 每个调用方（API Key 名称、证书 CN 或 JWT 调用方）、客户端 IP、目标 to 在一个限流窗口内允许的 /v1/send 请求数（令牌桶，可突发）；0 表示不限制该维度
+	RateLimitPerCaller = env.GetInt("RATE_LIMIT_PER_CALLER", 600)
+	RateLimitPerIP     = env.GetInt("RATE_LIMIT_PER_IP", 600)
+	RateLimitPerTo     = env.GetInt("RATE_LIMIT_PER_TO", 10)
+	// RateLimitWindowSec: 限流窗口（秒），令牌按 限额/窗口 的速率匀速补充
+	RateLimitWindowSec = env.GetInt("RATE_LIMIT_WINDOW_SECONDS", 60)
+	// RateLimitStore: memory=每个副本各自限流；redis=多副本共享限流计数（需 REDIS_URL）
+	RateLimitStore = env.Get("RATE_LIMIT_STORE", RateLimitStoreMemory)
+	// RedisURL: Redis 连接串，如 redis://:password@redis:6379/0
+	RedisURL = env.Get("REDIS_URL", "")
+	// RedisKeyPrefix: 本服务写入 Redis 的 key 前缀
+	RedisKeyPrefix = env.Get("REDIS_KEY_PREFIX", "herald-dingtalk:")
 	// LookupMode: none=to 仅 userid；mobile=to 支持 userid 或手机号（需申请 Contact.User.mobile 权限）
 	LookupMode = env.Get("DINGTALK_LOOKUP_MODE", LookupModeNone)
 )
@@ -31,3 +169,49 @@ func ValidWith(appKey, appSecret, agentID string) bool {
 func Valid() bool {
 	return ValidWith(AppKey, AppSecret, AgentID)
 }
+
+// Validate returns an error naming the first setting whose value is out of range. main calls it at
+// startup so a bad value stops the service instead of misbehaving later.
+func Validate() error {
+	for _, s := range []struct {
+		name       string
+		value, min int
+	}{
+		{"DINGTALK_RETRY_MAX_ATTEMPTS", RetryMaxAttempts, 1},
+		{"DINGTALK_RETRY_BASE_DELAY_MS", RetryBaseDelayMs, 1},
+		{"DINGTALK_RETRY_MAX_DELAY_MS", RetryMaxDelayMs, 1},
+		{"DINGTALK_RETRY_MAX_ELAPSED_MS", RetryMaxElapsedMs, 1},
+		{"DINGTALK_BREAKER_THRESHOLD", BreakerThreshold, 0},
+		{"DINGTALK_BREAKER_OPEN_SECONDS", BreakerOpenSec, 1},
+		{"DINGTALK_QPS_SEND", QPSSend, 0},
+		{"DINGTALK_QPS_LOOKUP", QPSLookup, 0},
+		{"DINGTALK_QPS_OAUTH", QPSOAuth, 0},
+		{"QUEUE_RETRY_BASE_SECONDS", QueueRetryBaseSec, 1},
+		{"QUEUE_RETRY_MAX_SECONDS", QueueRetryMaxSec, 1},
+	} {
+		if s.value < s.min {
+			return fmt.Errorf("%s must be at least %d, got %d", s.name, s.min, s.value)
+		}
+	}
+	switch {
+	case RetryMaxDelayMs < RetryBaseDelayMs:
+		return errors.New("DINGTALK_RETRY_MAX_DELAY_MS must not be less than DINGTALK_RETRY_BASE_DELAY_MS")
+	case QueueRetryMaxSec < QueueRetryBaseSec:
+		return errors.New("QUEUE_RETRY_MAX_SECONDS must not be less than QUEUE_RETRY_BASE_SECONDS")
+	case TokenRefreshAheadSec < 0 || TokenRefreshJitterSec < 0:
+		return errors.New("DINGTALK_TOKEN_REFRESH_AHEAD_SECONDS and DINGTALK_TOKEN_REFRESH_JITTER_SECONDS must not be negative")
+	case TokenRefreshAheadSec+TokenRefreshJitterSec >= maxTokenRefreshLeadSec:
+		return errors.New("DINGTALK_TOKEN_REFRESH_AHEAD_SECONDS plus DINGTALK_TOKEN_REFRESH_JITTER_SECONDS must be less than " +
+			strconv.Itoa(maxTokenRefreshLeadSec) + " (half the access token lifetime)")
+	}
+	return nil
+}
+
+// getBool reads a boolean env var (1/0, true/false, as accepted by strconv.ParseBool); invalid or unset returns def.
+func getBool(key string, def bool) bool {
+	b, err := strconv.ParseBool(env.Get(key, ""))
+	if err != nil {
+		return def
+	}
+	return b
+}
@@ -1,6 +1,9 @@
 package config
 
-import "testing"
+import (
+	"strings"
+	"testing"
+)
 
 func TestValidWith(t *testing.T) {
 	tests := []struct {
@@ -40,3 +43,105 @@ func TestLookupModeConstants(t *testing.T) {
 		t.Logf("LookupMode = %q (from env); expected none or mobile in production", LookupMode)
 	}
 }
+
+func TestGetBool(t *testing.T) {
+	t.Setenv("HERALD_DINGTALK_TEST_BOOL", "true")
+	if !getBool("HERALD_DINGTALK_TEST_BOOL", false) {
+		t.Error("getBool(true) = false")
+	}
+	t.Setenv("HERALD_DINGTALK_TEST_BOOL", "not-a-bool")
+	if !getBool("HERALD_DINGTALK_TEST_BOOL", true) {
+		t.Error("getBool(invalid, def=true) should return default")
+	}
+	if getBool("HERALD_DINGTALK_TEST_BOOL_UNSET", false) {
+		t.Error("getBool(unset, def=false) should return default")
+	}
+}
+
+func TestTokenCacheConstants(t *testing.T) {
+	if TokenCacheMemory != "memory" || TokenCacheRedis != "redis" {
+		t.Errorf("TokenCacheMemory = %q, TokenCacheRedis = %q", TokenCacheMemory, TokenCacheRedis)
+	}
+	switch TokenCache {
+	case TokenCacheMemory, TokenCacheRedis:
+	default:
+		t.Logf("TokenCache = %q (from env); expected memory or redis", TokenCache)
+	}
+}
+
+func TestRequestSigningConstants(t *testing.T) {
+	if RequestSigningOff != "off" || RequestSigningOptional != "optional" || RequestSigningRequired != "required" {
+		t.Errorf("RequestSigning constants = %q, %q, %q", RequestSigningOff, RequestSigningOptional, RequestSigningRequired)
+	}
+	if NonceStoreMemory != "memory" || NonceStoreRedis != "redis" {
+		t.Errorf("NonceStoreMemory = %q, NonceStoreRedis = %q", NonceStoreMemory, NonceStoreRedis)
+	}
+}
+
+func TestTLSClientAuthConstants(t *testing.T) {
+	if TLSClientAuthRequire != "require" || TLSClientAuthOptional != "optional" {
+		t.Errorf("TLSClientAuthRequire = %q, TLSClientAuthOptional = %q", TLSClientAuthRequire, TLSClientAuthOptional)
+	}
+}
+
+func TestRateLimitStoreConstants(t *testing.T) {
+	if RateLimitStoreMemory != "memory" || RateLimitStoreRedis != "redis" {
+		t.Errorf("RateLimitStoreMemory = %q, RateLimitStoreRedis = %q", RateLimitStoreMemory, RateLimitStoreRedis)
+	}
+}
+
+func TestValidate_TokenRefresh(t *testing.T) {
+	ahead, jitter := TokenRefreshAheadSec, TokenRefreshJitterSec
+	t.Cleanup(func() { TokenRefreshAheadSec, TokenRefreshJitterSec = ahead, jitter })
+	tests := []struct {
+		ahead, jitter int
+		ok            bool
+	}{
+		{300, 60, true},
+		{0, 0, true},
+		{3000, 599, true},
+		{3000, 600, false},
+		{7200, 0, false},
+		{-1, 0, false},
+		{300, -1, false},
+	}
+	for _, tt := range tests {
+		TokenRefreshAheadSec, TokenRefreshJitterSec = tt.ahead, tt.jitter
+		if err := Validate(); (err == nil) != tt.ok {
+			t.Errorf("Validate() with ahead=%d jitter=%d = %v, want ok=%v", tt.ahead, tt.jitter, err, tt.ok)
+		}
+	}
+}
+
+func TestValidate_RetryBreakerQPS(t *testing.T) {
+	if err := Validate(); err != nil {
+		t.Fatalf("Validate() with defaults = %v", err)
+	}
+	tests := []struct {
+		name string
+		v    *int
+		bad  int
+	}{
+		{"DINGTALK_RETRY_MAX_ATTEMPTS", &RetryMaxAttempts, 0},
+		{"DINGTALK_RETRY_BASE_DELAY_MS", &RetryBaseDelayMs, -2},
+		{"DINGTALK_RETRY_MAX_DELAY_MS", &RetryMaxDelayMs, 0},
+		{"DINGTALK_RETRY_MAX_DELAY_MS", &RetryMaxDelayMs, 100},
+		{"DINGTALK_RETRY_MAX_ELAPSED_MS", &RetryMaxElapsedMs, -1},
+		{"DINGTALK_BREAKER_THRESHOLD", &BreakerThreshold, -1},
+		{"DINGTALK_BREAKER_OPEN_SECONDS", &BreakerOpenSec, 0},
+		{"DINGTALK_QPS_SEND", &QPSSend, -5},
+		{"DINGTALK_QPS_LOOKUP", &QPSLookup, -1},
+		{"DINGTALK_QPS_OAUTH", &QPSOAuth, -1},
+		{"QUEUE_RETRY_BASE_SECONDS", &QueueRetryBaseSec, 0},
+		{"QUEUE_RETRY_MAX_SECONDS", &QueueRetryMaxSec, 1},
+	}
+	for _, tt := range tests {
+		old := *tt.v
+		*tt.v = tt.bad
+		err := Validate()
+		*tt.v = old
+		if err == nil || !strings.Contains(err.Error(), tt.name) {
+			t.Errorf("Validate() with %s=%d = %v, want an error naming it", tt.name, tt.bad, err)
+		}
+	}
+}
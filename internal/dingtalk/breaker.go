@@ -0,0 +1,131 @@
+package dingtalk
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// ErrCircuitOpen is returned without calling DingTalk while the circuit breaker is open.
+var ErrCircuitOpen = errors.New("dingtalk circuit breaker open")
+
+// Circuit breaker states reported by BreakerStats.
+const (
+	BreakerClosed   = "closed"
+	BreakerOpen     = "open"
+	BreakerHalfOpen = "half_open"
+)
+
+// Default circuit breaker settings used by NewClient.
+const (
+	DefaultBreakerThreshold = 5
+	DefaultBreakerOpenFor   = 30 * time.Second
+)
+
+// BreakerStats is a snapshot of the circuit breaker for health checks.
+type BreakerStats struct {
+	State               string     `json:"state"`
+	ConsecutiveFailures int        `json:"consecutive_failures"`
+	Opens               uint64     `json:"opens"`
+	OpenedAt            *time.Time `json:"opened_at,omitempty"`
+}
+
+// breaker opens after threshold consecutive outage-class failures and fails fast for openFor.
+// It then lets a single probe through (half-open): success closes it, failure re-opens it.
+// A nil breaker is disabled.
+type breaker struct {
+	mu        sync.Mutex
+	threshold int
+	openFor   time.Duration
+	state     string
+	failures  int
+	openedAt  time.Time
+	probing   bool
+	opens     uint64
+}
+
+func newBreaker(threshold int, openFor time.Duration) *breaker {
+	if threshold <= 0 {
+		return nil
+	}
+	return &breaker{threshold: threshold, openFor: openFor, state: BreakerClosed}
+}
+
+// SetBreaker replaces the circuit breaker: it opens after threshold consecutive transient
+// failures (network errors, 5xx, errcode -1) and stays open for openFor. threshold <= 0
+// disables it. Call it before the client is used.
+func (c *Client) SetBreaker(threshold int, openFor time.Duration) {
+	c.breaker = newBreaker(threshold, openFor)
+}
+
+// BreakerStats reports the circuit breaker state; ok is false when the breaker is disabled.
+func (c *Client) BreakerStats() (stats BreakerStats, ok bool) {
+	b := c.breaker
+	if b == nil {
+		return BreakerStats{}, false
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	stats = BreakerStats{State: b.state, ConsecutiveFailures: b.failures, Opens: b.opens}
+	if b.state == BreakerOpen && time.Since(b.openedAt) >= b.openFor {
+		stats.State = BreakerHalfOpen
+	}
+	if b.state != BreakerClosed {
+		openedAt := b.openedAt
+		stats.OpenedAt = &openedAt
+	}
+	return stats, true
+}
+
+// allow reports whether a call may proceed; probe is true for the single half-open trial call,
+// which must be followed by done.
+func (b *breaker) allow() (probe bool, err error) {
+	if b == nil {
+		return false, nil
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch b.state {
+	case BreakerClosed:
+		return false, nil
+	case BreakerOpen:
+		if time.Since(b.openedAt) < b.openFor {
+			return false, ErrCircuitOpen
+		}
+		b.state = BreakerHalfOpen
+	}
+	if b.probing {
+		return false, ErrCircuitOpen
+	}
+	b.probing = true
+	return true, nil
+}
+
+// done records the outcome of an allowed call. failed marks outage-class failures; ignored means
+// the outcome says nothing about DingTalk's health (e.g. the caller gave up) and only frees the probe slot.
+func (b *breaker) done(probe, failed, ignored bool) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if probe {
+		b.probing = false
+	}
+	if ignored {
+		return
+	}
+	if !failed {
+		b.state = BreakerClosed
+		b.failures = 0
+		return
+	}
+	b.failures++
+	if b.state == BreakerHalfOpen || b.failures >= b.threshold {
+		if b.state != BreakerOpen {
+			b.opens++
+		}
+		b.state = BreakerOpen
+		b.openedAt = time.Now()
+	}
+}
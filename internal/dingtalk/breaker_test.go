@@ -0,0 +1,98 @@
+package dingtalk
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestBreaker_OpensAndHalfOpens(t *testing.T) {
+	b := newBreaker(2, 50*time.Millisecond)
+	for range 2 {
+		probe, err := b.allow()
+		if err != nil {
+			t.Fatalf("allow while closed: %v", err)
+		}
+		b.done(probe, true, false)
+	}
+	if _, err := b.allow(); !errors.Is(err, ErrCircuitOpen) {
+		t.Fatalf("allow after threshold = %v, want ErrCircuitOpen", err)
+	}
+	time.Sleep(60 * time.Millisecond)
+	probe, err := b.allow()
+	if err != nil || !probe {
+		t.Fatalf("half-open allow = %v, %v; want a probe", probe, err)
+	}
+	if _, err := b.allow(); !errors.Is(err, ErrCircuitOpen) {
+		t.Errorf("second caller during probe = %v, want ErrCircuitOpen", err)
+	}
+	b.done(probe, true, false)
+	if _, err := b.allow(); !errors.Is(err, ErrCircuitOpen) {
+		t.Fatalf("failed probe should re-open, got %v", err)
+	}
+	time.Sleep(60 * time.Millisecond)
+	probe, _ = b.allow()
+	b.done(probe, false, false)
+	if b.state != BreakerClosed || b.failures != 0 || b.opens != 2 {
+		t.Errorf("after successful probe: state=%s failures=%d opens=%d", b.state, b.failures, b.opens)
+	}
+}
+
+func TestBreaker_IgnoredOutcomeFreesProbe(t *testing.T) {
+	b := newBreaker(1, 0)
+	b.done(false, true, false)
+	probe, err := b.allow()
+	if err != nil || !probe {
+		t.Fatalf("allow = %v, %v; want probe", probe, err)
+	}
+	b.done(probe, false, true)
+	if probe, err := b.allow(); err != nil || !probe {
+		t.Errorf("allow after ignored probe = %v, %v; want another probe", probe, err)
+	}
+}
+
+func TestSendWorkNotify_FailsFastWhenOpen(t *testing.T) {
+	var calls int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		if r.URL.Path == "/gettoken" {
+			_ = json.NewEncoder(w).Encode(map[string]any{"errcode": 0, "access_token": "tok", "expires_in": 7200})
+			return
+		}
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	client := NewClientWithHTTP("key", "secret", "1", &http.Client{Transport: &redirectTransport{base: server}})
+	client.SetRetryPolicy(RetryPolicy{MaxAttempts: 1})
+	client.SetBreaker(2, time.Minute)
+	for range 2 {
+		if _, err := client.SendWorkNotify(context.Background(), "u1", "hi"); err == nil || errors.Is(err, ErrCircuitOpen) {
+			t.Fatalf("err = %v, want a 503 failure", err)
+		}
+	}
+	before := atomic.LoadInt32(&calls)
+	if _, err := client.SendWorkNotify(context.Background(), "u1", "hi"); !errors.Is(err, ErrCircuitOpen) {
+		t.Fatalf("err = %v, want ErrCircuitOpen", err)
+	}
+	if got := atomic.LoadInt32(&calls); got != before {
+		t.Errorf("DingTalk called %d times while open", got-before)
+	}
+	stats, ok := client.BreakerStats()
+	if !ok || stats.State != BreakerOpen || stats.Opens != 1 || stats.OpenedAt == nil {
+		t.Errorf("BreakerStats = %+v, %v", stats, ok)
+	}
+}
+
+func TestSetBreaker_Disabled(t *testing.T) {
+	client := NewClient("key", "secret", "1")
+	client.SetBreaker(0, time.Minute)
+	if _, ok := client.BreakerStats(); ok {
+		t.Error("BreakerStats ok = true for a disabled breaker")
+	}
+}
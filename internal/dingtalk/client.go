@@ -5,7 +5,6 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
-	"io"
 	"net/http"
 	"net/url"
 	"sync"
@@ -93,6 +92,20 @@ type Client struct {
 	mu        sync.Mutex
 	token     string
 	expires   time.Time
+	// refresh is the in-flight gettoken call shared by concurrent callers (nil when idle).
+	refresh *tokenCall
+	// cache shares the access token with other clients of the same AppKey (in-memory by default).
+	cache TokenCache
+	// retryPolicy and observer control retries of transient failures (see retry.go).
+	retryPolicy RetryPolicy
+	observer    AttemptObserver
+	// breaker fails calls fast while DingTalk is down (nil = disabled, see breaker.go).
+	breaker *breaker
+	// pacers spread calls per rate class to stay under DingTalk's QPS limits (see outbound.go).
+	pacers map[string]*pacer
+	// stop ends the background token refresher started by StartTokenRefresher.
+	stop     chan struct{}
+	stopOnce sync.Once
 }
 
 // NewClient creates a DingTalk API client.
@@ -107,58 +120,36 @@ func NewClientWithHTTP(appKey, appSecret, agentID string, httpClient *http.Clien
 		httpClient = &http.Client{Timeout: 15 * time.Second}
 	}
 	return &Client{
-		appKey:    appKey,
-		appSecret: appSecret,
-		agentID:   agentID,
-		http:      httpClient,
+		appKey:      appKey,
+		appSecret:   appSecret,
+		agentID:     agentID,
+		http:        httpClient,
+		cache:       NewMemoryTokenCache(),
+		retryPolicy: DefaultRetryPolicy,
+		breaker:     newBreaker(DefaultBreakerThreshold, DefaultBreakerOpenFor),
+		stop:        make(chan struct{}),
 	}
 }
 
-// getToken returns a valid access token, refreshing if needed.
-func (c *Client) getToken(ctx context.Context) (string, error) {
-	c.mu.Lock()
-	if c.token != "" && time.Now().Before(c.expires) {
-		tok := c.token
-		c.mu.Unlock()
-		return tok, nil
-	}
-	c.mu.Unlock()
-
-	req, err := http.NewRequestWithContext(ctx, http.MethodGet,
-		fmt.Sprintf("%s?appkey=%s&appsecret=%s", getTokenURL, c.appKey, c.appSecret), nil)
-	if err != nil {
-		return "", err
-	}
-	resp, err := c.http.Do(req)
-	if err != nil {
-		return "", err
-	}
-	defer func() { _ = resp.Body.Close() }()
-	body, err := io.ReadAll(resp.Body)
-	if err != nil {
-		return "", err
-	}
-	var tr tokenResp
-	if err := json.Unmarshal(body, &tr); err != nil {
-		return "", err
-	}
-	if tr.ErrCode != 0 {
-		return "", fmt.Errorf("dingtalk gettoken: errcode=%d errmsg=%s", tr.ErrCode, tr.ErrMsg)
-	}
-	c.mu.Lock()
-	c.token = tr.AccessToken
-	c.expires = time.Now().Add(time.Duration(tr.ExpiresIn-120) * time.Second)
-	c.mu.Unlock()
-	return tr.AccessToken, nil
+// SetTokenCache replaces the default in-memory token cache, e.g. with a RedisTokenCache so all
+// replicas share one access token per AppKey. Call it before the client is used.
+func (c *Client) SetTokenCache(cache TokenCache) {
+	c.cache = cache
 }
 
 // SendWorkNotify sends a text work notification to the given userid.
 // userid is DingTalk user ID (single user); content is the message body.
 func (c *Client) SendWorkNotify(ctx context.Context, userid, content string) (taskID string, err error) {
-	tok, err := c.getToken(ctx)
-	if err != nil {
-		return "", err
-	}
+	err = c.withToken(ctx, func(tok string) error {
+		return c.retry(ctx, EndpointSend, false, func(ctx context.Context) error {
+			taskID, err = c.sendWorkNotify(ctx, tok, userid, content)
+			return err
+		})
+	})
+	return taskID, err
+}
+
+func (c *Client) sendWorkNotify(ctx context.Context, tok, userid, content string) (string, error) {
 	msg := sendReq{
 		AgentID:    mustParseInt64(c.agentID),
 		UserIDList: userid,
@@ -176,12 +167,7 @@ func (c *Client) SendWorkNotify(ctx context.Context, userid, content string) (ta
 		return "", err
 	}
 	req.Header.Set("Content-Type", "application/json")
-	resp, err := c.http.Do(req)
-	if err != nil {
-		return "", err
-	}
-	defer func() { _ = resp.Body.Close() }()
-	respBody, err := io.ReadAll(resp.Body)
+	respBody, err := c.do(req)
 	if err != nil {
 		return "", err
 	}
@@ -190,7 +176,7 @@ func (c *Client) SendWorkNotify(ctx context.Context, userid, content string) (ta
 		return "", err
 	}
 	if sr.ErrCode != 0 {
-		return "", fmt.Errorf("dingtalk send: errcode=%d errmsg=%s", sr.ErrCode, sr.ErrMsg)
+		return "", &APIError{Op: "dingtalk send", ErrCode: sr.ErrCode, ErrMsg: sr.ErrMsg}
 	}
 	return fmt.Sprintf("%d", sr.TaskID), nil
 }
@@ -203,7 +189,26 @@ func mustParseInt64(s string) int64 {
 
 // ResolveAuthCode exchanges OAuth2 auth_code for userid via userAccessToken + users/me.
 // See: https://open.dingtalk.com/document/orgapp/obtain-identity-credentials
+// The auth code is single-use, so the exchange is only retried when DingTalk certainly did not
+// process it; users/me is retried on any transient failure.
 func (c *Client) ResolveAuthCode(ctx context.Context, code string) (userid string, err error) {
+	var userToken string
+	err = c.retry(ctx, EndpointOAuth2UserToken, false, func(ctx context.Context) error {
+		userToken, err = c.exchangeAuthCode(ctx, code)
+		return err
+	})
+	if err != nil {
+		return "", err
+	}
+	err = c.retry(ctx, EndpointUsersMe, true, func(ctx context.Context) error {
+		userid, err = c.getUserMe(ctx, userToken)
+		return err
+	})
+	return userid, err
+}
+
+// exchangeAuthCode calls /v1.0/oauth2/userAccessToken and returns the user access token.
+func (c *Client) exchangeAuthCode(ctx context.Context, code string) (string, error) {
 	body := oauth2UserTokenReq{
 		ClientID:     c.appKey,
 		ClientSecret: c.appSecret,
@@ -219,12 +224,7 @@ func (c *Client) ResolveAuthCode(ctx context.Context, code string) (userid strin
 		return "", err
 	}
 	req.Header.Set("Content-Type", "application/json")
-	resp, err := c.http.Do(req)
-	if err != nil {
-		return "", err
-	}
-	defer func() { _ = resp.Body.Close() }()
-	respBody, err := io.ReadAll(resp.Body)
+	respBody, err := c.do(req)
 	if err != nil {
 		return "", err
 	}
@@ -243,18 +243,17 @@ func (c *Client) ResolveAuthCode(ctx context.Context, code string) (userid strin
 		}
 		return "", fmt.Errorf("oauth2 userAccessToken: empty access_token (code=%s)", errResp.Code)
 	}
-	// GET /v1.0/contact/users/me
+	return tr.AccessToken, nil
+}
+
+// getUserMe calls GET /v1.0/contact/users/me with a user access token and returns the userid.
+func (c *Client) getUserMe(ctx context.Context, userToken string) (string, error) {
 	req2, err := http.NewRequestWithContext(ctx, http.MethodGet, oauth2UserMeURL, nil)
 	if err != nil {
 		return "", err
 	}
-	req2.Header.Set("x-acs-dingtalk-access-token", tr.AccessToken)
-	resp2, err := c.http.Do(req2)
-	if err != nil {
-		return "", err
-	}
-	defer func() { _ = resp2.Body.Close() }()
-	meBody, err := io.ReadAll(resp2.Body)
+	req2.Header.Set("x-acs-dingtalk-access-token", userToken)
+	meBody, err := c.do(req2)
 	if err != nil {
 		return "", err
 	}
@@ -279,21 +278,22 @@ func (c *Client) ResolveAuthCode(ctx context.Context, code string) (userid strin
 // GetUserIDByMobile returns userid for the given mobile using topapi/v2/user/getbymobile.
 // Requires Contact.User.mobile permission. See: https://open.dingtalk.com/document/orgapp-server/query-users-by-phone-number
 func (c *Client) GetUserIDByMobile(ctx context.Context, mobile string) (userid string, err error) {
-	tok, err := c.getToken(ctx)
-	if err != nil {
-		return "", err
-	}
+	err = c.withToken(ctx, func(tok string) error {
+		return c.retry(ctx, EndpointGetByMobile, true, func(ctx context.Context) error {
+			userid, err = c.getUserIDByMobile(ctx, tok, mobile)
+			return err
+		})
+	})
+	return userid, err
+}
+
+func (c *Client) getUserIDByMobile(ctx context.Context, tok, mobile string) (string, error) {
 	req, err := http.NewRequestWithContext(ctx, http.MethodGet,
 		getByMobileURL+"?access_token="+url.QueryEscape(tok)+"&mobile="+url.QueryEscape(mobile), nil)
 	if err != nil {
 		return "", err
 	}
-	resp, err := c.http.Do(req)
-	if err != nil {
-		return "", err
-	}
-	defer func() { _ = resp.Body.Close() }()
-	body, err := io.ReadAll(resp.Body)
+	body, err := c.do(req)
 	if err != nil {
 		return "", err
 	}
@@ -302,7 +302,7 @@ func (c *Client) GetUserIDByMobile(ctx context.Context, mobile string) (userid s
 		return "", err
 	}
 	if gr.ErrCode != 0 {
-		return "", fmt.Errorf("getbymobile: errcode=%d errmsg=%s", gr.ErrCode, gr.ErrMsg)
+		return "", &APIError{Op: "getbymobile", ErrCode: gr.ErrCode, ErrMsg: gr.ErrMsg}
 	}
 	if gr.Result.UserID == "" {
 		return "", fmt.Errorf("getbymobile: no userid for mobile")
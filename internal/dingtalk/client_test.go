@@ -3,9 +3,14 @@ package dingtalk
 import (
 	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"net/http"
 	"net/http/httptest"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 )
 
 // redirectTransport forwards all requests to the given server (for testing).
@@ -215,3 +220,109 @@ func TestMustParseInt64(t *testing.T) {
 		t.Errorf("mustParseInt64(0) = %d", got)
 	}
 }
+
+func TestGetToken_SingleFlight(t *testing.T) {
+	var tokenCalls int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/gettoken":
+			atomic.AddInt32(&tokenCalls, 1)
+			time.Sleep(50 * time.Millisecond)
+			w.Header().Set("Content-Type", "application/json")
+			_ = json.NewEncoder(w).Encode(map[string]any{"errcode": 0, "access_token": "tok", "expires_in": 7200})
+		case "/topapi/message/corpconversation/asyncsend_v2":
+			if r.URL.Query().Get("access_token") != "tok" {
+				t.Errorf("access_token = %q", r.URL.Query().Get("access_token"))
+			}
+			w.Header().Set("Content-Type", "application/json")
+			_ = json.NewEncoder(w).Encode(map[string]any{"errcode": 0, "task_id": 1})
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+
+	client := NewClientWithHTTP("key", "secret", "1", &http.Client{
+		Transport: &redirectTransport{base: server},
+	})
+	const senders = 20
+	var wg sync.WaitGroup
+	for i := 0; i < senders; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := client.SendWorkNotify(context.Background(), "user1", "hi"); err != nil {
+				t.Errorf("SendWorkNotify: %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+	if got := atomic.LoadInt32(&tokenCalls); got != 1 {
+		t.Errorf("gettoken calls = %d, want 1 under %d concurrent senders", got, senders)
+	}
+}
+
+func TestSendWorkNotify_RetriesOnceOnInvalidToken(t *testing.T) {
+	var tokenCalls, sendCalls int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch r.URL.Path {
+		case "/gettoken":
+			n := atomic.AddInt32(&tokenCalls, 1)
+			_ = json.NewEncoder(w).Encode(map[string]any{"errcode": 0, "access_token": fmt.Sprintf("tok%d", n), "expires_in": 7200})
+		case "/topapi/message/corpconversation/asyncsend_v2":
+			atomic.AddInt32(&sendCalls, 1)
+			if r.URL.Query().Get("access_token") == "tok1" {
+				_ = json.NewEncoder(w).Encode(map[string]any{"errcode": 42001, "errmsg": "access_token expired"})
+				return
+			}
+			_ = json.NewEncoder(w).Encode(map[string]any{"errcode": 0, "task_id": 42})
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+
+	client := NewClientWithHTTP("key", "secret", "1", &http.Client{
+		Transport: &redirectTransport{base: server},
+	})
+	taskID, err := client.SendWorkNotify(context.Background(), "user1", "hi")
+	if err != nil {
+		t.Fatalf("SendWorkNotify: %v", err)
+	}
+	if taskID != "42" {
+		t.Errorf("taskID = %q, want 42", taskID)
+	}
+	if tokenCalls != 2 || sendCalls != 2 {
+		t.Errorf("gettoken calls = %d, send calls = %d; want 2 and 2", tokenCalls, sendCalls)
+	}
+}
+
+func TestGetUserIDByMobile_InvalidTokenRetriedOnlyOnce(t *testing.T) {
+	var lookups int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch r.URL.Path {
+		case "/gettoken":
+			_ = json.NewEncoder(w).Encode(map[string]any{"errcode": 0, "access_token": "tok", "expires_in": 7200})
+		case "/topapi/v2/user/getbymobile":
+			atomic.AddInt32(&lookups, 1)
+			_ = json.NewEncoder(w).Encode(map[string]any{"errcode": 40014, "errmsg": "invalid access_token"})
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+
+	client := NewClientWithHTTP("key", "secret", "1", &http.Client{
+		Transport: &redirectTransport{base: server},
+	})
+	_, err := client.GetUserIDByMobile(context.Background(), "13800138000")
+	var apiErr *APIError
+	if !errors.As(err, &apiErr) || apiErr.ErrCode != 40014 {
+		t.Fatalf("err = %v, want APIError errcode 40014", err)
+	}
+	if lookups != 2 {
+		t.Errorf("getbymobile calls = %d, want 2 (original + one retry)", lookups)
+	}
+}
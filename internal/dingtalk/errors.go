@@ -0,0 +1,37 @@
+package dingtalk
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Token-related errcodes returned by oapi.dingtalk.com when the access token is no longer valid.
+const (
+	errCodeTokenInvalid = 40014 // 不合法的 access_token
+	errCodeTokenExpired = 42001 // access_token 超时
+	errCodeTokenAuth    = 88    // 鉴权异常（token 被吊销或轮换）
+)
+
+// APIError is a non-zero errcode returned by a DingTalk oapi endpoint.
+type APIError struct {
+	Op      string
+	ErrCode int
+	ErrMsg  string
+}
+
+func (e *APIError) Error() string {
+	return fmt.Sprintf("%s: errcode=%d errmsg=%s", e.Op, e.ErrCode, e.ErrMsg)
+}
+
+// isTokenInvalid reports whether err means DingTalk rejected the access token itself.
+func isTokenInvalid(err error) bool {
+	var apiErr *APIError
+	if !errors.As(err, &apiErr) {
+		return false
+	}
+	switch apiErr.ErrCode {
+	case errCodeTokenInvalid, errCodeTokenExpired, errCodeTokenAuth:
+		return true
+	}
+	return false
+}
@@ -0,0 +1,33 @@
+package dingtalk
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// ErrExpired is returned instead of calling DingTalk once the message's expiry has passed.
+var ErrExpired = errors.New("message expired")
+
+type expiryKey struct{}
+
+// WithExpiry returns a context under which client calls are refused with ErrExpired once t has
+// passed, including retries: a stale OTP is dropped rather than delivered late. A zero t is ignored.
+func WithExpiry(ctx context.Context, t time.Time) context.Context {
+	if t.IsZero() {
+		return ctx
+	}
+	return context.WithValue(ctx, expiryKey{}, t)
+}
+
+// expiryFrom returns the expiry set by WithExpiry.
+func expiryFrom(ctx context.Context) (time.Time, bool) {
+	t, ok := ctx.Value(expiryKey{}).(time.Time)
+	return t, ok
+}
+
+// expired reports whether ctx carries an expiry that has passed at now.
+func expired(ctx context.Context, now time.Time) bool {
+	t, ok := expiryFrom(ctx)
+	return ok && !now.Before(t)
+}
@@ -0,0 +1,35 @@
+package dingtalk
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestRetry_RefusesAfterExpiry(t *testing.T) {
+	client := NewClient("key", "secret", "1")
+	client.SetRetryPolicy(RetryPolicy{MaxAttempts: 5, BaseDelay: 60 * time.Millisecond, MaxDelay: 60 * time.Millisecond})
+
+	ctx := WithExpiry(context.Background(), time.Now().Add(-time.Second))
+	called := false
+	err := client.retry(ctx, EndpointSend, false, func(context.Context) error { called = true; return nil })
+	if !errors.Is(err, ErrExpired) || called {
+		t.Fatalf("retry after expiry = %v (called=%v), want ErrExpired without calling", err, called)
+	}
+
+	// Retries stop once the next attempt would start after the expiry.
+	ctx = WithExpiry(context.Background(), time.Now().Add(50*time.Millisecond))
+	calls := 0
+	err = client.retry(ctx, EndpointGetByMobile, true, func(context.Context) error {
+		calls++
+		return &HTTPStatusError{StatusCode: http.StatusBadGateway}
+	})
+	if err == nil || calls > 2 {
+		t.Errorf("retry near expiry = %v after %d calls, want failure within 2 calls", err, calls)
+	}
+	if WithExpiry(context.Background(), time.Time{}).Value(expiryKey{}) != nil {
+		t.Error("zero expiry should not be recorded")
+	}
+}
@@ -0,0 +1,136 @@
+package dingtalk
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Rate classes group endpoints that share a DingTalk per-app QPS limit. gettoken is not limited:
+// tokens are cached and refreshed at most a few times per expiry.
+const (
+	RateClassSend   = "send"
+	RateClassLookup = "lookup"
+	RateClassOAuth  = "oauth"
+)
+
+// rateClass maps an endpoint to its rate class ("" = unlimited).
+func rateClass(endpoint string) string {
+	switch endpoint {
+	case EndpointSend:
+		return RateClassSend
+	case EndpointGetByMobile:
+		return RateClassLookup
+	case EndpointOAuth2UserToken, EndpointUsersMe:
+		return RateClassOAuth
+	}
+	return ""
+}
+
+// ErrRateLimited matches a *RateLimitError.
+var ErrRateLimited = errors.New("dingtalk outbound rate limit reached")
+
+// RateLimitError is returned when the outbound limiter has no slot for a call before the call's
+// deadline (or expiry): the call was not made, and can be tried again after RetryAfter.
+type RateLimitError struct {
+	Class      string
+	RetryAfter time.Duration
+}
+
+func (e *RateLimitError) Error() string {
+	return fmt.Sprintf("dingtalk outbound rate limit for %s: next slot in %v", e.Class, e.RetryAfter)
+}
+
+// Is makes errors.Is(err, ErrRateLimited) true.
+func (e *RateLimitError) Is(target error) bool {
+	return target == ErrRateLimited
+}
+
+// pacer is a token bucket that delays calls instead of rejecting them, so bursts are spread out
+// to the configured QPS. A nil pacer never waits.
+type pacer struct {
+	mu       sync.Mutex
+	interval time.Duration
+	burst    float64
+	tokens   float64
+	last     time.Time
+}
+
+func newPacer(qps float64, burst int) *pacer {
+	if qps <= 0 {
+		return nil
+	}
+	burst = max(burst, 1)
+	return &pacer{
+		interval: time.Duration(float64(time.Second) / qps),
+		burst:    float64(burst),
+		tokens:   float64(burst),
+	}
+}
+
+// reserve takes a token, possibly going into debt, and returns how long the caller must wait.
+func (p *pacer) reserve(now time.Time) time.Duration {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if !p.last.IsZero() && now.After(p.last) {
+		p.tokens = min(p.burst, p.tokens+float64(now.Sub(p.last))/float64(p.interval))
+	}
+	if now.After(p.last) {
+		p.last = now
+	}
+	p.tokens--
+	if p.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-p.tokens * float64(p.interval))
+}
+
+// unreserve gives back a token taken by reserve whose call will not be made.
+func (p *pacer) unreserve() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.tokens = min(p.burst, p.tokens+1)
+}
+
+// wait blocks until the call may be made. If that would be after ctx's deadline or the expiry set
+// by WithExpiry, it returns a *RateLimitError or ErrExpired at once without waiting.
+func (p *pacer) wait(ctx context.Context, class string) error {
+	if p == nil {
+		return nil
+	}
+	now := time.Now()
+	d := p.reserve(now)
+	if d <= 0 {
+		return nil
+	}
+	at := now.Add(d)
+	if deadline, ok := ctx.Deadline(); ok && at.After(deadline) {
+		p.unreserve()
+		return &RateLimitError{Class: class, RetryAfter: d}
+	}
+	if expired(ctx, at) {
+		p.unreserve()
+		return ErrExpired
+	}
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		p.unreserve()
+		return ctx.Err()
+	}
+}
+
+// SetRateLimit limits calls of a rate class (RateClassSend, ...) to qps per second with bursts of
+// up to burst calls; excess calls wait for a slot. qps <= 0 removes the limit. Call it before the
+// client is used.
+func (c *Client) SetRateLimit(class string, qps float64, burst int) {
+	if c.pacers == nil {
+		c.pacers = make(map[string]*pacer)
+	}
+	c.pacers[class] = newPacer(qps, burst)
+}
@@ -0,0 +1,116 @@
+package dingtalk
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestPacer_Reserve(t *testing.T) {
+	p := newPacer(10, 2)
+	now := time.Unix(1_700_000_000, 0)
+	for i := range 2 {
+		if d := p.reserve(now); d != 0 {
+			t.Fatalf("burst call %d waits %v, want 0", i, d)
+		}
+	}
+	if d := p.reserve(now); d != 100*time.Millisecond {
+		t.Fatalf("third call waits %v, want 100ms", d)
+	}
+	if d := p.reserve(now); d != 200*time.Millisecond {
+		t.Fatalf("fourth call waits %v, want 200ms (queued behind the third)", d)
+	}
+	p.unreserve()
+	if d := p.reserve(now.Add(time.Second)); d != 0 {
+		t.Fatalf("after refill waits %v, want 0", d)
+	}
+	if newPacer(0, 5) != nil {
+		t.Error("qps 0 should disable the pacer")
+	}
+	if err := (*pacer)(nil).wait(context.Background(), RateClassSend); err != nil {
+		t.Errorf("nil pacer wait = %v", err)
+	}
+}
+
+func TestPacer_WaitRespectsDeadlineAndExpiry(t *testing.T) {
+	p := newPacer(1, 1)
+	if err := p.wait(context.Background(), RateClassSend); err != nil {
+		t.Fatalf("first wait = %v", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	err := p.wait(ctx, RateClassSend)
+	var rl *RateLimitError
+	if !errors.As(err, &rl) || !errors.Is(err, ErrRateLimited) || rl.Class != RateClassSend || rl.RetryAfter <= 0 {
+		t.Fatalf("wait past deadline = %v, want *RateLimitError for send", err)
+	}
+	if time.Since(start) > 40*time.Millisecond {
+		t.Error("wait past deadline should fail at once, not block")
+	}
+	if err := p.wait(WithExpiry(context.Background(), time.Now().Add(50*time.Millisecond)), RateClassSend); !errors.Is(err, ErrExpired) {
+		t.Fatalf("wait past expiry = %v, want ErrExpired", err)
+	}
+	// Refused waits give their slot back: the next caller only waits for the original one.
+	if d := p.reserve(time.Now()); d > time.Second {
+		t.Errorf("after refused waits next slot is in %v, want <= 1s", d)
+	}
+}
+
+func TestSetRateLimit_SmoothsSends(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if r.URL.Path == "/gettoken" {
+			_ = json.NewEncoder(w).Encode(map[string]any{"errcode": 0, "access_token": "tok", "expires_in": 7200})
+			return
+		}
+		_ = json.NewEncoder(w).Encode(map[string]any{"errcode": 0, "task_id": 1})
+	}))
+	defer server.Close()
+
+	client := NewClientWithHTTP("key", "secret", "1", &http.Client{Transport: &redirectTransport{base: server}})
+	client.SetRateLimit(RateClassSend, 20, 1)
+	start := time.Now()
+	for i := range 4 {
+		if _, err := client.SendWorkNotify(context.Background(), "u1", "hi"); err != nil {
+			t.Fatalf("send %d: %v", i, err)
+		}
+	}
+	if elapsed := time.Since(start); elapsed < 140*time.Millisecond {
+		t.Errorf("4 sends at 20 QPS with burst 1 took %v, want >= 150ms", elapsed)
+	}
+
+	// A caller that cannot wait for a slot gets ErrRateLimited, which neither reaches DingTalk nor trips the breaker.
+	client.SetRateLimit(RateClassSend, 0.5, 1)
+	client.SetBreaker(1, time.Minute)
+	if _, err := client.SendWorkNotify(context.Background(), "u1", "hi"); err != nil {
+		t.Fatalf("send within burst: %v", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if _, err := client.SendWorkNotify(ctx, "u1", "hi"); !errors.Is(err, ErrRateLimited) || !IsRetryable(err) {
+		t.Fatalf("send without slot = %v, want retryable ErrRateLimited", err)
+	}
+	if stats, _ := client.BreakerStats(); stats.State != BreakerClosed {
+		t.Errorf("breaker = %s after rate limited call, want closed", stats.State)
+	}
+}
+
+func TestRateClass(t *testing.T) {
+	tests := map[string]string{
+		EndpointSend:            RateClassSend,
+		EndpointGetByMobile:     RateClassLookup,
+		EndpointOAuth2UserToken: RateClassOAuth,
+		EndpointUsersMe:         RateClassOAuth,
+		EndpointGetToken:        "",
+	}
+	for endpoint, want := range tests {
+		if got := rateClass(endpoint); got != want {
+			t.Errorf("rateClass(%s) = %q, want %q", endpoint, got, want)
+		}
+	}
+}
@@ -0,0 +1,205 @@
+package dingtalk
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/soulteary/herald-dingtalk/internal/redact"
+)
+
+// Endpoint names identify DingTalk API calls in retries, logs and metrics.
+const (
+	EndpointGetToken        = "gettoken"
+	EndpointSend            = "asyncsend_v2"
+	EndpointGetByMobile     = "getbymobile"
+	EndpointOAuth2UserToken = "oauth2_user_token"
+	EndpointUsersMe         = "users_me"
+)
+
+// errCodeSystemBusy is DingTalk's "-1 系统繁忙，请稍后重试": the request was not processed.
+const errCodeSystemBusy = -1
+
+// RetryPolicy controls retries of transient DingTalk failures.
+type RetryPolicy struct {
+	// MaxAttempts is the total number of attempts including the first; <= 1 disables retries.
+	MaxAttempts int
+	// BaseDelay is the backoff before the second attempt; it doubles per attempt up to MaxDelay.
+	BaseDelay time.Duration
+	MaxDelay  time.Duration
+	// MaxElapsed bounds all attempts of one call together (0 = only the caller's context).
+	MaxElapsed time.Duration
+}
+
+// DefaultRetryPolicy is used by NewClient: 3 attempts, 200ms..2s backoff, 10s overall.
+var DefaultRetryPolicy = RetryPolicy{
+	MaxAttempts: 3,
+	BaseDelay:   200 * time.Millisecond,
+	MaxDelay:    2 * time.Second,
+	MaxElapsed:  10 * time.Second,
+}
+
+// AttemptObserver is called after every attempt of a DingTalk call, e.g. for logs and metrics.
+// err is nil on success; willRetry reports whether another attempt follows.
+type AttemptObserver func(endpoint string, attempt int, err error, elapsed time.Duration, willRetry bool)
+
+// HTTPStatusError is returned when DingTalk answers with a 5xx or 429 status.
+type HTTPStatusError struct {
+	StatusCode int
+}
+
+func (e *HTTPStatusError) Error() string {
+	return fmt.Sprintf("dingtalk http status %d", e.StatusCode)
+}
+
+// SetRetryPolicy replaces the retry policy. Call it before the client is used.
+func (c *Client) SetRetryPolicy(p RetryPolicy) {
+	c.retryPolicy = p
+}
+
+// SetAttemptObserver registers fn to be notified of every attempt. Call it before the client is used.
+func (c *Client) SetAttemptObserver(fn AttemptObserver) {
+	c.observer = fn
+}
+
+// do sends req and returns the response body. 5xx and 429 responses become *HTTPStatusError.
+// Transport errors quote the request URL; its access_token, appsecret and mobile are masked so
+// they never reach logs.
+func (c *Client) do(req *http.Request) ([]byte, error) {
+	resp, err := c.http.Do(req)
+	if err != nil {
+		var urlErr *url.Error
+		if errors.As(err, &urlErr) {
+			urlErr.URL = redact.URL(urlErr.URL)
+		}
+		return nil, err
+	}
+	defer func() { _ = resp.Body.Close() }()
+	if resp.StatusCode >= http.StatusInternalServerError || resp.StatusCode == http.StatusTooManyRequests {
+		_, _ = io.Copy(io.Discard, resp.Body)
+		return nil, &HTTPStatusError{StatusCode: resp.StatusCode}
+	}
+	return io.ReadAll(resp.Body)
+}
+
+// retry runs fn until it succeeds, fails permanently, or the policy is exhausted.
+// idempotent marks calls that are safe to repeat after any transient failure; other calls
+// (sending a message, exchanging a one-time auth code) are only retried when DingTalk
+// certainly did not process the request. While the circuit breaker is open, retry returns
+// ErrCircuitOpen without calling fn; the final outcome of each call feeds the breaker. Once the
+// expiry set by WithExpiry has passed, it returns ErrExpired instead of (re)trying.
+func (c *Client) retry(ctx context.Context, endpoint string, idempotent bool, fn func(ctx context.Context) error) error {
+	if expired(ctx, time.Now()) {
+		return ErrExpired
+	}
+	probe, err := c.breaker.allow()
+	if err != nil {
+		return err
+	}
+	err = c.attempt(ctx, endpoint, idempotent, fn)
+	// Calls cut short by the caller or never made (no outbound slot, expired) say nothing about DingTalk.
+	ignored := err != nil && (ctx.Err() != nil || errors.Is(err, ErrRateLimited) || errors.Is(err, ErrExpired))
+	c.breaker.done(probe, err != nil && isTransient(err, true), ignored)
+	return err
+}
+
+// attempt runs fn with the retry policy.
+func (c *Client) attempt(ctx context.Context, endpoint string, idempotent bool, fn func(ctx context.Context) error) error {
+	p := c.retryPolicy
+	if p.MaxElapsed > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, p.MaxElapsed)
+		defer cancel()
+	}
+	delay := p.BaseDelay
+	class := rateClass(endpoint)
+	var err error
+	for attempt := 1; ; attempt++ {
+		if werr := c.pacers[class].wait(ctx, class); werr != nil {
+			if err != nil {
+				// A retry found no slot: report what DingTalk said last.
+				return err
+			}
+			return werr
+		}
+		start := time.Now()
+		err = fn(ctx)
+		willRetry := err != nil && ctx.Err() == nil && attempt < p.MaxAttempts && isTransient(err, idempotent)
+		var wait time.Duration
+		if willRetry {
+			// Equal jitter: half the delay fixed, half random, so callers spread out. rand.N panics
+			// on a negative bound, so a non-positive delay retries at once.
+			if delay > 0 {
+				wait = delay/2 + rand.N(delay/2+1)
+			}
+			if deadline, ok := ctx.Deadline(); ok && time.Now().Add(wait).After(deadline) {
+				willRetry = false
+			}
+			if expired(ctx, time.Now().Add(wait)) {
+				willRetry = false
+			}
+		}
+		if c.observer != nil {
+			c.observer(endpoint, attempt, err, time.Since(start), willRetry)
+		}
+		if !willRetry {
+			return err
+		}
+		t := time.NewTimer(wait)
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			t.Stop()
+			return err
+		}
+		delay = min(delay*2, p.MaxDelay)
+	}
+}
+
+// IsRetryable reports whether err is a transient failure (or an open circuit breaker, or no
+// outbound rate limit slot) that a later attempt may overcome. Callers that re-deliver on their
+// own, like the async queue, use it to give up early on errors such as an unknown userid.
+func IsRetryable(err error) bool {
+	return errors.Is(err, ErrCircuitOpen) || errors.Is(err, ErrRateLimited) || isTransient(err, true)
+}
+
+// NotProcessed reports whether err means DingTalk certainly did not process the call: it was never
+// sent (open circuit breaker, no outbound slot, expired, no connection) or DingTalk refused it
+// up front (HTTP 429/503, errcode -1). After any other failure, such as a read timeout, a 502 or a
+// permanent errcode, a message may already have been delivered, so sending it again is not safe.
+func NotProcessed(err error) bool {
+	return errors.Is(err, ErrCircuitOpen) || errors.Is(err, ErrRateLimited) || errors.Is(err, ErrExpired) || isTransient(err, false)
+}
+
+// isTransient classifies err as worth retrying. Callers check their own context first: a
+// cancelled or expired caller context is never retried.
+func isTransient(err error, idempotent bool) bool {
+	if errors.Is(err, context.Canceled) {
+		return false
+	}
+	var apiErr *APIError
+	if errors.As(err, &apiErr) {
+		return apiErr.ErrCode == errCodeSystemBusy
+	}
+	var statusErr *HTTPStatusError
+	if errors.As(err, &statusErr) {
+		if idempotent {
+			return true
+		}
+		// 429/503 mean the request was rejected before processing.
+		return statusErr.StatusCode == http.StatusTooManyRequests || statusErr.StatusCode == http.StatusServiceUnavailable
+	}
+	var opErr *net.OpError
+	if errors.As(err, &opErr) && opErr.Op == "dial" {
+		// Connection never established: nothing was sent.
+		return true
+	}
+	var netErr net.Error
+	return idempotent && errors.As(err, &netErr)
+}
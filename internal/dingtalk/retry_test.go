@@ -0,0 +1,247 @@
+package dingtalk
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+var fastRetry = RetryPolicy{MaxAttempts: 3, BaseDelay: time.Millisecond, MaxDelay: 4 * time.Millisecond, MaxElapsed: time.Second}
+
+func TestSendWorkNotify_RetriesSystemBusy(t *testing.T) {
+	var sendCalls int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if r.URL.Path == "/gettoken" {
+			_ = json.NewEncoder(w).Encode(map[string]any{"errcode": 0, "access_token": "tok", "expires_in": 7200})
+			return
+		}
+		if atomic.AddInt32(&sendCalls, 1) < 3 {
+			_ = json.NewEncoder(w).Encode(map[string]any{"errcode": -1, "errmsg": "系统繁忙"})
+			return
+		}
+		_ = json.NewEncoder(w).Encode(map[string]any{"errcode": 0, "task_id": 7})
+	}))
+	defer server.Close()
+
+	client := NewClientWithHTTP("key", "secret", "1", &http.Client{Transport: &redirectTransport{base: server}})
+	client.SetRetryPolicy(fastRetry)
+	var mu sync.Mutex
+	var attempts []int
+	client.SetAttemptObserver(func(endpoint string, attempt int, err error, _ time.Duration, willRetry bool) {
+		if endpoint != EndpointSend {
+			return
+		}
+		mu.Lock()
+		attempts = append(attempts, attempt)
+		mu.Unlock()
+		if (err != nil) != willRetry {
+			t.Errorf("attempt %d: err=%v willRetry=%v", attempt, err, willRetry)
+		}
+	})
+	taskID, err := client.SendWorkNotify(context.Background(), "u1", "hi")
+	if err != nil || taskID != "7" {
+		t.Fatalf("SendWorkNotify = %q, %v; want 7, nil", taskID, err)
+	}
+	if len(attempts) != 3 {
+		t.Errorf("observed send attempts = %v, want 3", attempts)
+	}
+}
+
+func TestSendWorkNotify_NoRetryOn500(t *testing.T) {
+	var sendCalls int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/gettoken" {
+			_ = json.NewEncoder(w).Encode(map[string]any{"errcode": 0, "access_token": "tok", "expires_in": 7200})
+			return
+		}
+		atomic.AddInt32(&sendCalls, 1)
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer server.Close()
+
+	client := NewClientWithHTTP("key", "secret", "1", &http.Client{Transport: &redirectTransport{base: server}})
+	client.SetRetryPolicy(fastRetry)
+	_, err := client.SendWorkNotify(context.Background(), "u1", "hi")
+	var statusErr *HTTPStatusError
+	if !errors.As(err, &statusErr) || statusErr.StatusCode != http.StatusInternalServerError {
+		t.Fatalf("err = %v, want HTTPStatusError 500", err)
+	}
+	if got := atomic.LoadInt32(&sendCalls); got != 1 {
+		t.Errorf("send calls = %d, want 1 (a 500 may have been delivered)", got)
+	}
+}
+
+func TestGetUserIDByMobile_RetriesUntilMaxAttempts(t *testing.T) {
+	var lookups int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/gettoken" {
+			_ = json.NewEncoder(w).Encode(map[string]any{"errcode": 0, "access_token": "tok", "expires_in": 7200})
+			return
+		}
+		atomic.AddInt32(&lookups, 1)
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer server.Close()
+
+	client := NewClientWithHTTP("key", "secret", "1", &http.Client{Transport: &redirectTransport{base: server}})
+	client.SetRetryPolicy(fastRetry)
+	if _, err := client.GetUserIDByMobile(context.Background(), "13800138000"); err == nil {
+		t.Fatal("want error")
+	}
+	if got := atomic.LoadInt32(&lookups); got != 3 {
+		t.Errorf("lookups = %d, want 3", got)
+	}
+}
+
+// failingTransport answers /gettoken with token and fails every other request.
+type failingTransport struct{ token string }
+
+func (f failingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.URL.Path == "/gettoken" && f.token != "" {
+		rec := httptest.NewRecorder()
+		_ = json.NewEncoder(rec).Encode(map[string]any{"errcode": 0, "access_token": f.token, "expires_in": 7200})
+		return rec.Result(), nil
+	}
+	return nil, errors.New("connection reset by peer")
+}
+
+func TestDo_MasksCredentialsInTransportErrors(t *testing.T) {
+	client := NewClientWithHTTP("key", "app-s3cret", "1", &http.Client{Transport: failingTransport{}})
+	client.SetRetryPolicy(RetryPolicy{MaxAttempts: 1})
+	_, err := client.SendWorkNotify(context.Background(), "user1", "hi")
+	if err == nil || strings.Contains(err.Error(), "app-s3cret") || !strings.Contains(err.Error(), "connection reset") {
+		t.Errorf("gettoken error = %v; want the transport error without the app secret", err)
+	}
+
+	client = NewClientWithHTTP("key", "app-s3cret", "1", &http.Client{Transport: failingTransport{token: "tok-s3cret"}})
+	client.SetRetryPolicy(RetryPolicy{MaxAttempts: 1})
+	for _, call := range []func() error{
+		func() error { _, err := client.SendWorkNotify(context.Background(), "user1", "hi"); return err },
+		func() error { _, err := client.GetUserIDByMobile(context.Background(), "13812345678"); return err },
+	} {
+		err := call()
+		if err == nil {
+			t.Fatal("expected error")
+		}
+		for _, secret := range []string{"tok-s3cret", "13812345678"} {
+			if strings.Contains(err.Error(), secret) {
+				t.Errorf("error %q contains %q", err, secret)
+			}
+		}
+		var netErr interface{ Timeout() bool }
+		if !errors.As(err, &netErr) {
+			t.Errorf("error %v should still unwrap to the *url.Error", err)
+		}
+	}
+}
+
+func TestRetry_StopsAtContextDeadline(t *testing.T) {
+	client := NewClient("key", "secret", "1")
+	client.SetRetryPolicy(RetryPolicy{MaxAttempts: 10, BaseDelay: 50 * time.Millisecond, MaxDelay: 50 * time.Millisecond})
+	ctx, cancel := context.WithTimeout(context.Background(), 80*time.Millisecond)
+	defer cancel()
+	var calls int
+	err := client.retry(ctx, EndpointGetToken, true, func(context.Context) error {
+		calls++
+		return &HTTPStatusError{StatusCode: http.StatusServiceUnavailable}
+	})
+	if err == nil {
+		t.Fatal("want error")
+	}
+	if calls < 1 || calls > 3 {
+		t.Errorf("calls = %d, want retries bounded by the context deadline", calls)
+	}
+}
+
+func TestIsTransient(t *testing.T) {
+	dialErr := &net.OpError{Op: "dial", Err: errors.New("connection refused")}
+	readErr := &net.OpError{Op: "read", Err: errors.New("connection reset")}
+	tests := []struct {
+		name       string
+		err        error
+		idempotent bool
+		want       bool
+	}{
+		{"system busy", &APIError{ErrCode: -1}, false, true},
+		{"other errcode", &APIError{ErrCode: 60020}, true, false},
+		{"500 idempotent", &HTTPStatusError{StatusCode: 500}, true, true},
+		{"500 send", &HTTPStatusError{StatusCode: 500}, false, false},
+		{"503 send", &HTTPStatusError{StatusCode: 503}, false, true},
+		{"dial send", dialErr, false, true},
+		{"read idempotent", readErr, true, true},
+		{"read send", readErr, false, false},
+		{"canceled", context.Canceled, true, false},
+		{"plain", errors.New("boom"), true, false},
+	}
+	for _, tt := range tests {
+		if got := isTransient(tt.err, tt.idempotent); got != tt.want {
+			t.Errorf("%s: isTransient = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestIsRetryable(t *testing.T) {
+	if !IsRetryable(ErrCircuitOpen) || !IsRetryable(&APIError{ErrCode: -1}) {
+		t.Error("circuit open and system busy should be retryable")
+	}
+	if IsRetryable(&APIError{ErrCode: 60121}) || IsRetryable(errors.New("getbymobile: no userid for mobile")) {
+		t.Error("business errors should not be retryable")
+	}
+}
+
+func TestNotProcessed(t *testing.T) {
+	dialErr := &url.Error{Op: "Post", URL: "https://oapi.dingtalk.com", Err: &net.OpError{Op: "dial", Err: errors.New("connection refused")}}
+	readErr := &url.Error{Op: "Post", URL: "https://oapi.dingtalk.com", Err: &net.OpError{Op: "read", Err: errors.New("i/o timeout")}}
+	for _, tc := range []struct {
+		err  error
+		want bool
+	}{
+		{ErrCircuitOpen, true},
+		{&RateLimitError{RetryAfter: time.Second}, true},
+		{ErrExpired, true},
+		{dialErr, true},
+		{&HTTPStatusError{StatusCode: 429}, true},
+		{&HTTPStatusError{StatusCode: 503}, true},
+		{&APIError{ErrCode: -1}, true},
+		{readErr, false},
+		{&HTTPStatusError{StatusCode: 502}, false},
+		{&APIError{ErrCode: 40035}, false},
+		{context.DeadlineExceeded, false},
+	} {
+		if got := NotProcessed(tc.err); got != tc.want {
+			t.Errorf("NotProcessed(%v) = %v, want %v", tc.err, got, tc.want)
+		}
+	}
+}
+
+func TestGetUserIDByMobile_NegativeBackoffDoesNotPanic(t *testing.T) {
+	var lookups int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/gettoken" {
+			_ = json.NewEncoder(w).Encode(map[string]any{"errcode": 0, "access_token": "tok", "expires_in": 7200})
+			return
+		}
+		atomic.AddInt32(&lookups, 1)
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer server.Close()
+
+	client := NewClientWithHTTP("key", "secret", "1", &http.Client{Transport: &redirectTransport{base: server}})
+	client.SetRetryPolicy(RetryPolicy{MaxAttempts: 3, BaseDelay: -time.Second, MaxDelay: -time.Second})
+	if _, err := client.GetUserIDByMobile(context.Background(), "13800138000"); err == nil {
+		t.Fatal("want error")
+	}
+	if got := atomic.LoadInt32(&lookups); got != 3 {
+		t.Errorf("lookups = %d, want 3", got)
+	}
+}
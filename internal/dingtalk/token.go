@@ -0,0 +1,241 @@
+package dingtalk
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math/rand/v2"
+	"net/http"
+	"time"
+)
+
+const (
+	// tokenExpirySkew is subtracted from expires_in to absorb clock drift and slow requests, so a
+	// token is never used close to its real expiry even with the background refresher off.
+	tokenExpirySkew = 120 * time.Second
+	// refreshRetryMin / refreshRetryMax bound the backoff after a failed background refresh.
+	refreshRetryMin = time.Second
+	refreshRetryMax = time.Minute
+	// tokenLockTTL bounds how long one client may hold the shared refresh lock.
+	tokenLockTTL = 10 * time.Second
+	// tokenLockWait / tokenLockPoll: how long and how often a client that lost the refresh lock
+	// polls the shared cache for the winner's token before fetching one itself.
+	tokenLockWait = 3 * time.Second
+	tokenLockPoll = 100 * time.Millisecond
+	// tokenRefreshTimeout bounds a shared refresh, including retries and waiting for the lock.
+	tokenRefreshTimeout = 30 * time.Second
+)
+
+// tokenCall is a single gettoken request whose result is shared by every waiter.
+type tokenCall struct {
+	done chan struct{}
+	tok  string
+	err  error
+}
+
+// getToken returns a valid access token, refreshing if needed.
+// Concurrent callers that find the token expired share one gettoken request.
+func (c *Client) getToken(ctx context.Context) (string, error) {
+	return c.refreshToken(ctx, time.Now())
+}
+
+// withToken runs fn with a valid access token. If DingTalk rejects the token as invalid or expired
+// (it may be revoked or rotated before the cached expiry), the cached token is dropped, a new one is
+// fetched and fn is retried exactly once.
+func (c *Client) withToken(ctx context.Context, fn func(tok string) error) error {
+	tok, err := c.getToken(ctx)
+	if err != nil {
+		return err
+	}
+	err = fn(tok)
+	if !isTokenInvalid(err) {
+		return err
+	}
+	c.invalidateToken(ctx, tok)
+	if tok, err = c.getToken(ctx); err != nil {
+		return err
+	}
+	return fn(tok)
+}
+
+// invalidateToken drops the cached token (locally and in the shared cache) if it is still tok,
+// so the next getToken refetches. Comparing with tok avoids discarding a fresh token another
+// goroutine or replica already fetched.
+func (c *Client) invalidateToken(ctx context.Context, tok string) {
+	c.mu.Lock()
+	if c.token == tok {
+		c.token = ""
+		c.expires = time.Time{}
+	}
+	c.mu.Unlock()
+	_ = c.cache.Delete(ctx, c.tokenKey(), tok)
+}
+
+// refreshToken returns the local token if it stays valid after validUntil; otherwise it obtains
+// one from the shared cache or /gettoken. Only one refresh runs at a time per client; every caller,
+// including the one that started it, waits for its result or its own ctx, whichever comes first.
+func (c *Client) refreshToken(ctx context.Context, validUntil time.Time) (string, error) {
+	c.mu.Lock()
+	if c.token != "" && c.expires.After(validUntil) {
+		tok := c.token
+		c.mu.Unlock()
+		return tok, nil
+	}
+	call := c.refresh
+	if call == nil {
+		call = &tokenCall{done: make(chan struct{})}
+		c.refresh = call
+		go c.runRefresh(call, validUntil)
+	}
+	c.mu.Unlock()
+	select {
+	case <-call.done:
+		return call.tok, call.err
+	case <-ctx.Done():
+		return "", ctx.Err()
+	}
+}
+
+// runRefresh performs call on a fresh context: several callers wait on the result, so neither one
+// caller's cancellation nor values such as its WithExpiry deadline may cut the refresh short.
+func (c *Client) runRefresh(call *tokenCall, validUntil time.Time) {
+	ctx, cancel := context.WithTimeout(context.Background(), tokenRefreshTimeout)
+	defer cancel()
+	tok, expires, err := c.obtainToken(ctx, validUntil)
+	c.mu.Lock()
+	if err == nil {
+		c.token = tok
+		c.expires = expires
+	}
+	c.refresh = nil
+	c.mu.Unlock()
+	call.tok, call.err = tok, err
+	close(call.done)
+}
+
+// obtainToken returns a token from the shared cache if one stays valid after validUntil. Otherwise
+// it takes the cache's refresh lock, re-checks the cache, fetches from /gettoken and publishes the
+// result. If another holder has the lock, it polls the cache briefly for that holder's token before
+// fetching one itself. Cache errors only cost the sharing: the client falls back to /gettoken.
+func (c *Client) obtainToken(ctx context.Context, validUntil time.Time) (string, time.Time, error) {
+	key := c.tokenKey()
+	if tok, exp, ok, err := c.cache.Get(ctx, key); err == nil && ok && exp.After(validUntil) {
+		return tok, exp, nil
+	}
+	unlock, locked, err := c.cache.Lock(ctx, key, tokenLockTTL)
+	if err == nil && !locked {
+		for deadline := time.Now().Add(tokenLockWait); time.Now().Before(deadline); {
+			select {
+			case <-time.After(tokenLockPoll):
+			case <-ctx.Done():
+				return "", time.Time{}, ctx.Err()
+			}
+			if tok, exp, ok, err := c.cache.Get(ctx, key); err == nil && ok && exp.After(validUntil) {
+				return tok, exp, nil
+			}
+		}
+	}
+	if locked {
+		defer unlock()
+		if tok, exp, ok, err := c.cache.Get(ctx, key); err == nil && ok && exp.After(validUntil) {
+			return tok, exp, nil
+		}
+	}
+	var tok string
+	var expiresIn int
+	err = c.retry(ctx, EndpointGetToken, true, func(ctx context.Context) error {
+		tok, expiresIn, err = c.fetchToken(ctx)
+		return err
+	})
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	expires := time.Now().Add(time.Duration(expiresIn)*time.Second - tokenExpirySkew)
+	_ = c.cache.Set(ctx, key, tok, expires)
+	return tok, expires, nil
+}
+
+// tokenKey is the shared cache key for this app's access token.
+func (c *Client) tokenKey() string {
+	return "token:" + c.appKey
+}
+
+// fetchToken calls /gettoken and returns the app access token and its lifetime in seconds.
+func (c *Client) fetchToken(ctx context.Context) (string, int, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet,
+		fmt.Sprintf("%s?appkey=%s&appsecret=%s", getTokenURL, c.appKey, c.appSecret), nil)
+	if err != nil {
+		return "", 0, err
+	}
+	body, err := c.do(req)
+	if err != nil {
+		return "", 0, err
+	}
+	var tr tokenResp
+	if err := json.Unmarshal(body, &tr); err != nil {
+		return "", 0, err
+	}
+	if tr.ErrCode != 0 {
+		return "", 0, &APIError{Op: "dingtalk gettoken", ErrCode: tr.ErrCode, ErrMsg: tr.ErrMsg}
+	}
+	return tr.AccessToken, tr.ExpiresIn, nil
+}
+
+// StartTokenRefresher renews the access token in the background about ahead before it expires
+// (plus up to jitter, so replicas do not refresh in lockstep), but never before half of its
+// lifetime has passed. Failed refreshes are retried with exponential backoff while the old token
+// keeps being served until it really expires. The refresher stops when Close is called.
+func (c *Client) StartTokenRefresher(ahead, jitter time.Duration) {
+	go func() {
+		for {
+			lead, wait := ahead, time.Duration(0)
+			c.mu.Lock()
+			if c.token != "" {
+				remaining := time.Until(c.expires)
+				if jitter > 0 {
+					lead += rand.N(jitter)
+				}
+				// An ahead as long as the token lifetime would make every new token due at once.
+				lead = min(lead, remaining/2)
+				wait = remaining - lead
+			}
+			c.mu.Unlock()
+			if !c.sleep(wait) {
+				return
+			}
+			for backoff := refreshRetryMin; ; backoff = min(backoff*2, refreshRetryMax) {
+				if _, err := c.refreshToken(context.Background(), time.Now().Add(lead)); err == nil {
+					break
+				}
+				if !c.sleep(backoff) {
+					return
+				}
+			}
+		}
+	}()
+}
+
+// Close stops the background token refresher. It is safe to call more than once.
+func (c *Client) Close() {
+	c.stopOnce.Do(func() { close(c.stop) })
+}
+
+// sleep waits for d and reports false if the client was closed meanwhile.
+func (c *Client) sleep(d time.Duration) bool {
+	if d <= 0 {
+		select {
+		case <-c.stop:
+			return false
+		default:
+			return true
+		}
+	}
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return true
+	case <-c.stop:
+		return false
+	}
+}
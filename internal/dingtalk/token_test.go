@@ -0,0 +1,190 @@
+package dingtalk
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestStartTokenRefresher_RenewsAhead(t *testing.T) {
+	var tokenCalls int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := atomic.AddInt32(&tokenCalls, 1)
+		w.Header().Set("Content-Type", "application/json")
+		// 122s lifetime minus the 120s skew leaves 2s; with ahead=1s the refresher renews after ~1s.
+		_ = json.NewEncoder(w).Encode(map[string]any{"errcode": 0, "access_token": "tok" + string(rune('0'+n)), "expires_in": 122})
+	}))
+	defer server.Close()
+
+	client := NewClientWithHTTP("key", "secret", "1", &http.Client{
+		Transport: &redirectTransport{base: server},
+	})
+	client.StartTokenRefresher(time.Second, 0)
+	defer client.Close()
+
+	time.Sleep(1500 * time.Millisecond)
+	if got := atomic.LoadInt32(&tokenCalls); got < 2 {
+		t.Fatalf("gettoken calls = %d, want at least 2 (initial + proactive renew)", got)
+	}
+	tok, err := client.getToken(context.Background())
+	if err != nil {
+		t.Fatalf("getToken: %v", err)
+	}
+	if tok == "tok1" {
+		t.Errorf("getToken returned the first token; expected a renewed one")
+	}
+}
+
+func TestStartTokenRefresher_KeepsOldTokenOnFailure(t *testing.T) {
+	var tokenCalls int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if atomic.AddInt32(&tokenCalls, 1) == 1 {
+			// 2s left after the skew: with ahead=1s the refresh is due after ~1s.
+			_ = json.NewEncoder(w).Encode(map[string]any{"errcode": 0, "access_token": "old", "expires_in": 122})
+			return
+		}
+		_ = json.NewEncoder(w).Encode(map[string]any{"errcode": -1, "errmsg": "busy"})
+	}))
+	defer server.Close()
+
+	client := NewClientWithHTTP("key", "secret", "1", &http.Client{
+		Transport: &redirectTransport{base: server},
+	})
+	client.SetRetryPolicy(fastRetry)
+	if _, err := client.getToken(context.Background()); err != nil {
+		t.Fatalf("getToken: %v", err)
+	}
+	client.StartTokenRefresher(time.Second, 0)
+	time.Sleep(1300 * time.Millisecond)
+	client.Close()
+
+	if got := atomic.LoadInt32(&tokenCalls); got < 2 {
+		t.Fatalf("gettoken calls = %d, want a background refresh attempt", got)
+	}
+	tok, err := client.getToken(context.Background())
+	if err != nil || tok != "old" {
+		t.Errorf("getToken = %q, %v; want old token served until it expires", tok, err)
+	}
+}
+
+func TestStartTokenRefresher_ClampsAheadToHalfTheLifetime(t *testing.T) {
+	var tokenCalls int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&tokenCalls, 1)
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(map[string]any{"errcode": 0, "access_token": "tok", "expires_in": 7200})
+	}))
+	defer server.Close()
+
+	client := NewClientWithHTTP("key", "secret", "1", &http.Client{
+		Transport: &redirectTransport{base: server},
+	})
+	// ahead beyond the token lifetime must not refresh every token as soon as it arrives.
+	client.StartTokenRefresher(3*time.Hour, 0)
+	time.Sleep(1500 * time.Millisecond)
+	client.Close()
+	if got := atomic.LoadInt32(&tokenCalls); got != 1 {
+		t.Errorf("gettoken calls = %d, want 1", got)
+	}
+}
+
+func TestClose_StopsRefresher(t *testing.T) {
+	var tokenCalls int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&tokenCalls, 1)
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(map[string]any{"errcode": 0, "access_token": "tok", "expires_in": 7200})
+	}))
+	defer server.Close()
+
+	client := NewClientWithHTTP("key", "secret", "1", &http.Client{
+		Transport: &redirectTransport{base: server},
+	})
+	client.Close()
+	client.StartTokenRefresher(time.Minute, 0)
+	client.Close() // safe to call twice
+	time.Sleep(100 * time.Millisecond)
+	if got := atomic.LoadInt32(&tokenCalls); got != 0 {
+		t.Errorf("gettoken calls = %d after Close, want 0", got)
+	}
+}
+
+func TestRefreshToken_IgnoresOneWaitersExpiry(t *testing.T) {
+	var tokenCalls int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&tokenCalls, 1) == 1 {
+			time.Sleep(100 * time.Millisecond)
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(map[string]any{"errcode": 0, "access_token": "tok", "expires_in": 7200})
+	}))
+	defer server.Close()
+
+	client := NewClientWithHTTP("key", "secret", "1", &http.Client{
+		Transport: &redirectTransport{base: server},
+	})
+	client.SetRetryPolicy(RetryPolicy{MaxAttempts: 3, BaseDelay: 10 * time.Millisecond, MaxDelay: 10 * time.Millisecond})
+
+	// The first waiter starts the refresh and expires before the retry would run.
+	nearlyExpired := WithExpiry(context.Background(), time.Now().Add(50*time.Millisecond))
+	first := make(chan error, 1)
+	go func() {
+		_, err := client.getToken(nearlyExpired)
+		first <- err
+	}()
+	time.Sleep(20 * time.Millisecond)
+	tok, err := client.getToken(context.Background())
+	if err != nil || tok != "tok" {
+		t.Fatalf("getToken without expiry = %q, %v; want tok", tok, err)
+	}
+	if err := <-first; err != nil {
+		t.Errorf("getToken of the expiring waiter = %v, want the shared token", err)
+	}
+	if got := atomic.LoadInt32(&tokenCalls); got != 2 {
+		t.Errorf("gettoken calls = %d, want 2 (the retry must not be skipped)", got)
+	}
+}
+
+func TestRefreshToken_StarterReturnsOnCancel(t *testing.T) {
+	var tokenCalls int32
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&tokenCalls, 1)
+		<-release
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(map[string]any{"errcode": 0, "access_token": "tok", "expires_in": 7200})
+	}))
+	defer server.Close()
+
+	client := NewClientWithHTTP("key", "secret", "1", &http.Client{
+		Transport: &redirectTransport{base: server},
+	})
+
+	// The caller that starts the refresh gives up without waiting for gettoken.
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if _, err := client.getToken(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("getToken of the cancelled caller = %v, want DeadlineExceeded", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("cancelled caller returned after %v", elapsed)
+	}
+	// The refresh it started carries on for the next caller.
+	close(release)
+	tok, err := client.getToken(context.Background())
+	if err != nil || tok != "tok" {
+		t.Fatalf("getToken = %q, %v; want tok", tok, err)
+	}
+	if got := atomic.LoadInt32(&tokenCalls); got != 1 {
+		t.Errorf("gettoken calls = %d, want 1", got)
+	}
+}
@@ -0,0 +1,89 @@
+package dingtalk
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// TokenCache stores the app access token per AppKey so several clients (e.g. replicas sharing
+// Redis) reuse one token instead of each calling /gettoken.
+type TokenCache interface {
+	// Get returns the cached token for key; ok=false means none is cached.
+	Get(ctx context.Context, key string) (token string, expires time.Time, ok bool, err error)
+	// Set stores token for key until expires.
+	Set(ctx context.Context, key, token string, expires time.Time) error
+	// Delete removes the cached token for key only if it still equals token.
+	Delete(ctx context.Context, key, token string) error
+	// Lock takes the refresh lock for key for at most ttl. ok=false means another holder has it.
+	// unlock must be called when ok is true.
+	Lock(ctx context.Context, key string, ttl time.Duration) (unlock func(), ok bool, err error)
+}
+
+// MemoryTokenCache is the default process-local TokenCache.
+type MemoryTokenCache struct {
+	mu     sync.Mutex
+	tokens map[string]cachedToken
+	locks  map[string]time.Time
+}
+
+type cachedToken struct {
+	token   string
+	expires time.Time
+}
+
+// NewMemoryTokenCache creates an empty in-memory token cache.
+func NewMemoryTokenCache() *MemoryTokenCache {
+	return &MemoryTokenCache{
+		tokens: make(map[string]cachedToken),
+		locks:  make(map[string]time.Time),
+	}
+}
+
+// Get implements TokenCache.
+func (m *MemoryTokenCache) Get(_ context.Context, key string) (string, time.Time, bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	t, ok := m.tokens[key]
+	if !ok || time.Now().After(t.expires) {
+		return "", time.Time{}, false, nil
+	}
+	return t.token, t.expires, true, nil
+}
+
+// Set implements TokenCache.
+func (m *MemoryTokenCache) Set(_ context.Context, key, token string, expires time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.tokens[key] = cachedToken{token: token, expires: expires}
+	return nil
+}
+
+// Delete implements TokenCache.
+func (m *MemoryTokenCache) Delete(_ context.Context, key, token string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if t, ok := m.tokens[key]; ok && t.token == token {
+		delete(m.tokens, key)
+	}
+	return nil
+}
+
+// Lock implements TokenCache.
+func (m *MemoryTokenCache) Lock(_ context.Context, key string, ttl time.Duration) (func(), bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := time.Now()
+	if until, held := m.locks[key]; held && now.Before(until) {
+		return nil, false, nil
+	}
+	until := now.Add(ttl)
+	m.locks[key] = until
+	return func() {
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		if m.locks[key] == until {
+			delete(m.locks, key)
+		}
+	}, true, nil
+}
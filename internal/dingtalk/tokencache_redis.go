@@ -0,0 +1,97 @@
+package dingtalk
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// deleteIfTokenScript removes the token hash only if it still holds the given token.
+var deleteIfTokenScript = redis.NewScript(`
+if redis.call("HGET", KEYS[1], "token") == ARGV[1] then
+	return redis.call("DEL", KEYS[1])
+end
+return 0`)
+
+// unlockScript releases a lock only if it is still held by the given owner value.
+var unlockScript = redis.NewScript(`
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("DEL", KEYS[1])
+end
+return 0`)
+
+// RedisTokenCache is a TokenCache shared by all replicas through Redis.
+// Tokens are stored as hashes (token, expires in unix ms) that Redis expires at the token expiry;
+// the refresh lock is a SET NX PX key owned by a random value.
+type RedisTokenCache struct {
+	rdb    redis.UniversalClient
+	prefix string
+}
+
+// NewRedisTokenCache creates a Redis-backed token cache. prefix is prepended to every key.
+func NewRedisTokenCache(rdb redis.UniversalClient, prefix string) *RedisTokenCache {
+	return &RedisTokenCache{rdb: rdb, prefix: prefix}
+}
+
+// Get implements TokenCache.
+func (r *RedisTokenCache) Get(ctx context.Context, key string) (string, time.Time, bool, error) {
+	vals, err := r.rdb.HMGet(ctx, r.prefix+key, "token", "expires").Result()
+	if err != nil {
+		return "", time.Time{}, false, err
+	}
+	tok, _ := vals[0].(string)
+	rawExp, _ := vals[1].(string)
+	if tok == "" || rawExp == "" {
+		return "", time.Time{}, false, nil
+	}
+	ms, err := strconv.ParseInt(rawExp, 10, 64)
+	if err != nil {
+		return "", time.Time{}, false, err
+	}
+	expires := time.UnixMilli(ms)
+	if time.Now().After(expires) {
+		return "", time.Time{}, false, nil
+	}
+	return tok, expires, true, nil
+}
+
+// Set implements TokenCache.
+func (r *RedisTokenCache) Set(ctx context.Context, key, token string, expires time.Time) error {
+	k := r.prefix + key
+	_, err := r.rdb.TxPipelined(ctx, func(p redis.Pipeliner) error {
+		p.HSet(ctx, k, "token", token, "expires", strconv.FormatInt(expires.UnixMilli(), 10))
+		p.PExpireAt(ctx, k, expires)
+		return nil
+	})
+	return err
+}
+
+// Delete implements TokenCache.
+func (r *RedisTokenCache) Delete(ctx context.Context, key, token string) error {
+	return deleteIfTokenScript.Run(ctx, r.rdb, []string{r.prefix + key}, token).Err()
+}
+
+// Lock implements TokenCache.
+func (r *RedisTokenCache) Lock(ctx context.Context, key string, ttl time.Duration) (func(), bool, error) {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return nil, false, err
+	}
+	owner := hex.EncodeToString(b[:])
+	lockKey := r.prefix + key + ":lock"
+	err := r.rdb.SetArgs(ctx, lockKey, owner, redis.SetArgs{Mode: "NX", TTL: ttl}).Err()
+	if errors.Is(err, redis.Nil) {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	return func() {
+		_ = unlockScript.Run(context.Background(), r.rdb, []string{lockKey}, owner).Err()
+	}, true, nil
+}
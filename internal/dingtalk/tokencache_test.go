@@ -0,0 +1,118 @@
+package dingtalk
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+)
+
+func testTokenCache(t *testing.T, cache TokenCache) {
+	t.Helper()
+	ctx := context.Background()
+	if _, _, ok, err := cache.Get(ctx, "k"); ok || err != nil {
+		t.Fatalf("Get on empty cache: ok=%v err=%v", ok, err)
+	}
+	exp := time.Now().Add(time.Hour).Truncate(time.Millisecond)
+	if err := cache.Set(ctx, "k", "tok", exp); err != nil {
+		t.Fatalf("Set: %v", err)
+	}
+	tok, gotExp, ok, err := cache.Get(ctx, "k")
+	if err != nil || !ok || tok != "tok" || !gotExp.Equal(exp) {
+		t.Fatalf("Get = %q %v %v %v; want tok %v", tok, gotExp, ok, err, exp)
+	}
+	if err := cache.Delete(ctx, "k", "other"); err != nil {
+		t.Fatalf("Delete(other): %v", err)
+	}
+	if _, _, ok, _ := cache.Get(ctx, "k"); !ok {
+		t.Fatal("Delete with a different token must not remove the entry")
+	}
+	if err := cache.Delete(ctx, "k", "tok"); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	if _, _, ok, _ := cache.Get(ctx, "k"); ok {
+		t.Fatal("expected miss after Delete")
+	}
+
+	unlock, ok, err := cache.Lock(ctx, "k", time.Minute)
+	if err != nil || !ok {
+		t.Fatalf("first Lock: ok=%v err=%v", ok, err)
+	}
+	if _, ok, err := cache.Lock(ctx, "k", time.Minute); err != nil || ok {
+		t.Fatalf("second Lock while held: ok=%v err=%v", ok, err)
+	}
+	unlock()
+	unlock2, ok, err := cache.Lock(ctx, "k", time.Minute)
+	if err != nil || !ok {
+		t.Fatalf("Lock after unlock: ok=%v err=%v", ok, err)
+	}
+	unlock2()
+}
+
+func TestMemoryTokenCache(t *testing.T) {
+	testTokenCache(t, NewMemoryTokenCache())
+}
+
+func TestRedisTokenCache(t *testing.T) {
+	mr := miniredis.RunT(t)
+	rdb := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	defer func() { _ = rdb.Close() }()
+	testTokenCache(t, NewRedisTokenCache(rdb, "herald-dingtalk:"))
+}
+
+func TestSharedTokenCache_OneFetchAcrossClients(t *testing.T) {
+	var tokenCalls int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&tokenCalls, 1)
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(map[string]any{"errcode": 0, "access_token": "shared", "expires_in": 7200})
+	}))
+	defer server.Close()
+
+	mr := miniredis.RunT(t)
+	rdb := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	defer func() { _ = rdb.Close() }()
+
+	for i := 0; i < 3; i++ {
+		replica := NewClientWithHTTP("key", "secret", "1", &http.Client{
+			Transport: &redirectTransport{base: server},
+		})
+		replica.SetTokenCache(NewRedisTokenCache(rdb, "herald-dingtalk:"))
+		tok, err := replica.getToken(context.Background())
+		if err != nil || tok != "shared" {
+			t.Fatalf("replica %d getToken = %q, %v", i, tok, err)
+		}
+	}
+	if got := atomic.LoadInt32(&tokenCalls); got != 1 {
+		t.Errorf("gettoken calls = %d across replicas, want 1", got)
+	}
+}
+
+func TestObtainToken_StopsWaitingForLockOnCancel(t *testing.T) {
+	cache := NewMemoryTokenCache()
+	client := NewClientWithHTTP("key", "secret", "1", http.DefaultClient)
+	client.SetTokenCache(cache)
+	// Another replica holds the refresh lock and never publishes a token.
+	unlock, ok, err := cache.Lock(context.Background(), client.tokenKey(), time.Minute)
+	if err != nil || !ok {
+		t.Fatalf("Lock: ok=%v err=%v", ok, err)
+	}
+	defer unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 150*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if _, _, err := client.obtainToken(ctx, time.Now()); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("obtainToken = %v, want DeadlineExceeded", err)
+	}
+	if elapsed := time.Since(start); elapsed >= tokenLockWait {
+		t.Errorf("obtainToken returned after %v, want well before the %v lock wait", elapsed, tokenLockWait)
+	}
+}
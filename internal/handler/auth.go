@@ -0,0 +1,205 @@
+package handler
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/soulteary/herald-dingtalk/internal/auth"
+	"github.com/soulteary/herald-dingtalk/internal/config"
+	"github.com/soulteary/herald-dingtalk/internal/tlsconfig"
+	"github.com/soulteary/logger-kit"
+)
+
+// callerLocal is the fiber.Ctx local holding the authenticated caller name, credentialLocal the
+// kind of credential that authenticated it.
+const (
+	callerLocal     = "caller"
+	credentialLocal = "credential"
+)
+
+// Authenticator checks one kind of caller credential.
+type Authenticator interface {
+	// Credential names the credential kind in audit logs, e.g. "api_key".
+	Credential() string
+	// Authenticate returns the caller name if the request's credential is valid and grants scope.
+	// found is false when the request carries no credential of this kind, so the next
+	// authenticator is tried.
+	Authenticate(c *fiber.Ctx, scope auth.Scope, now time.Time) (name string, found bool, err error)
+}
+
+// authenticators returns the chain configured by opts: client certificate, bearer JWT, HMAC
+// signature, then X-API-Key, with WithAuthenticators ones first. The API key authenticator
+// always decides, so a request without any credential is checked against the key ring.
+func authenticators(o options) []Authenticator {
+	keys := keyRing(o)
+	chain := append([]Authenticator{}, o.authenticators...)
+	chain = append(chain, clientCertAuth{keys})
+	if o.jwt != nil {
+		chain = append(chain, bearerAuth{o.jwt})
+	}
+	if o.signer != nil {
+		chain = append(chain, signatureAuth{o.signer, o.signRequired})
+	}
+	return append(chain, apiKeyAuth{keys: keys, required: o.jwt != nil})
+}
+
+// Authenticate returns middleware that lets a request through only if its caller may use scope,
+// recording the caller name (empty when auth is off) for logs and rate limits. Rejections get
+// 401 unauthorized or 403 forbidden with the usual error body and one audit log line. Routes
+// must name their scope: no credential grants the zero Scope.
+func Authenticate(scope auth.Scope, log *logger.Logger, opts ...Option) fiber.Handler {
+	o := newOptions(opts)
+	chain := authenticators(o)
+	return func(c *fiber.Ctx) error {
+		now := time.Now()
+		for _, a := range chain {
+			name, found, err := a.Authenticate(c, scope, now)
+			if !found {
+				continue
+			}
+			if err != nil {
+				return rejectAuth(c, log, a.Credential(), name, scope, err)
+			}
+			c.Locals(callerLocal, name)
+			c.Locals(credentialLocal, a.Credential())
+			return c.Next()
+		}
+		return rejectAuth(c, log, "", "", scope, auth.ErrMissingKey)
+	}
+}
+
+// rejectAuth writes the response for a failed authentication and logs it for audit.
+func rejectAuth(c *fiber.Ctx, log *logger.Logger, credential, name string, scope auth.Scope, err error) error {
+	status, code, msg := fiber.StatusUnauthorized, "unauthorized", err.Error()
+	switch {
+	case errors.Is(err, auth.ErrForbidden):
+		status, code, msg = fiber.StatusForbidden, "forbidden", "caller is not allowed to use this endpoint"
+	case errors.Is(err, auth.ErrMissingKey), errors.Is(err, auth.ErrInvalidKey), errors.Is(err, auth.ErrKeyExpired):
+		msg = "invalid or missing API key"
+	case errors.Is(err, auth.ErrBadSignature), errors.Is(err, auth.ErrStaleTimestamp), errors.Is(err, auth.ErrReplayed),
+		errors.Is(err, auth.ErrInvalidToken), errors.Is(err, auth.ErrTokenExpired):
+		// The reason helps callers fix their signing or token setup; it reveals no secret.
+	default:
+		// Not a verdict on the caller: e.g. the nonce store is unreachable. Fail closed.
+		status, code, msg = fiber.StatusServiceUnavailable, "auth_unavailable", "cannot verify request credentials"
+	}
+	ev := log.Warn()
+	if status == fiber.StatusServiceUnavailable {
+		ev = log.Error()
+	}
+	ev.Err(err).Str("method", c.Method()).Str("path", c.Path()).Str("client_ip", c.IP()).
+		Str("credential", credential).Str("caller", name).Str("scope", string(scope)).Int("status", status).
+		Msg("request rejected: " + code)
+	return c.Status(status).JSON(fiber.Map{"ok": false, "error_code": code, "error_message": msg})
+}
+
+// apiKeyAuth checks X-API-Key against the key ring. It always decides; with required set, an
+// empty ring (no API keys, only other credentials configured) rejects the request instead of
+// allowing it anonymously.
+type apiKeyAuth struct {
+	keys     *auth.KeyRing
+	required bool
+}
+
+func (apiKeyAuth) Credential() string { return "api_key" }
+
+func (a apiKeyAuth) Authenticate(c *fiber.Ctx, scope auth.Scope, now time.Time) (string, bool, error) {
+	if a.required && !a.keys.Enabled() {
+		return "", true, auth.ErrMissingKey
+	}
+	name, err := a.keys.Authorize(c.Get("X-API-Key"), scope, now)
+	return name, true, err
+}
+
+// clientCertAuth identifies callers by a verified TLS client certificate whose subject CN a key
+// claims with client_cert_cn.
+type clientCertAuth struct {
+	keys *auth.KeyRing
+}
+
+func (clientCertAuth) Credential() string { return "client_cert" }
+
+func (a clientCertAuth) Authenticate(c *fiber.Ctx, scope auth.Scope, now time.Time) (string, bool, error) {
+	return a.keys.AuthorizeCert(tlsconfig.PeerCommonName(c.Context().TLSConnectionState()), scope, now)
+}
+
+// bearerAuth checks "Authorization: Bearer" JWTs.
+type bearerAuth struct {
+	jwt *auth.JWTVerifier
+}
+
+func (bearerAuth) Credential() string { return "jwt" }
+
+func (a bearerAuth) Authenticate(c *fiber.Ctx, scope auth.Scope, now time.Time) (string, bool, error) {
+	token, ok := strings.CutPrefix(c.Get(fiber.HeaderAuthorization), "Bearer ")
+	if !ok {
+		return "", false, nil
+	}
+	name, err := a.jwt.Verify(strings.TrimSpace(token), scope, now)
+	return name, true, err
+}
+
+// signatureAuth checks HMAC-signed requests. With required set, requests for the send and
+// resolve scopes must be signed; X-API-Key alone is no longer accepted for them.
+type signatureAuth struct {
+	verifier *auth.Verifier
+	required bool
+}
+
+func (signatureAuth) Credential() string { return "signature" }
+
+func (a signatureAuth) Authenticate(c *fiber.Ctx, scope auth.Scope, now time.Time) (string, bool, error) {
+	mustSign := a.required && (scope == auth.ScopeSend || scope == auth.ScopeResolve)
+	if c.Get(auth.HeaderSignature) == "" && !mustSign {
+		return "", false, nil
+	}
+	name, err := a.verifier.Verify(c.Context(), auth.SignedRequest{
+		Method:    c.Method(),
+		Target:    c.OriginalURL(),
+		Body:      c.Body(),
+		KeyID:     c.Get(auth.HeaderKeyID),
+		Timestamp: c.Get(auth.HeaderTimestamp),
+		Nonce:     c.Get(auth.HeaderNonce),
+		Signature: c.Get(auth.HeaderSignature),
+	}, scope, now)
+	if errors.Is(err, auth.ErrMissingKey) {
+		err = fmt.Errorf("%w: %s, %s, %s and %s are required", auth.ErrBadSignature,
+			auth.HeaderKeyID, auth.HeaderTimestamp, auth.HeaderNonce, auth.HeaderSignature)
+	}
+	return name, true, err
+}
+
+// keyRing returns the ring from WithKeyRing, or one holding just API_KEY.
+func keyRing(o options) *auth.KeyRing {
+	if o.keys != nil {
+		return o.keys
+	}
+	keys, _ := auth.NewKeyRing(config.APIKey)
+	return keys
+}
+
+// callerName returns the caller recorded by Authenticate.
+func callerName(c *fiber.Ctx) string {
+	name, _ := c.Locals(callerLocal).(string)
+	return name
+}
+
+// callerLabel returns the caller as a metrics label. Only key ring names, which the operator
+// configures, are kept; JWT subjects are recorded as "jwt" and callers of WithAuthenticators ones
+// as "other", so a token issuer cannot grow the label set without bound.
+func callerLabel(c *fiber.Ctx) string {
+	name := callerName(c)
+	if name == "" {
+		return ""
+	}
+	switch credential, _ := c.Locals(credentialLocal).(string); credential {
+	case "api_key", "client_cert", "signature":
+		return name
+	case "jwt":
+		return "jwt"
+	}
+	return "other"
+}
@@ -0,0 +1,339 @@
+package handler
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/soulteary/herald-dingtalk/internal/auth"
+	"github.com/soulteary/herald-dingtalk/internal/config"
+	"github.com/soulteary/herald-dingtalk/internal/idempotency"
+	"github.com/soulteary/logger-kit"
+)
+
+func TestAuthenticate_ScopesAndExpiry(t *testing.T) {
+	keys, err := auth.NewKeyRing("",
+		auth.Key{Name: "herald-prod", Key: "send-key", Scopes: []auth.Scope{auth.ScopeSend}},
+		auth.Key{Name: "ops", Key: "admin-key", Scopes: []auth.Scope{auth.ScopeAdmin}},
+		auth.Key{Name: "retired", Key: "old-key", Scopes: auth.AllScopes, ExpiresAt: time.Now().Add(-time.Hour)},
+	)
+	if err != nil {
+		t.Fatalf("NewKeyRing: %v", err)
+	}
+	log := logger.New(logger.Config{Level: logger.ErrorLevel})
+	idemStore := idempotency.NewStore(300)
+	app := fiber.New()
+	app.Get("/v1/idempotency/stats", Authenticate(auth.ScopeAdmin, log, WithKeyRing(keys)), func(c *fiber.Ctx) error {
+		return IdempotencyStatsHandler(c, idemStore)
+	})
+	app.Get("/v1/jobs/:id", Authenticate(auth.ScopeSend, log, WithKeyRing(keys)), func(c *fiber.Ctx) error {
+		return JobHandler(c, log, WithKeyRing(keys))
+	})
+	app.Get("/v1/unscoped", Authenticate("", log, WithKeyRing(keys)), func(c *fiber.Ctx) error {
+		return c.SendStatus(fiber.StatusNoContent)
+	})
+
+	tests := []struct {
+		path, key  string
+		wantStatus int
+		wantCode   string
+	}{
+		{"/v1/idempotency/stats", "admin-key", http.StatusOK, ""},
+		{"/v1/idempotency/stats", "send-key", http.StatusForbidden, "forbidden"},
+		{"/v1/idempotency/stats", "old-key", http.StatusUnauthorized, "unauthorized"},
+		{"/v1/idempotency/stats", "", http.StatusUnauthorized, "unauthorized"},
+		{"/v1/idempotency/stats", "nope", http.StatusUnauthorized, "unauthorized"},
+		{"/v1/jobs/x", "send-key", http.StatusNotFound, "not_found"},
+		{"/v1/jobs/x", "admin-key", http.StatusForbidden, "forbidden"},
+		{"/v1/unscoped", "admin-key", http.StatusForbidden, "forbidden"},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodGet, tt.path, nil)
+		if tt.key != "" {
+			req.Header.Set("X-API-Key", tt.key)
+		}
+		resp, err := app.Test(req)
+		if err != nil {
+			t.Fatalf("app.Test: %v", err)
+		}
+		var out struct {
+			ErrorCode string `json:"error_code"`
+		}
+		_ = json.NewDecoder(resp.Body).Decode(&out)
+		_ = resp.Body.Close()
+		if resp.StatusCode != tt.wantStatus || out.ErrorCode != tt.wantCode {
+			t.Errorf("%s with %q = %d %q, want %d %q", tt.path, tt.key, resp.StatusCode, out.ErrorCode, tt.wantStatus, tt.wantCode)
+		}
+	}
+}
+
+func TestAuthenticate_LegacyAPIKeyWithoutKeyRing(t *testing.T) {
+	prev := config.APIKey
+	config.APIKey = "shared"
+	defer func() { config.APIKey = prev }()
+
+	var caller string
+	log := logger.New(logger.Config{Level: logger.ErrorLevel})
+	app := fiber.New()
+	app.Post("/v1/resolve", Authenticate(auth.ScopeResolve, log), func(c *fiber.Ctx) error {
+		caller = callerName(c)
+		return c.SendStatus(fiber.StatusNoContent)
+	})
+	send := func(key string) int {
+		req := httptest.NewRequest(http.MethodPost, "/v1/resolve", bytes.NewBufferString(`{}`))
+		req.Header.Set("X-API-Key", key)
+		resp, err := app.Test(req)
+		if err != nil {
+			t.Fatalf("app.Test: %v", err)
+		}
+		_ = resp.Body.Close()
+		return resp.StatusCode
+	}
+	if status := send("wrong"); status != http.StatusUnauthorized {
+		t.Errorf("wrong key = %d, want 401", status)
+	}
+	if status := send("shared"); status != http.StatusNoContent || caller != auth.LegacyKeyName {
+		t.Errorf("API_KEY = %d caller %q, want 204 %q", status, caller, auth.LegacyKeyName)
+	}
+}
+
+func TestAuthenticate_Signatures(t *testing.T) {
+	keys, err := auth.NewKeyRing("", auth.Key{Name: "herald-prod", Key: "s3cret", Scopes: []auth.Scope{auth.ScopeSend}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	verifier := auth.NewVerifier(keys, auth.NewMemoryNonceStore(), time.Minute)
+	log := logger.New(logger.Config{Level: logger.ErrorLevel})
+	handler := func(opts ...Option) *fiber.App {
+		app := fiber.New()
+		app.Post("/v1/send", Authenticate(auth.ScopeSend, log, opts...), func(c *fiber.Ctx) error {
+			return c.SendString(callerName(c))
+		})
+		app.Get("/v1/idempotency/stats", Authenticate(auth.ScopeAdmin, log, opts...), func(c *fiber.Ctx) error {
+			return c.SendString(callerName(c))
+		})
+		return app
+	}
+	optional := handler(WithKeyRing(keys), WithSignatures(verifier, false))
+	required := handler(WithKeyRing(keys), WithSignatures(verifier, true))
+
+	do := func(app *fiber.App, body string, header map[string]string) (int, string) {
+		req := httptest.NewRequest(http.MethodPost, "/v1/send", bytes.NewBufferString(body))
+		for k, v := range header {
+			req.Header.Set(k, v)
+		}
+		resp, err := app.Test(req)
+		if err != nil {
+			t.Fatalf("app.Test: %v", err)
+		}
+		defer func() { _ = resp.Body.Close() }()
+		var buf bytes.Buffer
+		_, _ = buf.ReadFrom(resp.Body)
+		return resp.StatusCode, buf.String()
+	}
+	sign := func(nonce, body string) map[string]string {
+		ts := strconv.FormatInt(time.Now().Unix(), 10)
+		return map[string]string{
+			auth.HeaderKeyID:     "herald-prod",
+			auth.HeaderTimestamp: ts,
+			auth.HeaderNonce:     nonce,
+			auth.HeaderSignature: auth.Sign([]byte("s3cret"), http.MethodPost, "/v1/send", ts, nonce, []byte(body)),
+		}
+	}
+
+	h := sign("n1", `{"to":"u1"}`)
+	if status, caller := do(optional, `{"to":"u1"}`, h); status != http.StatusOK || caller != "herald-prod" {
+		t.Errorf("signed request = %d %q, want 200 herald-prod", status, caller)
+	}
+	if status, body := do(optional, `{"to":"u1"}`, h); status != http.StatusUnauthorized || !strings.Contains(body, "nonce") {
+		t.Errorf("replayed request = %d %s, want 401 nonce reuse", status, body)
+	}
+	if status, _ := do(optional, `{"to":"u2"}`, sign("n2", `{"to":"u1"}`)); status != http.StatusUnauthorized {
+		t.Errorf("body changed after signing = %d, want 401", status)
+	}
+	if status, _ := do(optional, `{}`, map[string]string{"X-API-Key": "s3cret"}); status != http.StatusOK {
+		t.Errorf("optional mode with X-API-Key = %d, want 200", status)
+	}
+	if status, body := do(required, `{}`, map[string]string{"X-API-Key": "s3cret"}); status != http.StatusUnauthorized || !strings.Contains(body, auth.HeaderSignature) {
+		t.Errorf("required mode with X-API-Key only = %d %s, want 401 naming the signature headers", status, body)
+	}
+	if status, _ := do(required, `{}`, sign("n3", `{}`)); status != http.StatusOK {
+		t.Errorf("required mode signed = %d, want 200", status)
+	}
+	// Required signing covers the send and resolve scopes only: admin endpoints still take X-API-Key
+	// (this key lacks the admin scope, so the key itself was checked).
+	req := httptest.NewRequest(http.MethodGet, "/v1/idempotency/stats", nil)
+	req.Header.Set("X-API-Key", "s3cret")
+	resp, err := required.Test(req)
+	if err != nil {
+		t.Fatalf("app.Test: %v", err)
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusForbidden {
+		t.Errorf("required mode, admin endpoint with X-API-Key = %d, want 403", resp.StatusCode)
+	}
+}
+
+// selfSignedCert returns a certificate for cn usable as TLS server, client and its own CA.
+func selfSignedCert(t *testing.T, cn string) (tls.Certificate, *x509.Certificate) {
+	t.Helper()
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: cn},
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, _ := x509.ParseCertificate(der)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}, leaf
+}
+
+func TestAuthenticate_ClientCertificate(t *testing.T) {
+	cert, ca := selfSignedCert(t, "herald.internal")
+	pool := x509.NewCertPool()
+	pool.AddCert(ca)
+	keys, err := auth.NewKeyRing("", auth.Key{Name: "herald-prod", ClientCertCN: "herald.internal", Scopes: []auth.Scope{auth.ScopeSend}},
+		auth.Key{Name: "ops", Key: "ops-secret", Scopes: auth.AllScopes})
+	if err != nil {
+		t.Fatal(err)
+	}
+	log := logger.New(logger.Config{Level: logger.ErrorLevel})
+	app := fiber.New(fiber.Config{DisableStartupMessage: true})
+	caller := func(c *fiber.Ctx) error { return c.SendString(callerName(c)) }
+	app.Get("/send", Authenticate(auth.ScopeSend, log, WithKeyRing(keys)), caller)
+	app.Get("/admin", Authenticate(auth.ScopeAdmin, log, WithKeyRing(keys)), caller)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		_ = app.Listener(tls.NewListener(ln, &tls.Config{
+			Certificates: []tls.Certificate{cert},
+			ClientCAs:    pool,
+			ClientAuth:   tls.VerifyClientCertIfGiven,
+		}))
+	}()
+	t.Cleanup(func() { _ = app.Shutdown() })
+
+	get := func(path, apiKey string, certs []tls.Certificate) (int, string) {
+		client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool, Certificates: certs}}}
+		defer client.CloseIdleConnections()
+		req, _ := http.NewRequest(http.MethodGet, "https://"+ln.Addr().String()+path, nil)
+		if apiKey != "" {
+			req.Header.Set("X-API-Key", apiKey)
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatalf("GET %s: %v", path, err)
+		}
+		defer func() { _ = resp.Body.Close() }()
+		var buf bytes.Buffer
+		_, _ = buf.ReadFrom(resp.Body)
+		return resp.StatusCode, buf.String()
+	}
+	certs := []tls.Certificate{cert}
+	if status, caller := get("/send", "", certs); status != http.StatusOK || caller != "herald-prod" {
+		t.Errorf("client certificate = %d %q, want 200 herald-prod", status, caller)
+	}
+	if status, _ := get("/admin", "ops-secret", certs); status != http.StatusForbidden {
+		t.Errorf("certificate identity lacking scope = %d, want 403 (the certificate decides, not X-API-Key)", status)
+	}
+	if status, caller := get("/admin", "ops-secret", nil); status != http.StatusOK || caller != "ops" {
+		t.Errorf("no certificate, X-API-Key = %d %q, want 200 ops", status, caller)
+	}
+	if status, _ := get("/send", "", nil); status != http.StatusUnauthorized {
+		t.Errorf("no certificate, no key = %d, want 401", status)
+	}
+}
+
+func TestAuthenticate_BearerJWT(t *testing.T) {
+	pub, priv, _ := ed25519.GenerateKey(nil)
+	b64 := base64.RawURLEncoding
+	jwks := filepath.Join(t.TempDir(), "jwks.json")
+	raw, _ := json.Marshal(map[string]any{"keys": []map[string]string{{"kty": "OKP", "crv": "Ed25519", "kid": "k1", "x": b64.EncodeToString(pub)}}})
+	if err := os.WriteFile(jwks, raw, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	verifier, err := auth.NewJWTVerifier(auth.JWTConfig{JWKSFile: jwks, Issuer: "https://id.example.com", Audience: "herald-dingtalk"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	token := func(scope string, exp time.Time) string {
+		header := b64.EncodeToString([]byte(`{"alg":"EdDSA","kid":"k1"}`))
+		claims, _ := json.Marshal(map[string]any{"iss": "https://id.example.com", "aud": "herald-dingtalk", "sub": "notifier", "scope": scope, "exp": exp.Unix()})
+		signed := header + "." + b64.EncodeToString(claims)
+		return signed + "." + b64.EncodeToString(ed25519.Sign(priv, []byte(signed)))
+	}
+	keys, _ := auth.NewKeyRing("", auth.Key{Name: "ops", Key: "ops-secret", Scopes: auth.AllScopes})
+	log := logger.New(logger.Config{Level: logger.ErrorLevel})
+	app := func(opts ...Option) *fiber.App {
+		a := fiber.New()
+		a.Post("/v1/send", Authenticate(auth.ScopeSend, log, opts...), func(c *fiber.Ctx) error {
+			return c.SendString(callerName(c))
+		})
+		return a
+	}
+	withKeys := app(WithKeyRing(keys), WithJWT(verifier))
+	noKeys, _ := auth.NewKeyRing("")
+	jwtOnly := app(WithKeyRing(noKeys), WithJWT(verifier))
+
+	tests := []struct {
+		name       string
+		app        *fiber.App
+		header     map[string]string
+		wantStatus int
+		wantBody   string
+	}{
+		{"valid token", withKeys, map[string]string{"Authorization": "Bearer " + token("send", time.Now().Add(time.Minute))}, http.StatusOK, "notifier"},
+		{"token without scope", withKeys, map[string]string{"Authorization": "Bearer " + token("resolve", time.Now().Add(time.Minute))}, http.StatusForbidden, "forbidden"},
+		{"expired token", withKeys, map[string]string{"Authorization": "Bearer " + token("send", time.Now().Add(-time.Hour))}, http.StatusUnauthorized, "expired"},
+		{"bad token beats valid key", withKeys, map[string]string{"Authorization": "Bearer x.y.z", "X-API-Key": "ops-secret"}, http.StatusUnauthorized, "invalid bearer token"},
+		{"API key still works", withKeys, map[string]string{"X-API-Key": "ops-secret"}, http.StatusOK, "ops"},
+		{"jwt only, valid token", jwtOnly, map[string]string{"Authorization": "Bearer " + token("send", time.Now().Add(time.Minute))}, http.StatusOK, "notifier"},
+		{"jwt only, anonymous", jwtOnly, nil, http.StatusUnauthorized, "unauthorized"},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodPost, "/v1/send", nil)
+		for k, v := range tt.header {
+			req.Header.Set(k, v)
+		}
+		resp, err := tt.app.Test(req)
+		if err != nil {
+			t.Fatalf("app.Test: %v", err)
+		}
+		var buf bytes.Buffer
+		_, _ = buf.ReadFrom(resp.Body)
+		_ = resp.Body.Close()
+		if resp.StatusCode != tt.wantStatus || !strings.Contains(buf.String(), tt.wantBody) {
+			t.Errorf("%s = %d %s, want %d containing %q", tt.name, resp.StatusCode, buf.String(), tt.wantStatus, tt.wantBody)
+		}
+	}
+}
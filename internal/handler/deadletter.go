@@ -0,0 +1,123 @@
+package handler
+
+import (
+	"errors"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/soulteary/herald-dingtalk/internal/queue"
+	"github.com/soulteary/herald-dingtalk/internal/redact"
+	"github.com/soulteary/logger-kit"
+)
+
+// DeadLetterSummary is a dead letter as listed: enough to pick one to inspect, replay or purge,
+// without the message (it may carry a verification code) or the raw recipient.
+type DeadLetterSummary struct {
+	ID        string    `json:"id"`
+	Caller    string    `json:"caller,omitempty"`
+	ToHash    string    `json:"to_hash"`
+	Attempts  int       `json:"attempts"`
+	LastError string    `json:"last_error,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// DeadLettersHandler handles GET /v1/admin/dead-letters: async jobs that failed permanently
+// or exhausted their retries, most recent first.
+func DeadLettersHandler(c *fiber.Ctx, log *logger.Logger, opts ...Option) error {
+	o := newOptions(opts)
+	dead := []DeadLetterSummary{}
+	if q := o.queue; q != nil {
+		for _, job := range q.DeadLetters() {
+			dead = append(dead, DeadLetterSummary{
+				ID:        job.ID,
+				Caller:    job.Caller,
+				ToHash:    redact.Hash(job.Request.To),
+				Attempts:  job.Attempts,
+				LastError: job.LastError,
+				CreatedAt: job.CreatedAt,
+				UpdatedAt: job.UpdatedAt,
+			})
+		}
+	}
+	return c.JSON(fiber.Map{"ok": true, "dead_letters": dead})
+}
+
+// DeadLetterHandler handles GET /v1/admin/dead-letters/:id: the original request, resolved
+// userid, final error and attempt history of one dead letter.
+func DeadLetterHandler(c *fiber.Ctx, log *logger.Logger, opts ...Option) error {
+	o := newOptions(opts)
+	var (
+		job queue.Job
+		ok  bool
+	)
+	if q := o.queue; q != nil {
+		job, ok = q.Get(c.Params("id"))
+	}
+	if !ok || job.State != queue.StateFailed {
+		return deadLetterError(c, queue.ErrNotFound)
+	}
+	return c.JSON(fiber.Map{"ok": true, "dead_letter": job})
+}
+
+// ReplayDeadLetterHandler handles POST /v1/admin/dead-letters/:id/replay: re-queues the job
+// with a fresh attempt budget.
+func ReplayDeadLetterHandler(c *fiber.Ctx, log *logger.Logger, opts ...Option) error {
+	o := newOptions(opts)
+	q := o.queue
+	if q == nil {
+		return deadLetterError(c, queue.ErrNotFound)
+	}
+	job, err := q.Replay(c.Params("id"))
+	if err != nil {
+		return deadLetterError(c, err)
+	}
+	log.Info().Str("caller", callerName(c)).Str("job_id", job.ID).Str("to", logTo(job.Request.To)).Msg("dead letter replayed")
+	return c.Status(fiber.StatusAccepted).JSON(fiber.Map{"ok": true, "job": jobStatus(job)})
+}
+
+// PurgeDeadLettersHandler handles DELETE /v1/admin/dead-letters/:id (one) and
+// DELETE /v1/admin/dead-letters (all).
+func PurgeDeadLettersHandler(c *fiber.Ctx, log *logger.Logger, opts ...Option) error {
+	o := newOptions(opts)
+	q := o.queue
+	id := c.Params("id")
+	if q == nil {
+		if id != "" {
+			return deadLetterError(c, queue.ErrNotFound)
+		}
+		return c.JSON(fiber.Map{"ok": true, "purged": 0})
+	}
+	if id != "" {
+		if err := q.Purge(id); err != nil {
+			return deadLetterError(c, err)
+		}
+		log.Info().Str("caller", callerName(c)).Str("job_id", id).Msg("dead letter purged")
+		return c.JSON(fiber.Map{"ok": true, "purged": 1})
+	}
+	n, err := q.PurgeDeadLetters()
+	if err != nil {
+		log.Error().Err(err).Msg("dead letter purge failed")
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"ok": false, "error_code": "queue_failed", "error_message": err.Error(),
+		})
+	}
+	log.Info().Str("caller", callerName(c)).Int("purged", n).Msg("dead letters purged")
+	return c.JSON(fiber.Map{"ok": true, "purged": n})
+}
+
+func deadLetterError(c *fiber.Ctx, err error) error {
+	switch {
+	case errors.Is(err, queue.ErrNotFound):
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"ok": false, "error_code": "not_found", "error_message": "dead letter not found",
+		})
+	case errors.Is(err, queue.ErrNotDead):
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+			"ok": false, "error_code": "not_dead_letter", "error_message": err.Error(),
+		})
+	}
+	return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+		"ok": false, "error_code": "queue_failed", "error_message": err.Error(),
+	})
+}
@@ -0,0 +1,133 @@
+package handler
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/soulteary/herald-dingtalk/internal/dingtalk"
+	"github.com/soulteary/herald-dingtalk/internal/idempotency"
+	"github.com/soulteary/herald-dingtalk/internal/queue"
+	"github.com/soulteary/herald-dingtalk/internal/redact"
+	"github.com/soulteary/logger-kit"
+)
+
+func TestDeadLetterEndpoints(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if r.URL.Path == "/gettoken" {
+			_ = json.NewEncoder(w).Encode(map[string]any{"errcode": 0, "access_token": "tok", "expires_in": 7200})
+			return
+		}
+		_ = json.NewEncoder(w).Encode(map[string]any{"errcode": 60020, "errmsg": "访问ip不在白名单之中"})
+	}))
+	defer server.Close()
+
+	client := dingtalk.NewClientWithHTTP("k", "s", "1", &http.Client{Transport: &redirectTransport{base: server}})
+	log := logger.New(logger.Config{Level: logger.ErrorLevel})
+	q, err := queue.Open(filepath.Join(t.TempDir(), "queue.wal"), queue.Options{})
+	if err != nil {
+		t.Fatalf("queue.Open: %v", err)
+	}
+	defer func() { _ = q.Close() }()
+	q.Start(DeliverJob(client, log))
+	opt := WithQueue(q)
+	app := fiber.New()
+	app.Post("/v1/send", func(c *fiber.Ctx) error { return SendHandler(c, client, idempotency.NewStore(300), log, opt) })
+	app.Get("/v1/admin/dead-letters", func(c *fiber.Ctx) error { return DeadLettersHandler(c, log, opt) })
+	app.Get("/v1/admin/dead-letters/:id", func(c *fiber.Ctx) error { return DeadLetterHandler(c, log, opt) })
+	app.Post("/v1/admin/dead-letters/:id/replay", func(c *fiber.Ctx) error { return ReplayDeadLetterHandler(c, log, opt) })
+	app.Delete("/v1/admin/dead-letters/:id?", func(c *fiber.Ctx) error { return PurgeDeadLettersHandler(c, log, opt) })
+
+	do := func(method, path string, out any) int {
+		t.Helper()
+		var body *bytes.Buffer
+		if method == http.MethodPost && path == "/v1/send" {
+			body = bytes.NewBufferString(`{"to":"u1","body":"hi","params":{"mode":"async"}}`)
+		} else {
+			body = &bytes.Buffer{}
+		}
+		req := httptest.NewRequest(method, path, body)
+		req.Header.Set("Content-Type", "application/json")
+		resp, err := app.Test(req)
+		if err != nil {
+			t.Fatalf("app.Test: %v", err)
+		}
+		defer func() { _ = resp.Body.Close() }()
+		if out != nil {
+			_ = json.NewDecoder(resp.Body).Decode(out)
+		}
+		return resp.StatusCode
+	}
+
+	var accepted struct {
+		JobID string `json:"job_id"`
+	}
+	if status := do(http.MethodPost, "/v1/send", &accepted); status != http.StatusAccepted {
+		t.Fatalf("send status = %d", status)
+	}
+	var list struct {
+		DeadLetters []DeadLetterSummary `json:"dead_letters"`
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) && len(list.DeadLetters) == 0 {
+		time.Sleep(10 * time.Millisecond)
+		do(http.MethodGet, "/v1/admin/dead-letters", &list)
+	}
+	if len(list.DeadLetters) != 1 || list.DeadLetters[0].ID != accepted.JobID {
+		t.Fatalf("dead letters = %+v", list.DeadLetters)
+	}
+	if got := list.DeadLetters[0]; got.ToHash != redact.Hash("u1") || got.LastError == "" || got.Attempts != 1 {
+		t.Errorf("dead letter summary = %+v", got)
+	}
+	raw := httptest.NewRequest(http.MethodGet, "/v1/admin/dead-letters", nil)
+	if resp, err := app.Test(raw); err == nil {
+		body, _ := io.ReadAll(resp.Body)
+		_ = resp.Body.Close()
+		if strings.Contains(string(body), `"hi"`) || strings.Contains(string(body), `"u1"`) {
+			t.Errorf("dead letter list exposes the message or recipient: %s", body)
+		}
+	}
+
+	var one struct {
+		DeadLetter queue.Job `json:"dead_letter"`
+	}
+	if status := do(http.MethodGet, "/v1/admin/dead-letters/"+accepted.JobID, &one); status != http.StatusOK {
+		t.Fatalf("get status = %d", status)
+	}
+	dl := one.DeadLetter
+	if dl.Request.Body != "hi" || dl.UserID != "u1" || len(dl.History) != 1 || dl.LastError == "" {
+		t.Errorf("dead letter = %+v", dl)
+	}
+
+	if status := do(http.MethodPost, "/v1/admin/dead-letters/"+accepted.JobID+"/replay", nil); status != http.StatusAccepted {
+		t.Errorf("replay status = %d, want 202", status)
+	}
+	if status := do(http.MethodPost, "/v1/admin/dead-letters/unknown/replay", nil); status != http.StatusNotFound {
+		t.Errorf("replay unknown status = %d, want 404", status)
+	}
+	// The replayed job fails again (same permanent error) and becomes a dead letter once more.
+	deadline = time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		if job, _ := q.Get(accepted.JobID); job.State == queue.StateFailed && len(job.History) == 2 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	var purged struct {
+		Purged int `json:"purged"`
+	}
+	if status := do(http.MethodDelete, "/v1/admin/dead-letters", &purged); status != http.StatusOK || purged.Purged != 1 {
+		t.Errorf("purge all = %d, %+v; want 200 with 1 purged", status, purged)
+	}
+	if status := do(http.MethodDelete, "/v1/admin/dead-letters/"+accepted.JobID, nil); status != http.StatusNotFound {
+		t.Errorf("purge purged = %d, want 404", status)
+	}
+}
@@ -0,0 +1,20 @@
+package handler
+
+import (
+	"github.com/gofiber/fiber/v2"
+	"github.com/soulteary/herald-dingtalk/internal/dingtalk"
+)
+
+// HealthHandler handles GET /healthz when DingTalk is configured. It keeps the health-kit
+// body ({"status","service"}) and adds the circuit breaker so Herald can route around an
+// outage: status is "degraded" while the breaker is open or half-open.
+func HealthHandler(c *fiber.Ctx, dingtalkClient *dingtalk.Client) error {
+	body := fiber.Map{"status": "healthy", "service": "herald-dingtalk"}
+	if stats, ok := dingtalkClient.BreakerStats(); ok {
+		body["circuit_breaker"] = stats
+		if stats.State != dingtalk.BreakerClosed {
+			body["status"] = "degraded"
+		}
+	}
+	return c.JSON(body)
+}
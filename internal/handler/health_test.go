@@ -0,0 +1,48 @@
+package handler
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/soulteary/herald-dingtalk/internal/dingtalk"
+)
+
+func TestHealthHandler_ReportsBreaker(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer server.Close()
+
+	client := dingtalk.NewClientWithHTTP("k", "s", "1", &http.Client{Transport: &redirectTransport{base: server}})
+	client.SetRetryPolicy(dingtalk.RetryPolicy{MaxAttempts: 1})
+	client.SetBreaker(1, time.Minute)
+	app := fiber.New()
+	app.Get("/healthz", func(c *fiber.Ctx) error { return HealthHandler(c, client) })
+
+	get := func() map[string]any {
+		resp, err := app.Test(httptest.NewRequest(http.MethodGet, "/healthz", nil))
+		if err != nil {
+			t.Fatalf("app.Test: %v", err)
+		}
+		defer func() { _ = resp.Body.Close() }()
+		if resp.StatusCode != http.StatusOK {
+			t.Errorf("status = %d, want 200", resp.StatusCode)
+		}
+		var body map[string]any
+		_ = json.NewDecoder(resp.Body).Decode(&body)
+		return body
+	}
+	if body := get(); body["status"] != "healthy" || body["service"] != "herald-dingtalk" {
+		t.Errorf("closed breaker body = %v", body)
+	}
+	_, _ = client.SendWorkNotify(t.Context(), "u1", "hi")
+	body := get()
+	cb, _ := body["circuit_breaker"].(map[string]any)
+	if body["status"] != "degraded" || cb["state"] != dingtalk.BreakerOpen {
+		t.Errorf("open breaker body = %v", body)
+	}
+}
@@ -0,0 +1,182 @@
+package handler
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/soulteary/herald-dingtalk/internal/dingtalk"
+	"github.com/soulteary/herald-dingtalk/internal/idempotency"
+	"github.com/soulteary/herald-dingtalk/internal/queue"
+	"github.com/soulteary/herald-dingtalk/internal/quota"
+	"github.com/soulteary/logger-kit"
+	"github.com/soulteary/provider-kit"
+)
+
+// modeAsync is the params.mode value that queues a send instead of delivering it inline.
+const modeAsync = "async"
+
+// asyncSendResponse is the 202 body of an async or scheduled send.
+type asyncSendResponse struct {
+	provider.HTTPSendResponse
+	JobID  string      `json:"job_id"`
+	State  queue.State `json:"state"`
+	SendAt *time.Time  `json:"send_at,omitempty"`
+}
+
+// JobStatus is the public view of a queued job (the request itself is not echoed back).
+type JobStatus struct {
+	ID        string      `json:"id"`
+	State     queue.State `json:"state"`
+	Attempts  int         `json:"attempts"`
+	MessageID string      `json:"message_id,omitempty"`
+	LastError string      `json:"last_error,omitempty"`
+	CreatedAt time.Time   `json:"created_at"`
+	UpdatedAt time.Time   `json:"updated_at"`
+	NotBefore time.Time   `json:"not_before"`
+	ExpiresAt time.Time   `json:"expires_at,omitzero"`
+}
+
+func jobStatus(job queue.Job) JobStatus {
+	return JobStatus{
+		ID:        job.ID,
+		State:     job.State,
+		Attempts:  job.Attempts,
+		MessageID: job.MessageID,
+		LastError: job.LastError,
+		CreatedAt: job.CreatedAt,
+		UpdatedAt: job.UpdatedAt,
+		NotBefore: job.NotBefore,
+		ExpiresAt: job.ExpiresAt,
+	}
+}
+
+// enqueueSend persists req in the async queue, due at sendAt (zero = now) and dropped after
+// expires (zero = never), and answers 202 with the job id.
+func enqueueSend(c *fiber.Ctx, q *queue.Queue, idemStore *idempotency.Store, req provider.HTTPSendRequest, sendAt, expires time.Time, log *logger.Logger) error {
+	if q == nil {
+		log.Warn().Str("to", logTo(req.To)).Msg("send invalid_request: async mode is not enabled")
+		if req.IdempotencyKey != "" {
+			idemStore.Release(req.IdempotencyKey)
+		}
+		return c.Status(fiber.StatusBadRequest).JSON(provider.HTTPSendResponse{
+			OK: false, ErrorCode: "invalid_request", ErrorMessage: "async and scheduled sends are not enabled (QUEUE_FILE is not set)",
+		})
+	}
+	job, err := q.Enqueue(req, callerName(c), sendAt, expires)
+	if err != nil {
+		log.Error().Str("caller", callerName(c)).Err(err).Str("to", logTo(req.To)).Msg("send queue_failed: cannot persist job")
+		return finishUnsent(c, idemStore, req.IdempotencyKey, fiber.StatusInternalServerError, provider.HTTPSendResponse{
+			OK: false, ErrorCode: "queue_failed", ErrorMessage: err.Error(),
+		})
+	}
+	resp := asyncSendResponse{
+		HTTPSendResponse: provider.HTTPSendResponse{OK: true, Provider: "dingtalk"},
+		JobID:            job.ID,
+		State:            job.State,
+	}
+	if !sendAt.IsZero() {
+		resp.SendAt = &job.NotBefore
+	}
+	log.Info().Str("caller", callerName(c)).Str("to", logTo(req.To)).Str("job_id", job.ID).Time("send_at", job.NotBefore).Msg("send queued")
+	return finishSendBody(c, idemStore, req.IdempotencyKey, fiber.StatusAccepted, true, "", resp, false)
+}
+
+// CancelScheduledHandler handles DELETE /v1/scheduled/:key: cancels the caller's queued sends with
+// the given idempotency key that have not started yet.
+func CancelScheduledHandler(c *fiber.Ctx, log *logger.Logger, opts ...Option) error {
+	o := newOptions(opts)
+	var jobs []queue.Job
+	err := queue.ErrNotFound
+	if q := o.queue; q != nil {
+		jobs, err = q.Cancel(c.Params("key"), callerName(c))
+	}
+	switch {
+	case errors.Is(err, queue.ErrNotFound):
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"ok": false, "error_code": "not_found", "error_message": "no queued send with this idempotency key",
+		})
+	case errors.Is(err, queue.ErrNotPending):
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+			"ok": false, "error_code": "not_cancelable", "error_message": err.Error(),
+		})
+	}
+	statuses := make([]JobStatus, 0, len(jobs))
+	for _, job := range jobs {
+		statuses = append(statuses, jobStatus(job))
+		log.Info().Str("caller", callerName(c)).Str("job_id", job.ID).Str("to", logTo(job.Request.To)).Msg("scheduled send canceled")
+	}
+	return c.JSON(fiber.Map{"ok": true, "canceled": statuses})
+}
+
+// DeliverJob returns the queue worker that delivers a queued send via SendWorkNotify.
+// Errors a retry cannot fix (unknown userid, invalid content, ...) fail the job immediately;
+// a job whose expiry passes mid-delivery is dropped as expired.
+func DeliverJob(dingtalkClient *dingtalk.Client, log *logger.Logger, opts ...Option) queue.DeliverFunc {
+	o := newOptions(opts)
+	return func(ctx context.Context, job queue.Job) (queue.Delivery, error) {
+		var d queue.Delivery
+		ctx = dingtalk.WithExpiry(ctx, job.ExpiresAt)
+		destUserID, err := resolveUserID(ctx, dingtalkClient, job.Request.To)
+		if err != nil {
+			return d, jobFailed(log, job, err)
+		}
+		d.UserID = destUserID
+		content := messageContent(job.Request)
+		if o.quota != nil {
+			if retryAfter, err := o.quota.Reserve(destUserID, content, time.Now()); err != nil {
+				log.Warn().Err(err).Str("job_id", job.ID).Str("to", logTo(destUserID)).Dur("retry_after", retryAfter).Msg("job rate_limited: DingTalk quota")
+				if errors.Is(err, quota.ErrDuplicate) {
+					return d, queue.Permanent(err)
+				}
+				return d, queue.RetryAfter(err, retryAfter)
+			}
+		}
+		d.MessageID, err = dingtalkClient.SendWorkNotify(ctx, destUserID, content)
+		if err != nil {
+			if o.quota != nil {
+				o.quota.Cancel(destUserID, content, time.Now())
+			}
+			return d, jobFailed(log, job, err)
+		}
+		log.Info().Str("job_id", job.ID).Str("to", logTo(job.Request.To)).Str("message_id", d.MessageID).Int("attempt", job.Attempts).Msg("job delivered")
+		return d, nil
+	}
+}
+
+// jobFailed logs a failed delivery and marks errors a retry cannot fix as permanent. A call the
+// outbound limiter could not fit in is retried once a slot frees up; one it could not fit in
+// before the job's expiry ends the job as expired.
+func jobFailed(log *logger.Logger, job queue.Job, err error) error {
+	log.Warn().Err(err).Str("job_id", job.ID).Str("to", logTo(job.Request.To)).Int("attempt", job.Attempts).Msg("job delivery failed")
+	if errors.Is(err, dingtalk.ErrExpired) {
+		return queue.Expired(err)
+	}
+	if !dingtalk.IsRetryable(err) {
+		return queue.Permanent(err)
+	}
+	if retryAfter, ok := outboundLimited(err); ok {
+		return queue.RetryAfter(err, retryAfter)
+	}
+	return err
+}
+
+// JobHandler handles GET /v1/jobs/:id: state of an async send queued by the caller. Other callers'
+// jobs are reported as not found, like in CancelScheduledHandler.
+func JobHandler(c *fiber.Ctx, log *logger.Logger, opts ...Option) error {
+	o := newOptions(opts)
+	var (
+		job queue.Job
+		ok  bool
+	)
+	if o.queue != nil {
+		job, ok = o.queue.Get(c.Params("id"))
+	}
+	if !ok || job.Caller != callerName(c) {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"ok": false, "error_code": "not_found", "error_message": "job not found",
+		})
+	}
+	return c.JSON(fiber.Map{"ok": true, "job": jobStatus(job)})
+}
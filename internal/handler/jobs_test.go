@@ -0,0 +1,265 @@
+package handler
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/soulteary/herald-dingtalk/internal/auth"
+	"github.com/soulteary/herald-dingtalk/internal/dingtalk"
+	"github.com/soulteary/herald-dingtalk/internal/idempotency"
+	"github.com/soulteary/herald-dingtalk/internal/queue"
+	"github.com/soulteary/logger-kit"
+)
+
+func TestSendHandler_AsyncModeQueuesAndDelivers(t *testing.T) {
+	var sends int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if r.URL.Path == "/gettoken" {
+			_ = json.NewEncoder(w).Encode(map[string]any{"errcode": 0, "access_token": "tok", "expires_in": 7200})
+			return
+		}
+		atomic.AddInt32(&sends, 1)
+		_ = json.NewEncoder(w).Encode(map[string]any{"errcode": 0, "task_id": 555})
+	}))
+	defer server.Close()
+
+	client := dingtalk.NewClientWithHTTP("k", "s", "1", &http.Client{Transport: &redirectTransport{base: server}})
+	log := logger.New(logger.Config{Level: logger.ErrorLevel})
+	q, err := queue.Open(filepath.Join(t.TempDir(), "queue.wal"), queue.Options{})
+	if err != nil {
+		t.Fatalf("queue.Open: %v", err)
+	}
+	defer func() { _ = q.Close() }()
+	q.Start(DeliverJob(client, log))
+	idemStore := idempotency.NewStore(300)
+	app := fiber.New()
+	app.Post("/v1/send", func(c *fiber.Ctx) error { return SendHandler(c, client, idemStore, log, WithQueue(q)) })
+	app.Get("/v1/jobs/:id", func(c *fiber.Ctx) error { return JobHandler(c, log, WithQueue(q)) })
+
+	req := httptest.NewRequest(http.MethodPost, "/v1/send", bytes.NewBufferString(`{"to":"u1","body":"hi","params":{"mode":"async"}}`))
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := app.Test(req)
+	if err != nil {
+		t.Fatalf("app.Test: %v", err)
+	}
+	if resp.StatusCode != http.StatusAccepted {
+		t.Fatalf("status = %d, want 202", resp.StatusCode)
+	}
+	var accepted struct {
+		OK    bool   `json:"ok"`
+		JobID string `json:"job_id"`
+	}
+	_ = json.NewDecoder(resp.Body).Decode(&accepted)
+	_ = resp.Body.Close()
+	if !accepted.OK || accepted.JobID == "" {
+		t.Fatalf("accepted = %+v", accepted)
+	}
+
+	var status struct {
+		Job JobStatus `json:"job"`
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) && status.Job.State != queue.StateSucceeded {
+		time.Sleep(10 * time.Millisecond)
+		resp, err := app.Test(httptest.NewRequest(http.MethodGet, "/v1/jobs/"+accepted.JobID, nil))
+		if err != nil {
+			t.Fatalf("app.Test: %v", err)
+		}
+		_ = json.NewDecoder(resp.Body).Decode(&status)
+		_ = resp.Body.Close()
+	}
+	if status.Job.State != queue.StateSucceeded || status.Job.MessageID != "555" {
+		t.Errorf("job = %+v, want succeeded with message_id 555", status.Job)
+	}
+	if got := atomic.LoadInt32(&sends); got != 1 {
+		t.Errorf("asyncsend_v2 calls = %d, want 1", got)
+	}
+
+	resp, _ = app.Test(httptest.NewRequest(http.MethodGet, "/v1/jobs/unknown", nil))
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("unknown job status = %d, want 404", resp.StatusCode)
+	}
+}
+
+func TestSendHandler_AsyncModeDisabled(t *testing.T) {
+	client := dingtalk.NewClient("k", "s", "1")
+	log := logger.New(logger.Config{Level: logger.ErrorLevel})
+	app := fiber.New()
+	app.Post("/v1/send", func(c *fiber.Ctx) error { return SendHandler(c, client, idempotency.NewStore(300), log) })
+	req := httptest.NewRequest(http.MethodPost, "/v1/send", bytes.NewBufferString(`{"to":"u1","params":{"mode":"async"}}`))
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := app.Test(req)
+	if err != nil {
+		t.Fatalf("app.Test: %v", err)
+	}
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("status = %d, want 400", resp.StatusCode)
+	}
+}
+
+func TestSendHandler_ScheduledCancel(t *testing.T) {
+	client := dingtalk.NewClient("k", "s", "1")
+	log := logger.New(logger.Config{Level: logger.ErrorLevel})
+	q, err := queue.Open(filepath.Join(t.TempDir(), "queue.wal"), queue.Options{})
+	if err != nil {
+		t.Fatalf("queue.Open: %v", err)
+	}
+	defer func() { _ = q.Close() }()
+	app := fiber.New()
+	app.Post("/v1/send", func(c *fiber.Ctx) error {
+		return SendHandler(c, client, idempotency.NewStore(300), log, WithQueue(q))
+	})
+	app.Delete("/v1/scheduled/:key", func(c *fiber.Ctx) error { return CancelScheduledHandler(c, log, WithQueue(q)) })
+
+	req := httptest.NewRequest(http.MethodPost, "/v1/send", bytes.NewBufferString(`{"to":"u1","body":"expires in 10 minutes","params":{"delay":"1h"}}`))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Idempotency-Key", "reminder-1")
+	resp, err := app.Test(req)
+	if err != nil {
+		t.Fatalf("app.Test: %v", err)
+	}
+	var accepted struct {
+		JobID  string     `json:"job_id"`
+		SendAt *time.Time `json:"send_at"`
+	}
+	_ = json.NewDecoder(resp.Body).Decode(&accepted)
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusAccepted || accepted.SendAt == nil || time.Until(*accepted.SendAt) < 59*time.Minute {
+		t.Fatalf("schedule = %d %+v", resp.StatusCode, accepted)
+	}
+
+	resp, _ = app.Test(httptest.NewRequest(http.MethodDelete, "/v1/scheduled/reminder-1", nil))
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("cancel status = %d, want 200", resp.StatusCode)
+	}
+	if job, _ := q.Get(accepted.JobID); job.State != queue.StateCanceled {
+		t.Errorf("job state = %s, want canceled", job.State)
+	}
+	resp, _ = app.Test(httptest.NewRequest(http.MethodDelete, "/v1/scheduled/reminder-1", nil))
+	if resp.StatusCode != http.StatusConflict {
+		t.Errorf("second cancel status = %d, want 409", resp.StatusCode)
+	}
+	resp, _ = app.Test(httptest.NewRequest(http.MethodDelete, "/v1/scheduled/unknown", nil))
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("unknown cancel status = %d, want 404", resp.StatusCode)
+	}
+}
+
+func TestCancelScheduledHandler_OnlyOwnerCancels(t *testing.T) {
+	client := dingtalk.NewClient("k", "s", "1")
+	log := logger.New(logger.Config{Level: logger.ErrorLevel})
+	q, err := queue.Open(filepath.Join(t.TempDir(), "queue.wal"), queue.Options{})
+	if err != nil {
+		t.Fatalf("queue.Open: %v", err)
+	}
+	defer func() { _ = q.Close() }()
+	keys, err := auth.NewKeyRing("",
+		auth.Key{Name: "herald-prod", Key: "prod-key", Scopes: []auth.Scope{auth.ScopeSend}},
+		auth.Key{Name: "other-app", Key: "other-key", Scopes: []auth.Scope{auth.ScopeSend}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts := []Option{WithQueue(q), WithKeyRing(keys)}
+	app := fiber.New()
+	app.Post("/v1/send", Authenticate(auth.ScopeSend, log, opts...), func(c *fiber.Ctx) error {
+		return SendHandler(c, client, idempotency.NewStore(300), log, opts...)
+	})
+	app.Delete("/v1/scheduled/:key", Authenticate(auth.ScopeSend, log, opts...), func(c *fiber.Ctx) error {
+		return CancelScheduledHandler(c, log, opts...)
+	})
+
+	req := httptest.NewRequest(http.MethodPost, "/v1/send", bytes.NewBufferString(`{"to":"u1","body":"hi","params":{"delay":"1h"}}`))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Idempotency-Key", "reminder-2")
+	req.Header.Set("X-API-Key", "prod-key")
+	resp, err := app.Test(req)
+	if err != nil {
+		t.Fatalf("app.Test: %v", err)
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusAccepted {
+		t.Fatalf("schedule status = %d, want 202", resp.StatusCode)
+	}
+
+	cancel := func(key string) int {
+		req := httptest.NewRequest(http.MethodDelete, "/v1/scheduled/reminder-2", nil)
+		req.Header.Set("X-API-Key", key)
+		resp, err := app.Test(req)
+		if err != nil {
+			t.Fatalf("app.Test: %v", err)
+		}
+		_ = resp.Body.Close()
+		return resp.StatusCode
+	}
+	if status := cancel("other-key"); status != http.StatusNotFound {
+		t.Errorf("cancel by another caller = %d, want 404", status)
+	}
+	if status := cancel("prod-key"); status != http.StatusOK {
+		t.Errorf("cancel by the owner = %d, want 200", status)
+	}
+}
+
+func TestJobHandler_OnlyOwnerSeesJob(t *testing.T) {
+	client := dingtalk.NewClient("k", "s", "1")
+	log := logger.New(logger.Config{Level: logger.ErrorLevel})
+	q, err := queue.Open(filepath.Join(t.TempDir(), "queue.wal"), queue.Options{})
+	if err != nil {
+		t.Fatalf("queue.Open: %v", err)
+	}
+	defer func() { _ = q.Close() }()
+	keys, err := auth.NewKeyRing("",
+		auth.Key{Name: "herald-prod", Key: "prod-key", Scopes: []auth.Scope{auth.ScopeSend}},
+		auth.Key{Name: "other-app", Key: "other-key", Scopes: []auth.Scope{auth.ScopeSend}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts := []Option{WithQueue(q), WithKeyRing(keys)}
+	app := fiber.New()
+	app.Post("/v1/send", Authenticate(auth.ScopeSend, log, opts...), func(c *fiber.Ctx) error {
+		return SendHandler(c, client, idempotency.NewStore(300), log, opts...)
+	})
+	app.Get("/v1/jobs/:id", Authenticate(auth.ScopeSend, log, opts...), func(c *fiber.Ctx) error {
+		return JobHandler(c, log, opts...)
+	})
+
+	req := httptest.NewRequest(http.MethodPost, "/v1/send", bytes.NewBufferString(`{"to":"u1","body":"hi","params":{"delay":"1h"}}`))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-API-Key", "prod-key")
+	resp, err := app.Test(req)
+	if err != nil {
+		t.Fatalf("app.Test: %v", err)
+	}
+	var queued struct {
+		JobID string `json:"job_id"`
+	}
+	_ = json.NewDecoder(resp.Body).Decode(&queued)
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusAccepted || queued.JobID == "" {
+		t.Fatalf("schedule = %d job %q, want 202 and a job id", resp.StatusCode, queued.JobID)
+	}
+
+	get := func(key string) int {
+		req := httptest.NewRequest(http.MethodGet, "/v1/jobs/"+queued.JobID, nil)
+		req.Header.Set("X-API-Key", key)
+		resp, err := app.Test(req)
+		if err != nil {
+			t.Fatalf("app.Test: %v", err)
+		}
+		_ = resp.Body.Close()
+		return resp.StatusCode
+	}
+	if status := get("other-key"); status != http.StatusNotFound {
+		t.Errorf("job read by another caller = %d, want 404", status)
+	}
+	if status := get("prod-key"); status != http.StatusOK {
+		t.Errorf("job read by the owner = %d, want 200", status)
+	}
+}
@@ -0,0 +1,71 @@
+package handler
+
+import (
+	"encoding/json"
+	"regexp"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/middleware/adaptor"
+)
+
+// errorCodeLabel accepts the error codes this service writes; anything else is recorded as
+// "other" so a label can never carry request data.
+var errorCodeLabel = regexp.MustCompile(`^[a-z_]{1,40}$`)
+
+// MetricsHandler handles GET /metrics: the registry from WithMetrics in the Prometheus
+// exposition format, or 404 when metrics are disabled.
+func MetricsHandler(c *fiber.Ctx, opts ...Option) error {
+	m := newOptions(opts).metrics
+	if m == nil {
+		return fiber.ErrNotFound
+	}
+	return adaptor.HTTPHandler(m.Handler())(c)
+}
+
+// TrackInFlight returns middleware counting requests being served; it does nothing without WithMetrics.
+func TrackInFlight(opts ...Option) fiber.Handler {
+	m := newOptions(opts).metrics
+	return func(c *fiber.Ctx) error {
+		if m == nil {
+			return c.Next()
+		}
+		m.InFlight().Inc()
+		defer m.InFlight().Dec()
+		return c.Next()
+	}
+}
+
+// Instrument returns middleware recording the latency, caller and error_code of every response on
+// route, including authentication failures when it runs before Authenticate. It does nothing
+// without WithMetrics.
+func Instrument(route string, opts ...Option) fiber.Handler {
+	m := newOptions(opts).metrics
+	return func(c *fiber.Ctx) error {
+		if m == nil {
+			return c.Next()
+		}
+		start := time.Now()
+		err := c.Next()
+		code := "internal_error"
+		if err == nil {
+			code = responseErrorCode(c)
+		}
+		m.ObserveRequest(route, callerLabel(c), code, time.Since(start))
+		return err
+	}
+}
+
+// responseErrorCode returns the error_code of the JSON response body, "" if there is none.
+func responseErrorCode(c *fiber.Ctx) string {
+	var body struct {
+		ErrorCode string `json:"error_code"`
+	}
+	if json.Unmarshal(c.Response().Body(), &body) != nil || body.ErrorCode == "" {
+		return ""
+	}
+	if !errorCodeLabel.MatchString(body.ErrorCode) {
+		return "other"
+	}
+	return body.ErrorCode
+}
@@ -0,0 +1,139 @@
+package handler
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/soulteary/herald-dingtalk/internal/auth"
+	"github.com/soulteary/herald-dingtalk/internal/metrics"
+	"github.com/soulteary/logger-kit"
+)
+
+func TestInstrument_RecordsErrorCodes(t *testing.T) {
+	m := metrics.New()
+	app := fiber.New()
+	app.Use(TrackInFlight(WithMetrics(m)))
+	app.Post("/send", Instrument(metrics.RouteSend, WithMetrics(m)), func(c *fiber.Ctx) error {
+		if got := testutil.ToFloat64(m.InFlight()); got != 1 {
+			t.Errorf("in-flight during request = %v, want 1", got)
+		}
+		switch c.Query("case") {
+		case "ok":
+			return c.JSON(fiber.Map{"ok": true, "message_id": "13800138000"})
+		case "limited":
+			return c.Status(fiber.StatusTooManyRequests).JSON(fiber.Map{"ok": false, "error_code": "rate_limited"})
+		case "odd":
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"ok": false, "error_code": "user 13800138000"})
+		}
+		return errors.New("boom")
+	})
+	for _, q := range []string{"ok", "limited", "odd", "fail"} {
+		resp, err := app.Test(httptest.NewRequest(http.MethodPost, "/send?case="+q, nil))
+		if err != nil {
+			t.Fatalf("app.Test: %v", err)
+		}
+		_ = resp.Body.Close()
+	}
+	if got := testutil.ToFloat64(m.InFlight()); got != 0 {
+		t.Errorf("in-flight after requests = %v, want 0", got)
+	}
+
+	app.Get("/metrics", func(c *fiber.Ctx) error { return MetricsHandler(c, WithMetrics(m)) })
+	resp, err := app.Test(httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if err != nil {
+		t.Fatalf("app.Test: %v", err)
+	}
+	defer resp.Body.Close()
+	if ct := resp.Header.Get(fiber.HeaderContentType); !strings.HasPrefix(ct, "text/plain") {
+		t.Errorf("Content-Type = %q, want the Prometheus text format", ct)
+	}
+	raw, _ := io.ReadAll(resp.Body)
+	body := string(raw)
+	for _, code := range []string{"none", "rate_limited", "other", "internal_error"} {
+		want := `herald_dingtalk_requests_total{caller="anonymous",error_code="` + code + `",route="send"} 1`
+		if !strings.Contains(body, want) {
+			t.Errorf("metrics lack %q:\n%s", want, body)
+		}
+	}
+	if strings.Contains(body, "13800138000") {
+		t.Errorf("metrics leak request data:\n%s", body)
+	}
+}
+
+// headerAuth authenticates X-Test-Caller as a credential of the given kind.
+type headerAuth struct {
+	credential string
+}
+
+func (a headerAuth) Credential() string { return a.credential }
+
+func (headerAuth) Authenticate(c *fiber.Ctx, _ auth.Scope, _ time.Time) (string, bool, error) {
+	name := c.Get("X-Test-Caller")
+	return name, name != "", nil
+}
+
+func TestInstrument_BoundsCallerLabel(t *testing.T) {
+	keys, err := auth.NewKeyRing("", auth.Key{Name: "ops", Key: "ops-secret", Scopes: auth.AllScopes})
+	if err != nil {
+		t.Fatalf("NewKeyRing: %v", err)
+	}
+	log := logger.New(logger.Config{Level: logger.ErrorLevel})
+	m := metrics.New()
+	app := func(credential string) *fiber.App {
+		a := fiber.New()
+		a.Post("/send", Instrument(metrics.RouteSend, WithMetrics(m)),
+			Authenticate(auth.ScopeSend, log, WithKeyRing(keys), WithAuthenticators(headerAuth{credential})),
+			func(c *fiber.Ctx) error { return c.JSON(fiber.Map{"ok": true}) })
+		return a
+	}
+	requests := []struct {
+		app    *fiber.App
+		header map[string]string
+	}{
+		{app("jwt"), map[string]string{"X-API-Key": "ops-secret"}},
+		{app("jwt"), map[string]string{"X-Test-Caller": "user-4711@idp"}},
+		{app("custom"), map[string]string{"X-Test-Caller": "svc-0815"}},
+	}
+	for _, r := range requests {
+		req := httptest.NewRequest(http.MethodPost, "/send", nil)
+		for k, v := range r.header {
+			req.Header.Set(k, v)
+		}
+		resp, err := r.app.Test(req)
+		if err != nil {
+			t.Fatalf("app.Test: %v", err)
+		}
+		_ = resp.Body.Close()
+	}
+
+	want := `
+# HELP herald_dingtalk_requests_total Requests to /v1/send and /v1/resolve by route, authenticated caller (key name, jwt, other or anonymous) and error_code (none on success).
+# TYPE herald_dingtalk_requests_total counter
+herald_dingtalk_requests_total{caller="jwt",error_code="none",route="send"} 1
+herald_dingtalk_requests_total{caller="ops",error_code="none",route="send"} 1
+herald_dingtalk_requests_total{caller="other",error_code="none",route="send"} 1
+`
+	if err := testutil.GatherAndCompare(m.Registry, strings.NewReader(want), "herald_dingtalk_requests_total"); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestMetricsHandler_NotFoundWithoutMetrics(t *testing.T) {
+	app := fiber.New()
+	app.Get("/metrics", func(c *fiber.Ctx) error { return MetricsHandler(c) })
+	resp, err := app.Test(httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if err != nil {
+		t.Fatalf("app.Test: %v", err)
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("status = %d, want 404", resp.StatusCode)
+	}
+}
@@ -0,0 +1,82 @@
+package handler
+
+import (
+	"github.com/soulteary/herald-dingtalk/internal/auth"
+	"github.com/soulteary/herald-dingtalk/internal/metrics"
+	"github.com/soulteary/herald-dingtalk/internal/queue"
+	"github.com/soulteary/herald-dingtalk/internal/quota"
+	"github.com/soulteary/herald-dingtalk/internal/ratelimit"
+)
+
+// Option supplies optional dependencies to handlers.
+type Option func(*options)
+
+type options struct {
+	queue *queue.Queue
+	quota *quota.Limiter
+	limit *ratelimit.Limiter
+	keys  *auth.KeyRing
+	// signer verifies HMAC-signed requests; signRequired rejects unsigned ones for the send and
+	// resolve scopes.
+	signer       *auth.Verifier
+	signRequired bool
+	jwt          *auth.JWTVerifier
+	// authenticators run before the built-in ones (client certificate, JWT, signature, API key).
+	authenticators []Authenticator
+	metrics        *metrics.Metrics
+}
+
+// WithQueue enables async sends (params.mode=async) and job status lookups backed by q.
+func WithQueue(q *queue.Queue) Option {
+	return func(o *options) { o.queue = q }
+}
+
+// WithQuota rejects sends DingTalk would silently drop (per-user daily limit, identical content)
+// with 429 rate_limited before calling asyncsend_v2.
+func WithQuota(l *quota.Limiter) Option {
+	return func(o *options) { o.quota = l }
+}
+
+// WithRateLimit rejects /v1/send with 429 rate_limited when the caller's API key, client IP or
+// destination exceeds its limit.
+func WithRateLimit(l *ratelimit.Limiter) Option {
+	return func(o *options) { o.limit = l }
+}
+
+// WithKeyRing authenticates callers against named, scoped API keys instead of API_KEY alone.
+func WithKeyRing(k *auth.KeyRing) Option {
+	return func(o *options) { o.keys = k }
+}
+
+// WithSignatures accepts HMAC-signed requests, verified by v. With required set, X-API-Key alone
+// is no longer accepted for the send and resolve scopes.
+func WithSignatures(v *auth.Verifier, required bool) Option {
+	return func(o *options) {
+		o.signer = v
+		o.signRequired = required
+	}
+}
+
+// WithJWT accepts "Authorization: Bearer" JWTs verified by v as an alternative to X-API-Key. The
+// token's scope claim decides which endpoints the caller may use.
+func WithJWT(v *auth.JWTVerifier) Option {
+	return func(o *options) { o.jwt = v }
+}
+
+// WithAuthenticators adds authenticators for other credential kinds, tried before the built-in ones.
+func WithAuthenticators(a ...Authenticator) Option {
+	return func(o *options) { o.authenticators = append(o.authenticators, a...) }
+}
+
+// WithMetrics records request outcomes and in-flight requests in m and serves it on GET /metrics.
+func WithMetrics(m *metrics.Metrics) Option {
+	return func(o *options) { o.metrics = m }
+}
+
+func newOptions(opts []Option) options {
+	var o options
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return o
+}
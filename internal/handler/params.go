@@ -0,0 +1,52 @@
+package handler
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// scheduledAt returns when a send should be delivered from params.send_at or params.delay.
+// Zero means now.
+func scheduledAt(params map[string]string, now time.Time) (time.Time, error) {
+	return timeParam(params, "send_at", "delay", now)
+}
+
+// expiresAt returns when a send must no longer be delivered from params.expires_at or
+// params.ttl. Zero means never.
+func expiresAt(params map[string]string, now time.Time) (time.Time, error) {
+	return timeParam(params, "expires_at", "ttl", now)
+}
+
+// timeParam reads an instant from params[atKey] (RFC 3339 or Unix seconds) or an offset from
+// now from params[durKey] (a Go duration such as "10m", or seconds). The keys are exclusive.
+func timeParam(params map[string]string, atKey, durKey string, now time.Time) (time.Time, error) {
+	at, dur := params[atKey], params[durKey]
+	switch {
+	case at != "" && dur != "":
+		return time.Time{}, errors.New(atKey + " and " + durKey + " are mutually exclusive")
+	case at != "":
+		if t, err := time.Parse(time.RFC3339, at); err == nil {
+			return t, nil
+		}
+		if sec, err := strconv.ParseInt(at, 10, 64); err == nil && sec > 0 {
+			return time.Unix(sec, 0), nil
+		}
+		return time.Time{}, fmt.Errorf("invalid %s %q: want RFC 3339 or Unix seconds", atKey, at)
+	case dur != "":
+		d, err := time.ParseDuration(dur)
+		if err != nil {
+			sec, convErr := strconv.Atoi(dur)
+			if convErr != nil {
+				return time.Time{}, fmt.Errorf("invalid %s %q: want a duration like 10m or seconds", durKey, dur)
+			}
+			d = time.Duration(sec) * time.Second
+		}
+		if d < 0 {
+			return time.Time{}, fmt.Errorf("invalid %s %q: must not be negative", durKey, dur)
+		}
+		return now.Add(d), nil
+	}
+	return time.Time{}, nil
+}
@@ -0,0 +1,44 @@
+package handler
+
+import (
+	"testing"
+	"time"
+)
+
+func TestScheduledAt(t *testing.T) {
+	now := time.Date(2026, 1, 1, 8, 0, 0, 0, time.UTC)
+	tests := []struct {
+		params  map[string]string
+		want    time.Time
+		wantErr bool
+	}{
+		{nil, time.Time{}, false},
+		{map[string]string{"send_at": "2026-01-01T09:00:00Z"}, now.Add(time.Hour), false},
+		{map[string]string{"send_at": "1767258000"}, time.Unix(1767258000, 0), false},
+		{map[string]string{"delay": "10m"}, now.Add(10 * time.Minute), false},
+		{map[string]string{"delay": "30"}, now.Add(30 * time.Second), false},
+		{map[string]string{"delay": "-1m"}, time.Time{}, true},
+		{map[string]string{"delay": "soon"}, time.Time{}, true},
+		{map[string]string{"send_at": "tomorrow"}, time.Time{}, true},
+		{map[string]string{"send_at": "2026-01-01T09:00:00Z", "delay": "1m"}, time.Time{}, true},
+	}
+	for _, tt := range tests {
+		got, err := scheduledAt(tt.params, now)
+		if (err != nil) != tt.wantErr || !got.Equal(tt.want) {
+			t.Errorf("scheduledAt(%v) = %v, %v; want %v, err=%v", tt.params, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+func TestExpiresAt(t *testing.T) {
+	now := time.Date(2026, 1, 1, 8, 0, 0, 0, time.UTC)
+	if got, err := expiresAt(map[string]string{"ttl": "5m"}, now); err != nil || !got.Equal(now.Add(5*time.Minute)) {
+		t.Errorf("ttl = %v, %v", got, err)
+	}
+	if got, err := expiresAt(map[string]string{"expires_at": "2026-01-01T08:10:00Z"}, now); err != nil || !got.Equal(now.Add(10*time.Minute)) {
+		t.Errorf("expires_at = %v, %v", got, err)
+	}
+	if _, err := expiresAt(map[string]string{"expires_at": "x", "ttl": "1m"}, now); err == nil {
+		t.Error("expires_at with ttl: want error")
+	}
+}
@@ -1,9 +1,11 @@
 package handler
 
 import (
+	"errors"
+
 	"github.com/gofiber/fiber/v2"
-	"github.com/soulteary/herald-dingtalk/internal/config"
 	"github.com/soulteary/herald-dingtalk/internal/dingtalk"
+	"github.com/soulteary/herald-dingtalk/internal/redact"
 	"github.com/soulteary/logger-kit"
 )
 
@@ -20,12 +22,6 @@ type ResolveResponse struct {
 // ResolveHandler handles POST /v1/resolve: OAuth2 auth_code -> userid.
 // Optional: useful when Stargate uses DingTalk OAuth2 login link and needs to resolve code to userid.
 func ResolveHandler(c *fiber.Ctx, dingtalkClient *dingtalk.Client, log *logger.Logger) error {
-	if config.APIKey != "" && c.Get("X-API-Key") != config.APIKey {
-		log.Warn().Str("client_ip", c.IP()).Msg("resolve unauthorized: invalid or missing API key")
-		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
-			"ok": false, "error_code": "unauthorized", "error_message": "invalid or missing API key",
-		})
-	}
 	var req ResolveRequest
 	if err := c.BodyParser(&req); err != nil {
 		log.Warn().Err(err).Msg("resolve invalid_request: body parse error")
@@ -46,12 +42,25 @@ func ResolveHandler(c *fiber.Ctx, dingtalkClient *dingtalk.Client, log *logger.L
 		})
 	}
 	userid, err := dingtalkClient.ResolveAuthCode(c.Context(), req.AuthCode)
+	if retryAfter, ok := outboundLimited(err); ok {
+		log.Warn().Err(err).Msg("resolve rate_limited: DingTalk OAuth rate limit")
+		setRetryAfter(c, retryAfter)
+		return c.Status(fiber.StatusTooManyRequests).JSON(fiber.Map{
+			"ok": false, "error_code": "rate_limited", "error_message": err.Error(),
+		})
+	}
+	if errors.Is(err, dingtalk.ErrCircuitOpen) {
+		log.Warn().Msg("resolve provider_down: circuit breaker open")
+		return c.Status(fiber.StatusServiceUnavailable).JSON(fiber.Map{
+			"ok": false, "error_code": "provider_down", "error_message": err.Error(),
+		})
+	}
 	if err != nil {
-		log.Warn().Err(err).Str("auth_code", req.AuthCode).Msg("resolve failed: oauth2 error")
+		log.Warn().Str("caller", callerName(c)).Err(err).Str("auth_code", redact.Secret(req.AuthCode, logRedaction())).Msg("resolve failed: oauth2 error")
 		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
 			"ok": false, "error_code": "resolve_failed", "error_message": err.Error(),
 		})
 	}
-	log.Info().Str("userid", userid).Msg("resolve ok")
+	log.Info().Str("caller", callerName(c)).Str("userid", logTo(userid)).Msg("resolve ok")
 	return c.JSON(fiber.Map{"ok": true, "userid": userid})
 }
@@ -1,12 +1,23 @@
 package handler
 
 import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"math"
 	"regexp"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/gofiber/fiber/v2"
 	"github.com/soulteary/herald-dingtalk/internal/config"
 	"github.com/soulteary/herald-dingtalk/internal/dingtalk"
 	"github.com/soulteary/herald-dingtalk/internal/idempotency"
+	"github.com/soulteary/herald-dingtalk/internal/ratelimit"
+	"github.com/soulteary/herald-dingtalk/internal/redact"
 	"github.com/soulteary/logger-kit"
 	"github.com/soulteary/provider-kit"
 )
@@ -14,14 +25,10 @@ import (
 // 仅数字且长度 11 视为手机号（用于 DINGTALK_LOOKUP_MODE=mobile 时解析 to）
 var mobileLike = regexp.MustCompile(`^\d{11}$`)
 
-// SendHandler handles POST /v1/send from Herald.
-func SendHandler(c *fiber.Ctx, dingtalkClient *dingtalk.Client, idemStore *idempotency.Store, log *logger.Logger) error {
-	if config.APIKey != "" && c.Get("X-API-Key") != config.APIKey {
-		log.Warn().Str("client_ip", c.IP()).Msg("send unauthorized: invalid or missing API key")
-		return c.Status(fiber.StatusUnauthorized).JSON(provider.HTTPSendResponse{
-			OK: false, ErrorCode: "unauthorized", ErrorMessage: "invalid or missing API key",
-		})
-	}
+// SendHandler handles POST /v1/send from Herald. With params.mode=async the message is queued
+// (see WithQueue) and 202 is returned with the job id.
+func SendHandler(c *fiber.Ctx, dingtalkClient *dingtalk.Client, idemStore *idempotency.Store, log *logger.Logger, opts ...Option) error {
+	o := newOptions(opts)
 	var req provider.HTTPSendRequest
 	if err := c.BodyParser(&req); err != nil {
 		log.Warn().Err(err).Msg("send invalid_request: body parse error")
@@ -35,55 +42,251 @@ func SendHandler(c *fiber.Ctx, dingtalkClient *dingtalk.Client, idemStore *idemp
 			OK: false, ErrorCode: "invalid_destination", ErrorMessage: "to is required",
 		})
 	}
+	now := time.Now()
+	sendAt, err := scheduledAt(req.Params, now)
+	if err != nil {
+		log.Warn().Err(err).Str("to", logTo(req.To)).Msg("send invalid_request: bad schedule")
+		return c.Status(fiber.StatusBadRequest).JSON(provider.HTTPSendResponse{
+			OK: false, ErrorCode: "invalid_request", ErrorMessage: err.Error(),
+		})
+	}
+	expires, err := expiresAt(req.Params, now)
+	if err == nil && !expires.IsZero() && !sendAt.IsZero() && !sendAt.Before(expires) {
+		err = errors.New("send_at must be before expires_at")
+	}
+	if err != nil {
+		log.Warn().Err(err).Str("to", logTo(req.To)).Msg("send invalid_request: bad expiry")
+		return c.Status(fiber.StatusBadRequest).JSON(provider.HTTPSendResponse{
+			OK: false, ErrorCode: "invalid_request", ErrorMessage: err.Error(),
+		})
+	}
 	if req.IdempotencyKey == "" {
-		req.IdempotencyKey = c.Get("Idempotency-Key")
+		// Copy: fiber's header strings are reused after the request, but the key outlives it in
+		// the idempotency store and queued jobs.
+		req.IdempotencyKey = strings.Clone(c.Get("Idempotency-Key"))
 	}
 	if req.IdempotencyKey != "" {
-		if cached, hit := idemStore.Get(req.IdempotencyKey); hit {
-			log.Debug().Str("to", req.To).Bool("cached_ok", cached.OK).Str("message_id", cached.MessageID).Msg("send idempotent hit")
+		fingerprint := requestFingerprint(req)
+		cached, status := idemStore.Reserve(req.IdempotencyKey, fingerprint)
+		deadline := time.Now().Add(time.Duration(config.IdemWaitSec) * time.Second)
+		for status == idempotency.InFlight {
+			log.Debug().Str("to", logTo(req.To)).Msg("send idempotent in-flight: waiting for first request")
+			cached, status = idemStore.Wait(req.IdempotencyKey, time.Until(deadline))
+			if status == idempotency.InFlight {
+				log.Warn().Str("to", logTo(req.To)).Msg("send idempotency_in_progress: same key still in flight")
+				return c.Status(fiber.StatusConflict).JSON(provider.HTTPSendResponse{
+					OK: false, ErrorCode: "idempotency_in_progress", ErrorMessage: "a request with the same idempotency key is in progress",
+				})
+			}
+			if status == idempotency.Released {
+				// The first request never reached DingTalk and gave the key up: send it ourselves.
+				cached, status = idemStore.Reserve(req.IdempotencyKey, fingerprint)
+			}
+		}
+		if status == idempotency.Conflict {
+			log.Warn().Str("to", logTo(req.To)).Msg("send idempotency_conflict: key reused with a different payload")
+			return c.Status(fiber.StatusConflict).JSON(provider.HTTPSendResponse{
+				OK: false, ErrorCode: "idempotency_conflict", ErrorMessage: "idempotency key was already used with a different request payload",
+			})
+		}
+		if status == idempotency.Completed {
+			log.Debug().Str("to", logTo(req.To)).Bool("cached_ok", cached.OK).Str("message_id", cached.MessageID).Msg("send idempotent hit")
+			if cached.StatusCode != 0 {
+				c.Set(fiber.HeaderContentType, fiber.MIMEApplicationJSON)
+				return c.Status(cached.StatusCode).Send(cached.Body)
+			}
 			return c.JSON(provider.HTTPSendResponse{
 				OK: cached.OK, MessageID: cached.MessageID, Provider: "dingtalk",
 			})
 		}
 	}
-	content := req.Body
-	if content == "" && len(req.Params) > 0 {
-		if code, ok := req.Params["code"]; ok {
-			content = "验证码：" + code
-		}
-	}
-	if content == "" {
-		content = "您有一条验证消息，请查看。"
-	}
-	destUserID := req.To
-	if config.LookupMode == config.LookupModeMobile && mobileLike.MatchString(req.To) {
-		resolved, err := dingtalkClient.GetUserIDByMobile(c.Context(), req.To)
+	if o.limit != nil {
+		dim, retryAfter, err := o.limit.Allow(c.Context(), ratelimit.Subject{Caller: callerName(c), IP: c.IP(), To: req.To}, time.Now())
 		if err != nil {
-			log.Warn().Err(err).Str("to", req.To).Msg("send invalid_destination: mobile lookup failed")
-			return c.Status(fiber.StatusBadRequest).JSON(provider.HTTPSendResponse{
-				OK: false, ErrorCode: "invalid_destination", ErrorMessage: "mobile lookup failed: " + err.Error(),
+			log.Warn().Err(err).Msg("send rate limit check failed; allowing request")
+		} else if retryAfter > 0 {
+			log.Warn().Str("caller", callerName(c)).Str("client_ip", c.IP()).Str("to", logTo(req.To)).Str("limited_by", string(dim)).Dur("retry_after", retryAfter).Msg("send rate_limited: too many requests")
+			setRetryAfter(c, retryAfter)
+			return finishUnsent(c, idemStore, req.IdempotencyKey, fiber.StatusTooManyRequests, provider.HTTPSendResponse{
+				OK: false, ErrorCode: "rate_limited", ErrorMessage: "too many requests per " + string(dim),
 			})
 		}
-		destUserID = resolved
-		log.Debug().Str("mobile", req.To).Str("userid", destUserID).Msg("send: resolved mobile to userid")
 	}
-	taskID, err := dingtalkClient.SendWorkNotify(c.Context(), destUserID, content)
+	if !expires.IsZero() && !time.Now().Before(expires) {
+		log.Warn().Str("to", logTo(req.To)).Time("expires_at", expires).Msg("send expired: message expired before delivery")
+		return finishSend(c, idemStore, req.IdempotencyKey, fiber.StatusGone, provider.HTTPSendResponse{
+			OK: false, ErrorCode: "expired", ErrorMessage: "message expired before delivery",
+		})
+	}
+	if req.Params["mode"] == modeAsync || !sendAt.IsZero() {
+		return enqueueSend(c, o.queue, idemStore, req, sendAt, expires, log)
+	}
+	ctx := dingtalk.WithExpiry(c.Context(), expires)
+	destUserID, err := resolveUserID(ctx, dingtalkClient, req.To)
 	if err != nil {
-		log.Warn().Err(err).Str("to", destUserID).Msg("send_failed: dingtalk API error")
-		errCode := "send_failed"
-		errMsg := err.Error()
-		if req.IdempotencyKey != "" {
-			idemStore.Set(req.IdempotencyKey, false, "")
+		if errors.Is(err, dingtalk.ErrExpired) {
+			log.Warn().Str("to", logTo(req.To)).Msg("send expired: message expired during mobile lookup")
+			return finishSend(c, idemStore, req.IdempotencyKey, fiber.StatusGone, provider.HTTPSendResponse{
+				OK: false, ErrorCode: "expired", ErrorMessage: "message expired before delivery",
+			})
+		}
+		if retryAfter, ok := outboundLimited(err); ok {
+			log.Warn().Err(err).Str("to", logTo(req.To)).Msg("send rate_limited: DingTalk lookup rate limit")
+			setRetryAfter(c, retryAfter)
+			return finishUnsent(c, idemStore, req.IdempotencyKey, fiber.StatusTooManyRequests, provider.HTTPSendResponse{
+				OK: false, ErrorCode: "rate_limited", ErrorMessage: err.Error(),
+			})
+		}
+		if errors.Is(err, dingtalk.ErrCircuitOpen) {
+			log.Warn().Str("to", logTo(req.To)).Msg("send provider_down: circuit breaker open")
+			return finishUnsent(c, idemStore, req.IdempotencyKey, fiber.StatusServiceUnavailable, provider.HTTPSendResponse{
+				OK: false, ErrorCode: "provider_down", ErrorMessage: err.Error(),
+			})
 		}
-		return c.Status(fiber.StatusInternalServerError).JSON(provider.HTTPSendResponse{
-			OK: false, ErrorCode: errCode, ErrorMessage: errMsg,
+		log.Warn().Err(err).Str("to", logTo(req.To)).Msg("send invalid_destination: mobile lookup failed")
+		return finishSend(c, idemStore, req.IdempotencyKey, fiber.StatusBadRequest, provider.HTTPSendResponse{
+			OK: false, ErrorCode: "invalid_destination", ErrorMessage: "mobile lookup failed: " + err.Error(),
 		})
 	}
-	if req.IdempotencyKey != "" {
-		idemStore.Set(req.IdempotencyKey, true, taskID)
+	if destUserID != req.To {
+		log.Debug().Str("mobile", logTo(req.To)).Str("userid", logTo(destUserID)).Msg("send: resolved mobile to userid")
+	}
+	content := messageContent(req)
+	log.Debug().Str("to", logTo(destUserID)).Str("content", redact.Body(content, logRedaction())).Msg("send: delivering")
+	if o.quota != nil {
+		if retryAfter, err := o.quota.Reserve(destUserID, content, time.Now()); err != nil {
+			log.Warn().Err(err).Str("to", logTo(destUserID)).Dur("retry_after", retryAfter).Msg("send rate_limited: DingTalk quota")
+			setRetryAfter(c, retryAfter)
+			return finishUnsent(c, idemStore, req.IdempotencyKey, fiber.StatusTooManyRequests, provider.HTTPSendResponse{
+				OK: false, ErrorCode: "rate_limited", ErrorMessage: err.Error(),
+			})
+		}
+	}
+	taskID, err := dingtalkClient.SendWorkNotify(ctx, destUserID, content)
+	if err != nil {
+		if o.quota != nil {
+			o.quota.Cancel(destUserID, content, time.Now())
+		}
+		if errors.Is(err, dingtalk.ErrExpired) {
+			log.Warn().Err(err).Str("to", logTo(destUserID)).Msg("send expired: dropped before delivery")
+			return finishSend(c, idemStore, req.IdempotencyKey, fiber.StatusGone, provider.HTTPSendResponse{
+				OK: false, ErrorCode: "expired", ErrorMessage: "message expired before delivery",
+			})
+		}
+		if retryAfter, ok := outboundLimited(err); ok {
+			log.Warn().Err(err).Str("to", logTo(destUserID)).Msg("send rate_limited: DingTalk send rate limit")
+			setRetryAfter(c, retryAfter)
+			return finishUnsent(c, idemStore, req.IdempotencyKey, fiber.StatusTooManyRequests, provider.HTTPSendResponse{
+				OK: false, ErrorCode: "rate_limited", ErrorMessage: err.Error(),
+			})
+		}
+		if errors.Is(err, dingtalk.ErrCircuitOpen) {
+			log.Warn().Str("to", logTo(destUserID)).Msg("send provider_down: circuit breaker open")
+			return finishUnsent(c, idemStore, req.IdempotencyKey, fiber.StatusServiceUnavailable, provider.HTTPSendResponse{
+				OK: false, ErrorCode: "provider_down", ErrorMessage: err.Error(),
+			})
+		}
+		log.Warn().Str("caller", callerName(c)).Err(err).Str("to", logTo(destUserID)).Msg("send_failed: dingtalk API error")
+		resp := provider.HTTPSendResponse{OK: false, ErrorCode: "send_failed", ErrorMessage: err.Error()}
+		if dingtalk.NotProcessed(err) {
+			return finishUnsent(c, idemStore, req.IdempotencyKey, fiber.StatusInternalServerError, resp)
+		}
+		// DingTalk may have delivered the message: a retry must replay this failure, not resend.
+		return finishSend(c, idemStore, req.IdempotencyKey, fiber.StatusInternalServerError, resp)
 	}
-	log.Info().Str("to", req.To).Str("message_id", taskID).Msg("send ok")
-	return c.JSON(provider.HTTPSendResponse{
+	log.Info().Str("caller", callerName(c)).Str("to", logTo(req.To)).Str("message_id", taskID).Msg("send ok")
+	return finishSend(c, idemStore, req.IdempotencyKey, fiber.StatusOK, provider.HTTPSendResponse{
 		OK: true, MessageID: taskID, Provider: "dingtalk",
 	})
 }
+
+// messageContent returns the notification text for req: body, else the code param, else a default.
+func messageContent(req provider.HTTPSendRequest) string {
+	if req.Body != "" {
+		return req.Body
+	}
+	if code, ok := req.Params["code"]; ok {
+		return "验证码：" + code
+	}
+	return "您有一条验证消息，请查看。"
+}
+
+// resolveUserID maps to onto a DingTalk userid: with DINGTALK_LOOKUP_MODE=mobile an 11-digit
+// mobile is looked up, anything else is used as the userid.
+func resolveUserID(ctx context.Context, dingtalkClient *dingtalk.Client, to string) (string, error) {
+	if config.LookupMode != config.LookupModeMobile || !mobileLike.MatchString(to) {
+		return to, nil
+	}
+	return dingtalkClient.GetUserIDByMobile(ctx, to)
+}
+
+// outboundLimited reports whether err means the client's outbound limiter had no slot for the
+// DingTalk call in time, and when one frees up.
+func outboundLimited(err error) (time.Duration, bool) {
+	var rl *dingtalk.RateLimitError
+	if errors.As(err, &rl) {
+		return rl.RetryAfter, true
+	}
+	return 0, false
+}
+
+// setRetryAfter sets the Retry-After header to d rounded up to whole seconds.
+func setRetryAfter(c *fiber.Ctx, d time.Duration) {
+	c.Set(fiber.HeaderRetryAfter, strconv.Itoa(int(math.Ceil(d.Seconds()))))
+}
+
+// finishSend writes resp with the given status and, when key is set, caches the exact bytes so an
+// idempotent replay is identical to the original response.
+func finishSend(c *fiber.Ctx, idemStore *idempotency.Store, key string, status int, resp provider.HTTPSendResponse) error {
+	return finishSendBody(c, idemStore, key, status, resp.OK, resp.MessageID, resp, false)
+}
+
+// finishUnsent is finishSend for failures where the message certainly never reached DingTalk (see
+// dingtalk.NotProcessed): it releases the key instead, unless IDEMPOTENCY_CACHE_TRANSIENT_FAILURES
+// is enabled, so a retry with the same key actually sends.
+func finishUnsent(c *fiber.Ctx, idemStore *idempotency.Store, key string, status int, resp provider.HTTPSendResponse) error {
+	return finishSendBody(c, idemStore, key, status, resp.OK, resp.MessageID, resp, !config.IdemCacheTransientFailures)
+}
+
+// finishSendBody is finishSend, or finishUnsent when release is set, for response bodies other
+// than provider.HTTPSendResponse.
+func finishSendBody(c *fiber.Ctx, idemStore *idempotency.Store, key string, status int, ok bool, messageID string, resp any, release bool) error {
+	body, err := json.Marshal(resp)
+	if err != nil {
+		return err
+	}
+	if key != "" {
+		if release {
+			idemStore.Release(key)
+		} else {
+			idemStore.SetResponse(key, idempotency.Response{
+				OK: ok, MessageID: messageID, StatusCode: status, Body: body,
+			})
+		}
+	}
+	c.Set(fiber.HeaderContentType, fiber.MIMEApplicationJSON)
+	return c.Status(status).Send(body)
+}
+
+// requestFingerprint hashes the canonicalized parts of the send payload that determine delivery
+// (to, body, params) so reuse of a key with a different message can be detected. encoding/json
+// sorts map keys, which keeps params order-independent.
+func requestFingerprint(req provider.HTTPSendRequest) string {
+	raw, _ := json.Marshal(struct {
+		To     string            `json:"to"`
+		Body   string            `json:"body"`
+		Params map[string]string `json:"params"`
+	}{req.To, req.Body, req.Params})
+	sum := sha256.Sum256(raw)
+	return hex.EncodeToString(sum[:])
+}
+
+// logRedaction is the LOG_REDACTION level (validated at startup).
+func logRedaction() redact.Level {
+	return redact.Level(config.LogRedaction)
+}
+
+// logTo masks a destination (mobile or userid) for logs.
+func logTo(to string) string {
+	return redact.To(to, logRedaction())
+}
@@ -2,15 +2,23 @@ package handler
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
+	"io"
 	"net/http"
 	"net/http/httptest"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/gofiber/fiber/v2"
 	"github.com/soulteary/herald-dingtalk/internal/config"
 	"github.com/soulteary/herald-dingtalk/internal/dingtalk"
 	"github.com/soulteary/herald-dingtalk/internal/idempotency"
+	"github.com/soulteary/herald-dingtalk/internal/quota"
+	"github.com/soulteary/herald-dingtalk/internal/ratelimit"
 	"github.com/soulteary/logger-kit"
 )
 
@@ -164,3 +172,594 @@ func TestSendHandler_MobileLookupWhenModeMobile(t *testing.T) {
 		t.Errorf("ok=%v message_id=%q", out.OK, out.MessageID)
 	}
 }
+
+func TestSendHandler_CachesMobileLookupFailure(t *testing.T) {
+	orig := config.LookupMode
+	config.LookupMode = config.LookupModeMobile
+	t.Cleanup(func() { config.LookupMode = orig })
+	var lookups int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch r.URL.Path {
+		case "/gettoken":
+			_ = json.NewEncoder(w).Encode(map[string]any{"errcode": 0, "access_token": "tok", "expires_in": 7200})
+		case "/topapi/v2/user/getbymobile":
+			atomic.AddInt32(&lookups, 1)
+			_ = json.NewEncoder(w).Encode(map[string]any{"errcode": 60121, "errmsg": "找不到该用户"})
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+
+	client := dingtalk.NewClientWithHTTP("k", "s", "1", &http.Client{Transport: &redirectTransport{base: server}})
+	idemStore := idempotency.NewStore(300)
+	log := logger.New(logger.Config{Level: logger.ErrorLevel})
+	app := fiber.New()
+	app.Post("/v1/send", func(c *fiber.Ctx) error { return SendHandler(c, client, idemStore, log) })
+
+	var bodies []string
+	for range 2 {
+		req := httptest.NewRequest(http.MethodPost, "/v1/send", bytes.NewBufferString(`{"to":"13800138000","body":"code"}`))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Idempotency-Key", "lookup-key")
+		resp, err := app.Test(req)
+		if err != nil {
+			t.Fatalf("app.Test: %v", err)
+		}
+		raw, _ := io.ReadAll(resp.Body)
+		_ = resp.Body.Close()
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("status = %d, want 400", resp.StatusCode)
+		}
+		bodies = append(bodies, string(raw))
+	}
+	if bodies[0] != bodies[1] {
+		t.Errorf("replay body = %s, want %s", bodies[1], bodies[0])
+	}
+	if got := atomic.LoadInt32(&lookups); got != 1 {
+		t.Errorf("getbymobile calls = %d, want 1 (the failure is cached)", got)
+	}
+}
+
+func TestSendHandler_ConcurrentSameIdempotencyKey(t *testing.T) {
+	var sends int32
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/gettoken":
+			w.Header().Set("Content-Type", "application/json")
+			_ = json.NewEncoder(w).Encode(map[string]any{"errcode": 0, "access_token": "tok", "expires_in": 7200})
+		case "/topapi/message/corpconversation/asyncsend_v2":
+			atomic.AddInt32(&sends, 1)
+			<-release
+			w.Header().Set("Content-Type", "application/json")
+			_ = json.NewEncoder(w).Encode(map[string]any{"errcode": 0, "task_id": 777})
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+
+	client := dingtalk.NewClientWithHTTP("k", "s", "1", &http.Client{Transport: &redirectTransport{base: server}})
+	idemStore := idempotency.NewStore(300)
+	log := logger.New(logger.Config{Level: logger.ErrorLevel})
+	app := fiber.New()
+	app.Post("/v1/send", func(c *fiber.Ctx) error { return SendHandler(c, client, idemStore, log) })
+
+	const n = 4
+	var wg sync.WaitGroup
+	ids := make([]string, n)
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			req := httptest.NewRequest(http.MethodPost, "/v1/send", bytes.NewBufferString(`{"to":"userid123","body":"hello"}`))
+			req.Header.Set("Content-Type", "application/json")
+			req.Header.Set("Idempotency-Key", "same-key")
+			resp, err := app.Test(req, 5000)
+			if err != nil {
+				t.Errorf("app.Test: %v", err)
+				return
+			}
+			defer func() { _ = resp.Body.Close() }()
+			var out struct {
+				MessageID string `json:"message_id"`
+			}
+			_ = json.NewDecoder(resp.Body).Decode(&out)
+			ids[i] = out.MessageID
+		}(i)
+	}
+	time.Sleep(100 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	if got := atomic.LoadInt32(&sends); got != 1 {
+		t.Errorf("asyncsend_v2 calls = %d, want 1", got)
+	}
+	for i, id := range ids {
+		if id != "777" {
+			t.Errorf("response %d message_id = %q, want 777", i, id)
+		}
+	}
+}
+
+func TestSendHandler_WaiterSendsAfterOwnerReleases(t *testing.T) {
+	var sends int32
+	firstArrived := make(chan struct{})
+	failFirst := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/gettoken":
+			w.Header().Set("Content-Type", "application/json")
+			_ = json.NewEncoder(w).Encode(map[string]any{"errcode": 0, "access_token": "tok", "expires_in": 7200})
+		case "/topapi/message/corpconversation/asyncsend_v2":
+			if atomic.AddInt32(&sends, 1) == 1 {
+				close(firstArrived)
+				<-failFirst
+				// 503: DingTalk refused the send unprocessed, so the key is released.
+				w.WriteHeader(http.StatusServiceUnavailable)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			_ = json.NewEncoder(w).Encode(map[string]any{"errcode": 0, "task_id": 888})
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+
+	client := dingtalk.NewClientWithHTTP("k", "s", "1", &http.Client{Transport: &redirectTransport{base: server}})
+	client.SetRetryPolicy(dingtalk.RetryPolicy{MaxAttempts: 1})
+	idemStore := idempotency.NewStore(300)
+	log := logger.New(logger.Config{Level: logger.ErrorLevel})
+	app := fiber.New()
+	app.Post("/v1/send", func(c *fiber.Ctx) error { return SendHandler(c, client, idemStore, log) })
+
+	send := func() (int, string) {
+		req := httptest.NewRequest(http.MethodPost, "/v1/send", bytes.NewBufferString(`{"to":"userid123","body":"hello"}`))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Idempotency-Key", "released-key")
+		resp, err := app.Test(req, 5000)
+		if err != nil {
+			t.Errorf("app.Test: %v", err)
+			return 0, ""
+		}
+		defer func() { _ = resp.Body.Close() }()
+		var out struct {
+			MessageID string `json:"message_id"`
+		}
+		_ = json.NewDecoder(resp.Body).Decode(&out)
+		return resp.StatusCode, out.MessageID
+	}
+
+	firstStatus := make(chan int, 1)
+	go func() {
+		status, _ := send()
+		firstStatus <- status
+	}()
+	<-firstArrived
+	waiter := make(chan [2]any, 1)
+	go func() {
+		status, id := send()
+		waiter <- [2]any{status, id}
+	}()
+	time.Sleep(50 * time.Millisecond) // let the duplicate start waiting on the key
+	close(failFirst)
+
+	if status := <-firstStatus; status < http.StatusInternalServerError {
+		t.Errorf("first status = %d, want a 5xx", status)
+	}
+	got := <-waiter
+	if got[0] != http.StatusOK || got[1] != "888" {
+		t.Errorf("waiter got status %v message_id %q, want 200 and 888", got[0], got[1])
+	}
+	if n := atomic.LoadInt32(&sends); n != 2 {
+		t.Errorf("asyncsend_v2 calls = %d, want 2", n)
+	}
+}
+
+func TestSendHandler_IdempotencyConflict(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/gettoken":
+			w.Header().Set("Content-Type", "application/json")
+			_ = json.NewEncoder(w).Encode(map[string]any{"errcode": 0, "access_token": "tok", "expires_in": 7200})
+		case "/topapi/message/corpconversation/asyncsend_v2":
+			w.Header().Set("Content-Type", "application/json")
+			_ = json.NewEncoder(w).Encode(map[string]any{"errcode": 0, "task_id": 555})
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+
+	client := dingtalk.NewClientWithHTTP("k", "s", "1", &http.Client{Transport: &redirectTransport{base: server}})
+	idemStore := idempotency.NewStore(300)
+	log := logger.New(logger.Config{Level: logger.ErrorLevel})
+	app := fiber.New()
+	app.Post("/v1/send", func(c *fiber.Ctx) error { return SendHandler(c, client, idemStore, log) })
+
+	send := func(body string) *http.Response {
+		req := httptest.NewRequest(http.MethodPost, "/v1/send", bytes.NewBufferString(body))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Idempotency-Key", "reused-key")
+		resp, err := app.Test(req)
+		if err != nil {
+			t.Fatalf("app.Test: %v", err)
+		}
+		return resp
+	}
+	first := send(`{"to":"userid123","body":"hello"}`)
+	_ = first.Body.Close()
+	if first.StatusCode != http.StatusOK {
+		t.Fatalf("first status = %d, want 200", first.StatusCode)
+	}
+	replay := send(`{"to":"userid123","body":"hello"}`)
+	_ = replay.Body.Close()
+	if replay.StatusCode != http.StatusOK {
+		t.Errorf("replay status = %d, want 200", replay.StatusCode)
+	}
+	conflict := send(`{"to":"userid456","body":"hello"}`)
+	defer func() { _ = conflict.Body.Close() }()
+	if conflict.StatusCode != http.StatusConflict {
+		t.Errorf("conflict status = %d, want 409", conflict.StatusCode)
+	}
+	var out struct {
+		ErrorCode string `json:"error_code"`
+	}
+	_ = json.NewDecoder(conflict.Body).Decode(&out)
+	if out.ErrorCode != "idempotency_conflict" {
+		t.Errorf("error_code = %q, want idempotency_conflict", out.ErrorCode)
+	}
+}
+
+func TestSendHandler_IdempotentRetryOnlyResendsUnprocessed(t *testing.T) {
+	cases := []struct {
+		name     string
+		fail     func(w http.ResponseWriter)
+		resends  bool
+		wantCode int
+	}{
+		{"system busy", func(w http.ResponseWriter) {
+			_ = json.NewEncoder(w).Encode(map[string]any{"errcode": -1, "errmsg": "系统繁忙"})
+		}, true, http.StatusOK},
+		{"service unavailable", func(w http.ResponseWriter) { w.WriteHeader(http.StatusServiceUnavailable) }, true, http.StatusOK},
+		// DingTalk may have delivered these: the retry replays the failure.
+		{"permanent errcode", func(w http.ResponseWriter) {
+			_ = json.NewEncoder(w).Encode(map[string]any{"errcode": 40035, "errmsg": "invalid param"})
+		}, false, http.StatusInternalServerError},
+		{"bad gateway", func(w http.ResponseWriter) { w.WriteHeader(http.StatusBadGateway) }, false, http.StatusInternalServerError},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			var sends int32
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				switch r.URL.Path {
+				case "/gettoken":
+					w.Header().Set("Content-Type", "application/json")
+					_ = json.NewEncoder(w).Encode(map[string]any{"errcode": 0, "access_token": "tok", "expires_in": 7200})
+				case "/topapi/message/corpconversation/asyncsend_v2":
+					w.Header().Set("Content-Type", "application/json")
+					if atomic.AddInt32(&sends, 1) == 1 {
+						tc.fail(w)
+						return
+					}
+					_ = json.NewEncoder(w).Encode(map[string]any{"errcode": 0, "task_id": 321})
+				default:
+					http.NotFound(w, r)
+				}
+			}))
+			defer server.Close()
+
+			client := dingtalk.NewClientWithHTTP("k", "s", "1", &http.Client{Transport: &redirectTransport{base: server}})
+			client.SetRetryPolicy(dingtalk.RetryPolicy{MaxAttempts: 1})
+			idemStore := idempotency.NewStore(300)
+			log := logger.New(logger.Config{Level: logger.ErrorLevel})
+			app := fiber.New()
+			app.Post("/v1/send", func(c *fiber.Ctx) error { return SendHandler(c, client, idemStore, log) })
+
+			send := func() (int, string) {
+				req := httptest.NewRequest(http.MethodPost, "/v1/send", bytes.NewBufferString(`{"to":"userid123","body":"hello"}`))
+				req.Header.Set("Content-Type", "application/json")
+				req.Header.Set("Idempotency-Key", "retry-key")
+				resp, err := app.Test(req)
+				if err != nil {
+					t.Fatalf("app.Test: %v", err)
+				}
+				defer func() { _ = resp.Body.Close() }()
+				raw, _ := io.ReadAll(resp.Body)
+				return resp.StatusCode, string(raw)
+			}
+
+			if status, _ := send(); status != http.StatusInternalServerError {
+				t.Fatalf("first status = %d, want 500", status)
+			}
+			status, body := send()
+			if status != tc.wantCode {
+				t.Fatalf("retry status = %d, want %d", status, tc.wantCode)
+			}
+			replayStatus, replayBody := send()
+			if replayStatus != status || replayBody != body {
+				t.Errorf("replay = %d %s, want %d %s", replayStatus, replayBody, status, body)
+			}
+			want := int32(1)
+			if tc.resends {
+				want = 2
+			}
+			if got := atomic.LoadInt32(&sends); got != want {
+				t.Errorf("asyncsend_v2 calls = %d, want %d", got, want)
+			}
+		})
+	}
+}
+
+func TestSendHandler_ProviderDownWhenBreakerOpen(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/gettoken" {
+			_ = json.NewEncoder(w).Encode(map[string]any{"errcode": 0, "access_token": "tok", "expires_in": 7200})
+			return
+		}
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	client := dingtalk.NewClientWithHTTP("k", "s", "1", &http.Client{Transport: &redirectTransport{base: server}})
+	client.SetRetryPolicy(dingtalk.RetryPolicy{MaxAttempts: 1})
+	client.SetBreaker(1, time.Minute)
+	idemStore := idempotency.NewStore(300)
+	log := logger.New(logger.Config{Level: logger.ErrorLevel})
+	app := fiber.New()
+	app.Post("/v1/send", func(c *fiber.Ctx) error { return SendHandler(c, client, idemStore, log) })
+
+	type sendOut struct {
+		ErrorCode string `json:"error_code"`
+	}
+	send := func() (int, sendOut) {
+		req := httptest.NewRequest(http.MethodPost, "/v1/send", bytes.NewBufferString(`{"to":"userid123","body":"hello"}`))
+		req.Header.Set("Content-Type", "application/json")
+		resp, err := app.Test(req)
+		if err != nil {
+			t.Fatalf("app.Test: %v", err)
+		}
+		defer func() { _ = resp.Body.Close() }()
+		var out sendOut
+		_ = json.NewDecoder(resp.Body).Decode(&out)
+		return resp.StatusCode, out
+	}
+	if status, _ := send(); status != http.StatusInternalServerError {
+		t.Fatalf("first status = %d, want 500", status)
+	}
+	status, out := send()
+	if status != http.StatusServiceUnavailable || out.ErrorCode != "provider_down" {
+		t.Errorf("open breaker = %d %s, want 503 provider_down", status, out.ErrorCode)
+	}
+}
+
+func TestSendHandler_ExpiredMessageNotDelivered(t *testing.T) {
+	var sends int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&sends, 1)
+	}))
+	defer server.Close()
+
+	client := dingtalk.NewClientWithHTTP("k", "s", "1", &http.Client{Transport: &redirectTransport{base: server}})
+	log := logger.New(logger.Config{Level: logger.ErrorLevel})
+	app := fiber.New()
+	app.Post("/v1/send", func(c *fiber.Ctx) error { return SendHandler(c, client, idempotency.NewStore(300), log) })
+
+	send := func(body string) (int, string) {
+		req := httptest.NewRequest(http.MethodPost, "/v1/send", bytes.NewBufferString(body))
+		req.Header.Set("Content-Type", "application/json")
+		resp, err := app.Test(req)
+		if err != nil {
+			t.Fatalf("app.Test: %v", err)
+		}
+		defer func() { _ = resp.Body.Close() }()
+		var out struct {
+			ErrorCode string `json:"error_code"`
+		}
+		_ = json.NewDecoder(resp.Body).Decode(&out)
+		return resp.StatusCode, out.ErrorCode
+	}
+	if status, code := send(`{"to":"u1","params":{"code":"123456","expires_at":"2020-01-01T00:00:00Z"}}`); status != http.StatusGone || code != "expired" {
+		t.Errorf("expired send = %d %s, want 410 expired", status, code)
+	}
+	if status, code := send(`{"to":"u1","params":{"delay":"10m","ttl":"5m"}}`); status != http.StatusBadRequest || code != "invalid_request" {
+		t.Errorf("send_at after expiry = %d %s, want 400 invalid_request", status, code)
+	}
+	if got := atomic.LoadInt32(&sends); got != 0 {
+		t.Errorf("DingTalk called %d times for expired messages", got)
+	}
+}
+
+func TestSendHandler_QuotaRateLimited(t *testing.T) {
+	var sends int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if r.URL.Path == "/gettoken" {
+			_ = json.NewEncoder(w).Encode(map[string]any{"errcode": 0, "access_token": "tok", "expires_in": 7200})
+			return
+		}
+		atomic.AddInt32(&sends, 1)
+		_ = json.NewEncoder(w).Encode(map[string]any{"errcode": 0, "task_id": 1})
+	}))
+	defer server.Close()
+
+	client := dingtalk.NewClientWithHTTP("k", "s", "1", &http.Client{Transport: &redirectTransport{base: server}})
+	log := logger.New(logger.Config{Level: logger.ErrorLevel})
+	limiter := quota.New(2, 24*time.Hour, true)
+	idemStore := idempotency.NewStore(300)
+	app := fiber.New()
+	app.Post("/v1/send", func(c *fiber.Ctx) error { return SendHandler(c, client, idemStore, log, WithQuota(limiter)) })
+
+	send := func(body, key string) (int, string, string) {
+		req := httptest.NewRequest(http.MethodPost, "/v1/send", bytes.NewBufferString(body))
+		req.Header.Set("Content-Type", "application/json")
+		if key != "" {
+			req.Header.Set("Idempotency-Key", key)
+		}
+		resp, err := app.Test(req)
+		if err != nil {
+			t.Fatalf("app.Test: %v", err)
+		}
+		defer func() { _ = resp.Body.Close() }()
+		var out struct {
+			ErrorCode string `json:"error_code"`
+		}
+		_ = json.NewDecoder(resp.Body).Decode(&out)
+		return resp.StatusCode, out.ErrorCode, resp.Header.Get("Retry-After")
+	}
+	if status, _, _ := send(`{"to":"u1","body":"a"}`, ""); status != http.StatusOK {
+		t.Fatalf("first send = %d", status)
+	}
+	status, code, retryAfter := send(`{"to":"u1","body":"a"}`, "dup-key")
+	if status != http.StatusTooManyRequests || code != "rate_limited" || retryAfter == "" || retryAfter == "0" {
+		t.Errorf("duplicate content = %d %s Retry-After=%q, want 429 rate_limited", status, code, retryAfter)
+	}
+	if _, ok := idemStore.Get("dup-key"); ok {
+		t.Error("429 was cached under the idempotency key")
+	}
+	if status, _, _ := send(`{"to":"u1","body":"b"}`, ""); status != http.StatusOK {
+		t.Errorf("second distinct message = %d, want 200", status)
+	}
+	if status, code, _ := send(`{"to":"u1","body":"c"}`, ""); status != http.StatusTooManyRequests || code != "rate_limited" {
+		t.Errorf("over per-user limit = %d %s, want 429 rate_limited", status, code)
+	}
+	if got := atomic.LoadInt32(&sends); got != 2 {
+		t.Errorf("asyncsend_v2 calls = %d, want 2", got)
+	}
+}
+
+type failingStore struct{}
+
+func (failingStore) Take(context.Context, string, ratelimit.Rule, time.Time) (time.Duration, error) {
+	return 0, errors.New("redis down")
+}
+
+func TestSendHandler_InboundRateLimit(t *testing.T) {
+	var sends int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if r.URL.Path == "/gettoken" {
+			_ = json.NewEncoder(w).Encode(map[string]any{"errcode": 0, "access_token": "tok", "expires_in": 7200})
+			return
+		}
+		atomic.AddInt32(&sends, 1)
+		_ = json.NewEncoder(w).Encode(map[string]any{"errcode": 0, "task_id": 1})
+	}))
+	defer server.Close()
+
+	client := dingtalk.NewClientWithHTTP("k", "s", "1", &http.Client{Transport: &redirectTransport{base: server}})
+	log := logger.New(logger.Config{Level: logger.ErrorLevel})
+	limiter := ratelimit.New(ratelimit.NewMemoryStore(), ratelimit.Limits{
+		To: ratelimit.Rule{Limit: 1, Window: time.Minute},
+	})
+	idemStore := idempotency.NewStore(300)
+	app := fiber.New()
+	app.Post("/v1/send", func(c *fiber.Ctx) error { return SendHandler(c, client, idemStore, log, WithRateLimit(limiter)) })
+	open := fiber.New()
+	failOpen := ratelimit.New(failingStore{}, ratelimit.Limits{To: ratelimit.Rule{Limit: 1, Window: time.Minute}})
+	open.Post("/v1/send", func(c *fiber.Ctx) error { return SendHandler(c, client, idemStore, log, WithRateLimit(failOpen)) })
+
+	send := func(app *fiber.App, body, key string) (int, string, string) {
+		req := httptest.NewRequest(http.MethodPost, "/v1/send", bytes.NewBufferString(body))
+		req.Header.Set("Content-Type", "application/json")
+		if key != "" {
+			req.Header.Set("Idempotency-Key", key)
+		}
+		resp, err := app.Test(req)
+		if err != nil {
+			t.Fatalf("app.Test: %v", err)
+		}
+		defer func() { _ = resp.Body.Close() }()
+		var out struct {
+			ErrorCode string `json:"error_code"`
+		}
+		_ = json.NewDecoder(resp.Body).Decode(&out)
+		return resp.StatusCode, out.ErrorCode, resp.Header.Get("Retry-After")
+	}
+	if status, _, _ := send(app, `{"to":"u1","body":"a"}`, "k1"); status != http.StatusOK {
+		t.Fatalf("first send = %d", status)
+	}
+	if status, _, _ := send(app, `{"to":"u1","body":"a"}`, "k1"); status != http.StatusOK {
+		t.Errorf("idempotent replay = %d, want cached 200 (not rate limited)", status)
+	}
+	status, code, retryAfter := send(app, `{"to":"u1","body":"b"}`, "k2")
+	if status != http.StatusTooManyRequests || code != "rate_limited" || retryAfter != "60" {
+		t.Errorf("second message to u1 = %d %s Retry-After=%q, want 429 rate_limited 60", status, code, retryAfter)
+	}
+	if _, ok := idemStore.Get("k2"); ok {
+		t.Error("429 was cached under the idempotency key")
+	}
+	if status, _, _ := send(app, `{"to":"u2","body":"b"}`, ""); status != http.StatusOK {
+		t.Errorf("other recipient = %d, want 200", status)
+	}
+	if status, _, _ := send(open, `{"to":"u3","body":"c"}`, ""); status != http.StatusOK {
+		t.Errorf("store error = %d, want 200 (fail open)", status)
+	}
+	if got := atomic.LoadInt32(&sends); got != 3 {
+		t.Errorf("asyncsend_v2 calls = %d, want 3", got)
+	}
+}
+
+func TestSendHandler_OutboundRateLimited(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if r.URL.Path == "/gettoken" {
+			_ = json.NewEncoder(w).Encode(map[string]any{"errcode": 0, "access_token": "tok", "expires_in": 7200})
+			return
+		}
+		_ = json.NewEncoder(w).Encode(map[string]any{"errcode": 0, "task_id": 1})
+	}))
+	defer server.Close()
+
+	client := dingtalk.NewClientWithHTTP("k", "s", "1", &http.Client{Transport: &redirectTransport{base: server}})
+	client.SetRetryPolicy(dingtalk.RetryPolicy{MaxAttempts: 1, MaxElapsed: 50 * time.Millisecond})
+	client.SetRateLimit(dingtalk.RateClassSend, 0.1, 1)
+	log := logger.New(logger.Config{Level: logger.ErrorLevel})
+	idemStore := idempotency.NewStore(300)
+	app := fiber.New()
+	app.Post("/v1/send", func(c *fiber.Ctx) error { return SendHandler(c, client, idemStore, log) })
+
+	send := func(body string) *http.Response {
+		req := httptest.NewRequest(http.MethodPost, "/v1/send", bytes.NewBufferString(body))
+		req.Header.Set("Content-Type", "application/json")
+		resp, err := app.Test(req)
+		if err != nil {
+			t.Fatalf("app.Test: %v", err)
+		}
+		return resp
+	}
+	resp := send(`{"to":"u1","body":"a"}`)
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("first send = %d", resp.StatusCode)
+	}
+	resp = send(`{"to":"u2","body":"b"}`)
+	defer func() { _ = resp.Body.Close() }()
+	var out struct {
+		ErrorCode string `json:"error_code"`
+	}
+	_ = json.NewDecoder(resp.Body).Decode(&out)
+	if resp.StatusCode != http.StatusTooManyRequests || out.ErrorCode != "rate_limited" || resp.Header.Get("Retry-After") == "" {
+		t.Errorf("send without outbound slot = %d %s Retry-After=%q, want 429 rate_limited", resp.StatusCode, out.ErrorCode, resp.Header.Get("Retry-After"))
+	}
+}
+
+func TestLogTo_FollowsLogRedaction(t *testing.T) {
+	orig := config.LogRedaction
+	t.Cleanup(func() { config.LogRedaction = orig })
+	cases := []struct{ level, to, want string }{
+		{"partial", "13800138000", "138****8000"},
+		{"partial", "manager4521", "ma***21"},
+		{"full", "13800138000", "***"},
+		{"off", "13800138000", "13800138000"},
+	}
+	for _, tc := range cases {
+		config.LogRedaction = tc.level
+		if got := logTo(tc.to); got != tc.want {
+			t.Errorf("LOG_REDACTION=%s logTo(%q) = %q, want %q", tc.level, tc.to, got, tc.want)
+		}
+	}
+}
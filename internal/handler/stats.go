@@ -0,0 +1,11 @@
+package handler
+
+import (
+	"github.com/gofiber/fiber/v2"
+	"github.com/soulteary/herald-dingtalk/internal/idempotency"
+)
+
+// IdempotencyStatsHandler handles GET /v1/idempotency/stats: size, hits, misses, evictions of the idempotency cache.
+func IdempotencyStatsHandler(c *fiber.Ctx, idemStore *idempotency.Store) error {
+	return c.JSON(fiber.Map{"ok": true, "idempotency": idemStore.Stats()})
+}
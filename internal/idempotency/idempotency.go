@@ -1,55 +1,269 @@
 package idempotency
 
 import (
+	"container/list"
 	"sync"
 	"time"
 )
 
+// Status is the outcome of Reserve.
+type Status int
+
+const (
+	// Reserved means the caller now owns the key and must Set or Release it.
+	Reserved Status = iota
+	// Completed means a cached result exists for the key.
+	Completed
+	// InFlight means another request holds the key and has not finished yet.
+	InFlight
+	// Conflict means the key was already used with a different request payload.
+	Conflict
+	// Released means the request Wait was waiting for gave the key up without a result, so the
+	// waiter may Reserve it and run the request itself.
+	Released
+)
+
 type entry struct {
-	ok        bool
-	messageID string
+	key       string
+	resp      Response
 	expiresAt time.Time
+	// fingerprint is a hash of the canonicalized request that first used the key.
+	fingerprint string
+	// pending is true while the owning request is still sending; done is closed when it finishes.
+	pending bool
+	done    chan struct{}
+	// elem is the entry's position in the LRU list (front = most recently used).
+	elem *list.Element
+}
+
+// Stats is a snapshot of store counters for monitoring.
+type Stats struct {
+	Size      int    `json:"size"`
+	Hits      uint64 `json:"hits"`
+	Misses    uint64 `json:"misses"`
+	Evictions uint64 `json:"evictions"`
+	Expired   uint64 `json:"expired"`
 }
 
 // Store is an in-memory idempotency store. Same key within TTL returns cached response.
+// When maxEntries > 0 the least recently used completed entries are evicted beyond that size.
 type Store struct {
-	mu     sync.RWMutex
-	m      map[string]entry
-	ttlSec int
+	mu         sync.Mutex
+	m          map[string]*entry
+	lru        *list.List
+	ttlSec     int
+	maxEntries int
+	stats      Stats
+	stop       chan struct{}
+	stopOnce   sync.Once
 }
 
-// NewStore creates a store with the given TTL in seconds.
+// NewStore creates an unbounded store with the given TTL in seconds.
 func NewStore(ttlSec int) *Store {
-	s := &Store{m: make(map[string]entry), ttlSec: ttlSec}
+	return NewStoreWithLimit(ttlSec, 0)
+}
+
+// NewStoreWithLimit creates a store with the given TTL in seconds holding at most maxEntries keys.
+// maxEntries <= 0 means unbounded.
+func NewStoreWithLimit(ttlSec, maxEntries int) *Store {
+	s := &Store{
+		m:          make(map[string]*entry),
+		lru:        list.New(),
+		ttlSec:     ttlSec,
+		maxEntries: maxEntries,
+		stop:       make(chan struct{}),
+	}
 	if s.ttlSec <= 0 {
 		s.ttlSec = 300
 	}
 	return s
 }
 
-type cached struct {
-	OK        bool
-	MessageID string
+// Response is the cached outcome of a send. StatusCode and Body hold the exact HTTP response
+// so replays are byte-identical; they are zero for entries stored with Set.
+type Response struct {
+	OK         bool
+	MessageID  string
+	StatusCode int
+	Body       []byte
+}
+
+// Get returns cached result for key if not expired. ok=false means miss (including in-flight keys).
+func (s *Store) Get(key string) (Response, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e, ok := s.m[key]
+	if !ok || e.pending || time.Now().After(e.expiresAt) {
+		s.stats.Misses++
+		return Response{}, false
+	}
+	s.stats.Hits++
+	s.lru.MoveToFront(e.elem)
+	return e.resp, true
+}
+
+// Reserve atomically claims key for a request with the given payload fingerprint. When the key
+// is free (or expired) it is marked in-flight and Reserved is returned; the caller must then call
+// Set or Release. A pending reservation is held for at most the TTL so a crashed request cannot
+// block the key forever. If the key is held with a different non-empty fingerprint, Conflict is returned.
+func (s *Store) Reserve(key, fingerprint string) (Response, Status) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	if e, ok := s.m[key]; ok && now.Before(e.expiresAt) {
+		if e.fingerprint != "" && fingerprint != "" && e.fingerprint != fingerprint {
+			return Response{}, Conflict
+		}
+		if e.pending {
+			return Response{}, InFlight
+		}
+		s.stats.Hits++
+		s.lru.MoveToFront(e.elem)
+		return e.resp, Completed
+	}
+	s.stats.Misses++
+	s.put(&entry{
+		key:         key,
+		fingerprint: fingerprint,
+		pending:     true,
+		done:        make(chan struct{}),
+		expiresAt:   now.Add(time.Duration(s.ttlSec) * time.Second),
+	})
+	return Response{}, Reserved
 }
 
-// Get returns cached result for key if not expired. ok=false means miss.
-func (s *Store) Get(key string) (cached, bool) {
-	s.mu.RLock()
+// Wait blocks until the in-flight request holding key finishes or timeout elapses. It returns
+// Completed with the cached result, Released when the owner gave the key up without a result
+// (or it expired), or InFlight when the wait timed out.
+func (s *Store) Wait(key string, timeout time.Duration) (Response, Status) {
+	s.mu.Lock()
 	e, ok := s.m[key]
-	s.mu.RUnlock()
-	if !ok || time.Now().After(e.expiresAt) {
-		return cached{}, false
+	s.mu.Unlock()
+	if ok && e.pending {
+		t := time.NewTimer(timeout)
+		defer t.Stop()
+		select {
+		case <-e.done:
+		case <-t.C:
+			return Response{}, InFlight
+		}
 	}
-	return cached{OK: e.ok, MessageID: e.messageID}, true
+	if resp, ok := s.Get(key); ok {
+		return resp, Completed
+	}
+	return Response{}, Released
 }
 
-// Set stores the result for key with TTL.
+// Release drops an in-flight reservation without caching a result, waking any waiters.
+func (s *Store) Release(key string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e, ok := s.m[key]
+	if !ok || !e.pending {
+		return
+	}
+	s.remove(e)
+}
+
+// Set stores the result for key with TTL, completing any in-flight reservation.
 func (s *Store) Set(key string, ok bool, messageID string) {
+	s.SetResponse(key, Response{OK: ok, MessageID: messageID})
+}
+
+// SetResponse stores the full response for key with TTL, completing any in-flight reservation.
+// The fingerprint recorded by Reserve is kept for conflict detection.
+func (s *Store) SetResponse(key string, resp Response) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
-	s.m[key] = entry{
-		ok:        ok,
-		messageID: messageID,
-		expiresAt: time.Now().Add(time.Duration(s.ttlSec) * time.Second),
+	var fingerprint string
+	if e, exists := s.m[key]; exists {
+		fingerprint = e.fingerprint
+		s.remove(e)
+	}
+	s.put(&entry{
+		key:         key,
+		resp:        resp,
+		fingerprint: fingerprint,
+		expiresAt:   time.Now().Add(time.Duration(s.ttlSec) * time.Second),
+	})
+}
+
+// Stats returns a snapshot of the store counters.
+func (s *Store) Stats() Stats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	st := s.stats
+	st.Size = len(s.m)
+	return st
+}
+
+// Sweep deletes all expired entries and returns how many were removed.
+func (s *Store) Sweep() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	n := 0
+	for _, e := range s.m {
+		if now.After(e.expiresAt) {
+			s.remove(e)
+			n++
+		}
+	}
+	s.stats.Expired += uint64(n)
+	return n
+}
+
+// StartJanitor sweeps expired entries every interval until Close is called.
+func (s *Store) StartJanitor(interval time.Duration) {
+	if interval <= 0 {
+		interval = time.Minute
+	}
+	go func() {
+		t := time.NewTicker(interval)
+		defer t.Stop()
+		for {
+			select {
+			case <-t.C:
+				s.Sweep()
+			case <-s.stop:
+				return
+			}
+		}
+	}()
+}
+
+// Close stops the janitor started by StartJanitor. It is safe to call more than once.
+func (s *Store) Close() {
+	s.stopOnce.Do(func() { close(s.stop) })
+}
+
+// put inserts e as most recently used and evicts beyond maxEntries. Caller holds s.mu.
+func (s *Store) put(e *entry) {
+	if old, ok := s.m[e.key]; ok {
+		s.remove(old)
+	}
+	e.elem = s.lru.PushFront(e)
+	s.m[e.key] = e
+	if s.maxEntries <= 0 {
+		return
+	}
+	// Evict least recently used completed entries; in-flight reservations are never evicted
+	// so concurrent deduplication keeps working under pressure.
+	for el := s.lru.Back(); el != nil && len(s.m) > s.maxEntries; {
+		prev := el.Prev()
+		if victim := el.Value.(*entry); !victim.pending {
+			s.remove(victim)
+			s.stats.Evictions++
+		}
+		el = prev
+	}
+}
+
+// remove deletes e and wakes waiters if it was still pending. Caller holds s.mu.
+func (s *Store) remove(e *entry) {
+	s.lru.Remove(e.elem)
+	delete(s.m, e.key)
+	if e.pending {
+		close(e.done)
 	}
 }
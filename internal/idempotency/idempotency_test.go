@@ -63,3 +63,156 @@ func TestStore_SetFailureThenGet(t *testing.T) {
 		t.Errorf("got OK=%v MessageID=%q, want OK=false MessageID=", c.OK, c.MessageID)
 	}
 }
+
+func TestStore_ReserveThenSet(t *testing.T) {
+	s := NewStore(300)
+	key := "reserve-key"
+	if _, status := s.Reserve(key, "fp"); status != Reserved {
+		t.Fatalf("first Reserve status = %v, want Reserved", status)
+	}
+	if _, status := s.Reserve(key, "fp"); status != InFlight {
+		t.Fatalf("second Reserve status = %v, want InFlight", status)
+	}
+	if _, hit := s.Get(key); hit {
+		t.Fatal("expected miss while key is in flight")
+	}
+	s.Set(key, true, "msg-789")
+	c, status := s.Reserve(key, "fp")
+	if status != Completed {
+		t.Fatalf("Reserve after Set status = %v, want Completed", status)
+	}
+	if !c.OK || c.MessageID != "msg-789" {
+		t.Errorf("got OK=%v MessageID=%q, want OK=true MessageID=msg-789", c.OK, c.MessageID)
+	}
+}
+
+func TestStore_WaitForInFlight(t *testing.T) {
+	s := NewStore(300)
+	key := "wait-key"
+	s.Reserve(key, "fp")
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		s.Set(key, true, "msg-wait")
+	}()
+	c, status := s.Wait(key, 2*time.Second)
+	if status != Completed {
+		t.Fatalf("Wait status = %v, want Completed", status)
+	}
+	if c.MessageID != "msg-wait" {
+		t.Errorf("MessageID = %q, want msg-wait", c.MessageID)
+	}
+}
+
+func TestStore_WaitTimeout(t *testing.T) {
+	s := NewStore(300)
+	key := "timeout-key"
+	s.Reserve(key, "fp")
+	if _, status := s.Wait(key, 20*time.Millisecond); status != InFlight {
+		t.Fatalf("Wait status = %v, want InFlight after timeout", status)
+	}
+}
+
+func TestStore_ReleaseFreesKey(t *testing.T) {
+	s := NewStore(300)
+	key := "release-key"
+	s.Reserve(key, "fp")
+	waited := make(chan Status, 1)
+	go func() {
+		_, status := s.Wait(key, 2*time.Second)
+		waited <- status
+	}()
+	time.Sleep(20 * time.Millisecond)
+	s.Release(key)
+	if status := <-waited; status != Released {
+		t.Errorf("Wait status after Release = %v, want Released", status)
+	}
+	if _, status := s.Reserve(key, "fp"); status != Reserved {
+		t.Errorf("Reserve after Release status = %v, want Reserved", status)
+	}
+}
+
+func TestStore_ReserveConflict(t *testing.T) {
+	s := NewStore(300)
+	key := "conflict-key"
+	s.Reserve(key, "fp-a")
+	if _, status := s.Reserve(key, "fp-b"); status != Conflict {
+		t.Fatalf("Reserve with other fingerprint while in flight = %v, want Conflict", status)
+	}
+	s.Set(key, true, "msg-1")
+	if _, status := s.Reserve(key, "fp-b"); status != Conflict {
+		t.Fatalf("Reserve with other fingerprint after Set = %v, want Conflict", status)
+	}
+	if _, status := s.Reserve(key, "fp-a"); status != Completed {
+		t.Fatalf("Reserve with same fingerprint after Set = %v, want Completed", status)
+	}
+}
+
+func TestStore_LRUEviction(t *testing.T) {
+	s := NewStoreWithLimit(300, 2)
+	s.Set("a", true, "1")
+	s.Set("b", true, "2")
+	if _, hit := s.Get("a"); !hit { // a becomes most recently used
+		t.Fatal("expected hit for a")
+	}
+	s.Set("c", true, "3")
+	if _, hit := s.Get("b"); hit {
+		t.Error("expected b to be evicted as least recently used")
+	}
+	if _, hit := s.Get("a"); !hit {
+		t.Error("expected a to survive eviction")
+	}
+	st := s.Stats()
+	if st.Size != 2 || st.Evictions != 1 {
+		t.Errorf("stats = %+v, want Size=2 Evictions=1", st)
+	}
+}
+
+func TestStore_EvictionSkipsInFlight(t *testing.T) {
+	s := NewStoreWithLimit(300, 1)
+	s.Reserve("pending", "fp")
+	s.Set("done", true, "1")
+	if _, status := s.Reserve("pending", "fp"); status != InFlight {
+		t.Errorf("in-flight reservation was evicted: status = %v", status)
+	}
+}
+
+func TestStore_SweepAndStats(t *testing.T) {
+	s := NewStore(1)
+	s.Set("k1", true, "1")
+	s.Get("k1")
+	s.Get("missing")
+	time.Sleep(1100 * time.Millisecond)
+	if n := s.Sweep(); n != 1 {
+		t.Errorf("Sweep removed %d, want 1", n)
+	}
+	st := s.Stats()
+	if st.Size != 0 || st.Hits != 1 || st.Misses != 1 || st.Expired != 1 {
+		t.Errorf("stats = %+v, want Size=0 Hits=1 Misses=1 Expired=1", st)
+	}
+}
+
+func TestStore_Janitor(t *testing.T) {
+	s := NewStore(1)
+	defer s.Close()
+	s.Set("k1", true, "1")
+	s.StartJanitor(100 * time.Millisecond)
+	time.Sleep(1300 * time.Millisecond)
+	if st := s.Stats(); st.Size != 0 {
+		t.Errorf("Size = %d after janitor, want 0", st.Size)
+	}
+}
+
+func TestStore_SetResponseKeepsBody(t *testing.T) {
+	s := NewStore(300)
+	key := "full-key"
+	s.Reserve(key, "fp")
+	body := []byte(`{"ok":false,"error_code":"invalid_destination"}`)
+	s.SetResponse(key, Response{OK: false, StatusCode: 400, Body: body})
+	c, hit := s.Get(key)
+	if !hit {
+		t.Fatal("expected hit after SetResponse")
+	}
+	if c.StatusCode != 400 || string(c.Body) != string(body) {
+		t.Errorf("got StatusCode=%d Body=%s", c.StatusCode, c.Body)
+	}
+}
@@ -0,0 +1,119 @@
+package idempotency
+
+import (
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// snapshotVersion is bumped whenever the on-disk layout changes incompatibly.
+const snapshotVersion = 1
+
+type snapshot struct {
+	Version int             `json:"version"`
+	Entries []snapshotEntry `json:"entries"`
+}
+
+type snapshotEntry struct {
+	Key         string          `json:"key"`
+	OK          bool            `json:"ok"`
+	MessageID   string          `json:"message_id,omitempty"`
+	StatusCode  int             `json:"status_code,omitempty"`
+	Body        json.RawMessage `json:"body,omitempty"`
+	Fingerprint string          `json:"fingerprint,omitempty"`
+	ExpiresAt   time.Time       `json:"expires_at"`
+}
+
+// SaveFile writes all completed, unexpired entries to path as a JSON snapshot.
+// The file is written to a temp file first and renamed so a crash never leaves a partial snapshot.
+func (s *Store) SaveFile(path string) error {
+	s.mu.Lock()
+	now := time.Now()
+	snap := snapshot{Version: snapshotVersion}
+	// Walk from least to most recently used so LoadFile restores the same LRU order.
+	for el := s.lru.Back(); el != nil; el = el.Prev() {
+		e := el.Value.(*entry)
+		if e.pending || now.After(e.expiresAt) {
+			continue
+		}
+		snap.Entries = append(snap.Entries, snapshotEntry{
+			Key:         e.key,
+			OK:          e.resp.OK,
+			MessageID:   e.resp.MessageID,
+			StatusCode:  e.resp.StatusCode,
+			Body:        e.resp.Body,
+			Fingerprint: e.fingerprint,
+			ExpiresAt:   e.expiresAt,
+		})
+	}
+	s.mu.Unlock()
+
+	raw, err := json.Marshal(snap)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer func() { _ = os.Remove(tmp.Name()) }()
+	if _, err := tmp.Write(raw); err != nil {
+		_ = tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		_ = tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// LoadFile restores entries saved by SaveFile, skipping those already expired.
+// A missing file is not an error. It returns the number of entries loaded.
+func (s *Store) LoadFile(path string) (int, error) {
+	raw, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	var snap snapshot
+	if err := json.Unmarshal(raw, &snap); err != nil {
+		return 0, err
+	}
+	if snap.Version != snapshotVersion {
+		return 0, errors.New("idempotency snapshot: unsupported version")
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	n := 0
+	for _, se := range snap.Entries {
+		if now.After(se.ExpiresAt) {
+			continue
+		}
+		s.put(&entry{
+			key: se.Key,
+			resp: Response{
+				OK:         se.OK,
+				MessageID:  se.MessageID,
+				StatusCode: se.StatusCode,
+				Body:       se.Body,
+			},
+			fingerprint: se.Fingerprint,
+			expiresAt:   se.ExpiresAt,
+		})
+		n++
+	}
+	return n, nil
+}
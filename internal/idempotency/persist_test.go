@@ -0,0 +1,40 @@
+package idempotency
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestStore_SaveAndLoadFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "idem.json")
+	s := NewStore(300)
+	s.Set("done-key", true, "msg-1")
+	s.Reserve("pending-key", "fp")
+	if err := s.SaveFile(path); err != nil {
+		t.Fatalf("SaveFile: %v", err)
+	}
+
+	restored := NewStore(300)
+	n, err := restored.LoadFile(path)
+	if err != nil {
+		t.Fatalf("LoadFile: %v", err)
+	}
+	if n != 1 {
+		t.Errorf("loaded %d entries, want 1 (pending reservations are not persisted)", n)
+	}
+	c, hit := restored.Get("done-key")
+	if !hit || !c.OK || c.MessageID != "msg-1" {
+		t.Errorf("restored entry: hit=%v OK=%v MessageID=%q", hit, c.OK, c.MessageID)
+	}
+	if _, status := restored.Reserve("pending-key", "fp"); status != Reserved {
+		t.Errorf("pending key after restore: status = %v, want Reserved", status)
+	}
+}
+
+func TestStore_LoadFileMissing(t *testing.T) {
+	s := NewStore(300)
+	n, err := s.LoadFile(filepath.Join(t.TempDir(), "absent.json"))
+	if err != nil || n != 0 {
+		t.Errorf("LoadFile(missing) = %d, %v; want 0, nil", n, err)
+	}
+}
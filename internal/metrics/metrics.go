@@ -0,0 +1,162 @@
+package metrics
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/soulteary/herald-dingtalk/internal/dingtalk"
+	"github.com/soulteary/herald-dingtalk/internal/idempotency"
+)
+
+// Routes observed by ObserveRequest.
+const (
+	RouteSend    = "send"
+	RouteResolve = "resolve"
+)
+
+// errCodeUserNotFound is getbymobile's "找不到该用户".
+const errCodeUserNotFound = 60121
+
+// Metrics are the service's metrics. Labels are endpoints, error codes, outcomes and the
+// authenticated caller, which is a configured key name or a fixed kind such as "jwt": never
+// destinations, userids, token subjects or other per-user values.
+type Metrics struct {
+	Registry *prometheus.Registry
+
+	requests        *prometheus.CounterVec
+	requestDuration *prometheus.HistogramVec
+	inFlight        prometheus.Gauge
+	apiCalls        *prometheus.CounterVec
+	apiDuration     *prometheus.HistogramVec
+	tokenRefreshes  *prometheus.CounterVec
+	mobileLookups   *prometheus.CounterVec
+}
+
+// New returns the service metrics in a new registry.
+func New() *Metrics {
+	m := &Metrics{
+		Registry: prometheus.NewRegistry(),
+		requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "herald_dingtalk_requests_total",
+			Help: "Requests to /v1/send and /v1/resolve by route, authenticated caller (key name, jwt, other or anonymous) and error_code (none on success).",
+		}, []string{"route", "caller", "error_code"}),
+		requestDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name: "herald_dingtalk_request_duration_seconds",
+			Help: "Latency of /v1/send and /v1/resolve by route and error_code.",
+		}, []string{"route", "error_code"}),
+		inFlight: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "herald_dingtalk_requests_in_flight",
+			Help: "HTTP requests currently being served.",
+		}),
+		apiCalls: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "herald_dingtalk_dingtalk_api_calls_total",
+			Help: "DingTalk API call attempts by endpoint and errcode (0 on success, http_<status>, timeout or error when DingTalk sent none).",
+		}, []string{"endpoint", "errcode"}),
+		apiDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name: "herald_dingtalk_dingtalk_api_duration_seconds",
+			Help: "Latency of DingTalk API call attempts by endpoint.",
+		}, []string{"endpoint"}),
+		tokenRefreshes: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "herald_dingtalk_token_refreshes_total",
+			Help: "Access token fetches from DingTalk /gettoken by result (ok, error).",
+		}, []string{"result"}),
+		mobileLookups: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "herald_dingtalk_mobile_lookups_total",
+			Help: "Mobile to userid lookups via DingTalk getbymobile by result (ok, not_found, error).",
+		}, []string{"result"}),
+	}
+	m.Registry.MustRegister(m.requests, m.requestDuration, m.inFlight, m.apiCalls, m.apiDuration,
+		m.tokenRefreshes, m.mobileLookups)
+	return m
+}
+
+// Handler serves the registry in the Prometheus exposition format.
+func (m *Metrics) Handler() http.Handler {
+	return promhttp.HandlerFor(m.Registry, promhttp.HandlerOpts{})
+}
+
+// ObserveRequest records one /v1/send or /v1/resolve response; caller is "" when the request was
+// not authenticated and errorCode is "" on success.
+func (m *Metrics) ObserveRequest(route, caller, errorCode string, elapsed time.Duration) {
+	if caller == "" {
+		caller = "anonymous"
+	}
+	if errorCode == "" {
+		errorCode = "none"
+	}
+	m.requests.WithLabelValues(route, caller, errorCode).Inc()
+	m.requestDuration.WithLabelValues(route, errorCode).Observe(elapsed.Seconds())
+}
+
+// InFlight is the gauge of requests being served.
+func (m *Metrics) InFlight() prometheus.Gauge {
+	return m.inFlight
+}
+
+// ObserveAttempt is a dingtalk.AttemptObserver. Token refreshes and mobile lookups count the
+// final attempt of each call, so retries are not counted twice.
+func (m *Metrics) ObserveAttempt(endpoint string, attempt int, err error, elapsed time.Duration, willRetry bool) {
+	m.apiCalls.WithLabelValues(endpoint, errCodeLabel(err)).Inc()
+	m.apiDuration.WithLabelValues(endpoint).Observe(elapsed.Seconds())
+	if willRetry {
+		return
+	}
+	switch endpoint {
+	case dingtalk.EndpointGetToken:
+		m.tokenRefreshes.WithLabelValues(resultLabel(err)).Inc()
+	case dingtalk.EndpointGetByMobile:
+		var apiErr *dingtalk.APIError
+		if errors.As(err, &apiErr) && apiErr.ErrCode == errCodeUserNotFound {
+			m.mobileLookups.WithLabelValues("not_found").Inc()
+			return
+		}
+		m.mobileLookups.WithLabelValues(resultLabel(err)).Inc()
+	}
+}
+
+// TrackIdempotency exports the hit and miss counters and the size of s.
+func (m *Metrics) TrackIdempotency(s *idempotency.Store) {
+	m.Registry.MustRegister(
+		prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Name: "herald_dingtalk_idempotency_hits_total",
+			Help: "Idempotency-Key lookups that found a cached or in-progress request.",
+		}, func() float64 { return float64(s.Stats().Hits) }),
+		prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Name: "herald_dingtalk_idempotency_misses_total",
+			Help: "Idempotency-Key lookups that found nothing.",
+		}, func() float64 { return float64(s.Stats().Misses) }),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "herald_dingtalk_idempotency_entries",
+			Help: "Entries in the idempotency cache.",
+		}, func() float64 { return float64(s.Stats().Size) }),
+	)
+}
+
+// errCodeLabel maps a DingTalk call error onto the errcode label.
+func errCodeLabel(err error) string {
+	var apiErr *dingtalk.APIError
+	var statusErr *dingtalk.HTTPStatusError
+	switch {
+	case err == nil:
+		return "0"
+	case errors.As(err, &apiErr):
+		return strconv.Itoa(apiErr.ErrCode)
+	case errors.As(err, &statusErr):
+		return "http_" + strconv.Itoa(statusErr.StatusCode)
+	case errors.Is(err, context.DeadlineExceeded):
+		return "timeout"
+	}
+	return "error"
+}
+
+func resultLabel(err error) string {
+	if err != nil {
+		return "error"
+	}
+	return "ok"
+}
@@ -0,0 +1,108 @@
+package metrics
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/soulteary/herald-dingtalk/internal/dingtalk"
+	"github.com/soulteary/herald-dingtalk/internal/idempotency"
+)
+
+func TestObserveAttempt(t *testing.T) {
+	m := New()
+	busy := &dingtalk.APIError{Op: "dingtalk gettoken", ErrCode: -1}
+	m.ObserveAttempt(dingtalk.EndpointGetToken, 1, busy, time.Millisecond, true)
+	m.ObserveAttempt(dingtalk.EndpointGetToken, 2, nil, time.Millisecond, false)
+	m.ObserveAttempt(dingtalk.EndpointSend, 1, &dingtalk.HTTPStatusError{StatusCode: 502}, time.Millisecond, false)
+	m.ObserveAttempt(dingtalk.EndpointSend, 1, context.DeadlineExceeded, time.Second, false)
+	m.ObserveAttempt(dingtalk.EndpointGetByMobile, 1, &dingtalk.APIError{ErrCode: errCodeUserNotFound}, time.Millisecond, false)
+	m.ObserveAttempt(dingtalk.EndpointGetByMobile, 1, errors.New("getbymobile: no userid for mobile"), time.Millisecond, false)
+	m.ObserveAttempt(dingtalk.EndpointGetByMobile, 1, nil, time.Millisecond, false)
+
+	counts := []struct {
+		c      *prometheus.CounterVec
+		labels []string
+		want   float64
+	}{
+		{m.apiCalls, []string{dingtalk.EndpointGetToken, "-1"}, 1},
+		{m.apiCalls, []string{dingtalk.EndpointGetToken, "0"}, 1},
+		{m.apiCalls, []string{dingtalk.EndpointSend, "http_502"}, 1},
+		{m.apiCalls, []string{dingtalk.EndpointSend, "timeout"}, 1},
+		{m.apiCalls, []string{dingtalk.EndpointGetByMobile, "error"}, 1},
+		// The retried attempt is not a refresh of its own.
+		{m.tokenRefreshes, []string{"ok"}, 1},
+		{m.tokenRefreshes, []string{"error"}, 0},
+		{m.mobileLookups, []string{"not_found"}, 1},
+		{m.mobileLookups, []string{"error"}, 1},
+		{m.mobileLookups, []string{"ok"}, 1},
+	}
+	for _, tc := range counts {
+		if got := testutil.ToFloat64(tc.c.WithLabelValues(tc.labels...)); got != tc.want {
+			t.Errorf("counter%v = %v, want %v", tc.labels, got, tc.want)
+		}
+	}
+	if got := sampleCount(t, m.apiDuration.WithLabelValues(dingtalk.EndpointGetToken)); got != 2 {
+		t.Errorf("gettoken latency observations = %d, want 2", got)
+	}
+}
+
+// sampleCount returns the number of observations of histogram o.
+func sampleCount(t *testing.T, o prometheus.Observer) uint64 {
+	t.Helper()
+	var pb dto.Metric
+	if err := o.(prometheus.Metric).Write(&pb); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	return pb.GetHistogram().GetSampleCount()
+}
+
+func TestObserveRequestAndIdempotency(t *testing.T) {
+	m := New()
+	store := idempotency.NewStore(300)
+	m.TrackIdempotency(store)
+	store.Get("missing")
+	store.Set("k", true, "m1")
+	store.Get("k")
+	m.ObserveRequest(RouteSend, "herald-prod", "", 20*time.Millisecond)
+	m.ObserveRequest(RouteSend, "", "rate_limited", time.Millisecond)
+
+	requests := []struct {
+		labels []string
+		want   float64
+	}{
+		{[]string{RouteSend, "herald-prod", "none"}, 1},
+		{[]string{RouteSend, "anonymous", "rate_limited"}, 1},
+		{[]string{RouteSend, "", "none"}, 0},
+	}
+	for _, tc := range requests {
+		if got := testutil.ToFloat64(m.requests.WithLabelValues(tc.labels...)); got != tc.want {
+			t.Errorf("requests%v = %v, want %v", tc.labels, got, tc.want)
+		}
+	}
+	if got := sampleCount(t, m.requestDuration.WithLabelValues(RouteSend, "none")); got != 1 {
+		t.Errorf("send latency observations = %d, want 1", got)
+	}
+
+	want := `
+# HELP herald_dingtalk_idempotency_entries Entries in the idempotency cache.
+# TYPE herald_dingtalk_idempotency_entries gauge
+herald_dingtalk_idempotency_entries 1
+# HELP herald_dingtalk_idempotency_hits_total Idempotency-Key lookups that found a cached or in-progress request.
+# TYPE herald_dingtalk_idempotency_hits_total counter
+herald_dingtalk_idempotency_hits_total 1
+# HELP herald_dingtalk_idempotency_misses_total Idempotency-Key lookups that found nothing.
+# TYPE herald_dingtalk_idempotency_misses_total counter
+herald_dingtalk_idempotency_misses_total 1
+`
+	if err := testutil.GatherAndCompare(m.Registry, strings.NewReader(want),
+		"herald_dingtalk_idempotency_entries", "herald_dingtalk_idempotency_hits_total",
+		"herald_dingtalk_idempotency_misses_total"); err != nil {
+		t.Error(err)
+	}
+}
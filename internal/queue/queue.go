@@ -0,0 +1,536 @@
+package queue
+
+import (
+	"context"
+	crand "crypto/rand"
+	"encoding/hex"
+	"errors"
+	"math/rand/v2"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/soulteary/provider-kit"
+)
+
+// State is the lifecycle state of a job.
+type State string
+
+const (
+	// StatePending means the job waits for delivery (first try or a retry after NotBefore).
+	StatePending State = "pending"
+	// StateRunning means a worker is delivering the job.
+	StateRunning State = "running"
+	// StateSucceeded means the job was delivered; MessageID holds the provider's id.
+	StateSucceeded State = "succeeded"
+	// StateFailed means delivery failed permanently or exhausted MaxAttempts.
+	StateFailed State = "failed"
+	// StateCanceled means the job was canceled before it ran.
+	StateCanceled State = "canceled"
+	// StateExpired means the job's ExpiresAt passed before it could be delivered.
+	StateExpired State = "expired"
+)
+
+// errExpired is recorded as LastError of expired jobs.
+var errExpired = errors.New("expired before delivery")
+
+const (
+	// pruneInterval bounds how long the dispatcher sleeps, so finished jobs are pruned regularly.
+	pruneInterval = time.Minute
+	// maxHistory bounds the attempts kept per job so retried jobs do not bloat the WAL.
+	maxHistory = 20
+)
+
+// Errors returned by dead-letter operations.
+var (
+	ErrNotFound   = errors.New("job not found")
+	ErrNotDead    = errors.New("job is not a dead letter")
+	ErrNotPending = errors.New("job already started or finished")
+)
+
+// Attempt records one delivery attempt of a job.
+type Attempt struct {
+	At       time.Time     `json:"at"`
+	Duration time.Duration `json:"duration"`
+	Error    string        `json:"error,omitempty"`
+}
+
+// Job is one queued send. Jobs are persisted in the WAL as JSON. Failed jobs are dead letters:
+// they are kept, with their request and attempt history, until replayed or purged.
+type Job struct {
+	ID      string                   `json:"id"`
+	State   State                    `json:"state"`
+	Request provider.HTTPSendRequest `json:"request"`
+	// Caller is the authenticated caller that queued the job (empty when auth is off); only it
+	// may cancel the job.
+	Caller string `json:"caller,omitempty"`
+	// UserID is the DingTalk userid the request resolved to (empty if resolution failed).
+	UserID    string    `json:"userid,omitempty"`
+	Attempts  int       `json:"attempts"`
+	History   []Attempt `json:"history,omitempty"`
+	LastError string    `json:"last_error,omitempty"`
+	MessageID string    `json:"message_id,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+	// NotBefore is the earliest time the next attempt may run.
+	NotBefore time.Time `json:"not_before"`
+	// ExpiresAt, if set, is when the job must no longer be delivered.
+	ExpiresAt time.Time `json:"expires_at,omitzero"`
+}
+
+// Delivery is what a DeliverFunc learned while delivering, on success or failure.
+type Delivery struct {
+	MessageID string
+	UserID    string
+}
+
+// DeliverFunc delivers job. Wrap errors that retrying cannot fix with Permanent, and refusals to
+// deliver late with Expired.
+type DeliverFunc func(ctx context.Context, job Job) (Delivery, error)
+
+// Options configures a Queue. Zero values fall back to the defaults in Open.
+type Options struct {
+	// Workers is the number of concurrent deliveries.
+	Workers int
+	// MaxAttempts is the number of deliveries before a job fails.
+	MaxAttempts int
+	// RetryBase and RetryMax bound the exponential backoff between attempts.
+	RetryBase time.Duration
+	RetryMax  time.Duration
+	// Retention is how long succeeded jobs stay queryable before they are pruned.
+	// Failed jobs (dead letters) are kept until purged.
+	Retention time.Duration
+	// OnError is called when a state change cannot be written to the WAL (optional).
+	OnError func(err error)
+}
+
+// permanentError marks a delivery error as not retryable.
+type permanentError struct{ err error }
+
+func (e *permanentError) Error() string { return e.err.Error() }
+func (e *permanentError) Unwrap() error { return e.err }
+
+// Permanent wraps err so the queue fails the job without further attempts.
+func Permanent(err error) error {
+	return &permanentError{err: err}
+}
+
+// retryAfterError asks for the next attempt after a given delay instead of the usual backoff.
+type retryAfterError struct {
+	err   error
+	delay time.Duration
+}
+
+func (e *retryAfterError) Error() string { return e.err.Error() }
+func (e *retryAfterError) Unwrap() error { return e.err }
+
+// RetryAfter wraps err so the next attempt (if any remain) runs no earlier than delay from now,
+// e.g. when a rate limit resets.
+func RetryAfter(err error, delay time.Duration) error {
+	return &retryAfterError{err: err, delay: delay}
+}
+
+// expiredError marks a delivery refused because the job would be delivered too late.
+type expiredError struct{ err error }
+
+func (e *expiredError) Error() string { return e.err.Error() }
+func (e *expiredError) Unwrap() error { return e.err }
+
+// Expired wraps err so the queue ends the job as expired, even if ExpiresAt has not quite passed
+// yet (e.g. the next outbound slot is after it).
+func Expired(err error) error {
+	return &expiredError{err: err}
+}
+
+// Queue is a durable job queue backed by a local write-ahead log, delivered by a worker pool
+// with retries. Delivery is at-least-once: a job running during a crash is retried on restart.
+type Queue struct {
+	mu       sync.Mutex
+	wal      *wal
+	jobs     map[string]*Job
+	opts     Options
+	wake     chan struct{}
+	stop     chan struct{}
+	stopOnce sync.Once
+	wg       sync.WaitGroup
+}
+
+// Open loads the queue persisted at path (creating it if missing). Jobs that were running when
+// the process stopped are made pending again.
+func Open(path string, opts Options) (*Queue, error) {
+	if opts.Workers <= 0 {
+		opts.Workers = 4
+	}
+	if opts.MaxAttempts <= 0 {
+		opts.MaxAttempts = 5
+	}
+	if opts.RetryBase <= 0 {
+		opts.RetryBase = 5 * time.Second
+	}
+	if opts.RetryMax < opts.RetryBase {
+		opts.RetryMax = max(5*time.Minute, opts.RetryBase)
+	}
+	if opts.Retention <= 0 {
+		opts.Retention = 24 * time.Hour
+	}
+	w, jobs, err := openWAL(path)
+	if err != nil {
+		return nil, err
+	}
+	q := &Queue{
+		wal:  w,
+		jobs: jobs,
+		opts: opts,
+		wake: make(chan struct{}, 1),
+		stop: make(chan struct{}),
+	}
+	for _, job := range jobs {
+		if job.State == StateRunning {
+			job.State = StatePending
+			q.persist(job)
+		}
+	}
+	return q, nil
+}
+
+// Start runs the dispatcher, delivering due jobs with deliver on up to Workers goroutines
+// until Close is called.
+func (q *Queue) Start(deliver DeliverFunc) {
+	q.wg.Add(1)
+	go q.run(deliver)
+}
+
+// Enqueue persists a new pending job for req, queued by caller, that becomes due at notBefore
+// (zero = now) and is dropped as expired after expiresAt (zero = never). The job is durable once Enqueue returns
+// without error. If a job caller queued with the same non-empty idempotency key is still pending
+// or running, that job is returned instead of a duplicate.
+func (q *Queue) Enqueue(req provider.HTTPSendRequest, caller string, notBefore, expiresAt time.Time) (Job, error) {
+	now := time.Now()
+	if notBefore.IsZero() {
+		notBefore = now
+	}
+	q.mu.Lock()
+	if req.IdempotencyKey != "" {
+		for _, job := range q.jobs {
+			if job.Request.IdempotencyKey == req.IdempotencyKey && job.Caller == caller && (job.State == StatePending || job.State == StateRunning) {
+				existing := *job
+				q.mu.Unlock()
+				return existing, nil
+			}
+		}
+	}
+	job := &Job{
+		ID:        newID(),
+		State:     StatePending,
+		Request:   req,
+		Caller:    caller,
+		CreatedAt: now,
+		UpdatedAt: now,
+		NotBefore: notBefore,
+		ExpiresAt: expiresAt,
+	}
+	if err := q.wal.put(job); err != nil {
+		q.mu.Unlock()
+		return Job{}, err
+	}
+	q.jobs[job.ID] = job
+	queued := *job
+	q.mu.Unlock()
+	q.notify()
+	return queued, nil
+}
+
+// Get returns a copy of the job with the given id.
+func (q *Queue) Get(id string) (Job, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	job, ok := q.jobs[id]
+	if !ok {
+		return Job{}, false
+	}
+	return *job, true
+}
+
+// Close stops dispatching, waits for in-flight deliveries and closes the WAL.
+func (q *Queue) Close() error {
+	q.stopOnce.Do(func() { close(q.stop) })
+	q.wg.Wait()
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.wal.close()
+}
+
+func (q *Queue) run(deliver DeliverFunc) {
+	defer q.wg.Done()
+	sem := make(chan struct{}, q.opts.Workers)
+	for {
+		select {
+		case sem <- struct{}{}:
+		case <-q.stop:
+			return
+		}
+		for {
+			job, wait := q.claim(time.Now())
+			if job != nil {
+				q.wg.Add(1)
+				go func() {
+					defer q.wg.Done()
+					defer func() { <-sem }()
+					start := time.Now()
+					d, err := deliver(context.Background(), *job)
+					q.finish(job.ID, d, err, start)
+				}()
+				break
+			}
+			t := time.NewTimer(wait)
+			select {
+			case <-q.wake:
+			case <-t.C:
+			case <-q.stop:
+				t.Stop()
+				return
+			}
+			t.Stop()
+		}
+	}
+}
+
+// claim prunes old finished jobs and marks the most overdue pending job as running. If none is
+// due, it returns how long to wait for the next one.
+func (q *Queue) claim(now time.Time) (*Job, time.Duration) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	var next *Job
+	for id, job := range q.jobs {
+		switch job.State {
+		case StateSucceeded, StateCanceled, StateExpired:
+			if now.Sub(job.UpdatedAt) > q.opts.Retention {
+				delete(q.jobs, id)
+				if err := q.wal.del(id); err != nil {
+					q.reportError(err)
+				}
+			}
+		case StatePending:
+			if !job.ExpiresAt.IsZero() && !now.Before(job.ExpiresAt) {
+				job.State = StateExpired
+				job.LastError = errExpired.Error()
+				job.UpdatedAt = now
+				q.persist(job)
+				continue
+			}
+			if next == nil || job.NotBefore.Before(next.NotBefore) ||
+				(job.NotBefore.Equal(next.NotBefore) && job.CreatedAt.Before(next.CreatedAt)) {
+				next = job
+			}
+		}
+	}
+	if q.wal.needsCompact(len(q.jobs)) {
+		if err := q.wal.compact(q.jobs); err != nil {
+			q.reportError(err)
+		}
+	}
+	if next == nil {
+		return nil, pruneInterval
+	}
+	if wait := next.NotBefore.Sub(now); wait > 0 {
+		return nil, min(wait, pruneInterval)
+	}
+	next.State = StateRunning
+	next.Attempts++
+	next.UpdatedAt = now
+	q.persist(next)
+	job := *next
+	return &job, 0
+}
+
+// finish records the outcome of a delivery that began at start: success, a scheduled retry,
+// or failure (dead letter).
+func (q *Queue) finish(id string, d Delivery, err error, start time.Time) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	job, ok := q.jobs[id]
+	if !ok {
+		return
+	}
+	now := time.Now()
+	job.UpdatedAt = now
+	if d.UserID != "" {
+		job.UserID = d.UserID
+	}
+	attempt := Attempt{At: start, Duration: now.Sub(start)}
+	if err != nil {
+		attempt.Error = err.Error()
+	}
+	job.History = append(job.History, attempt)
+	if len(job.History) > maxHistory {
+		job.History = job.History[len(job.History)-maxHistory:]
+	}
+	var perm *permanentError
+	var exp *expiredError
+	switch {
+	case err == nil:
+		job.State = StateSucceeded
+		job.MessageID = d.MessageID
+		job.LastError = ""
+	case errors.As(err, &exp) || !job.ExpiresAt.IsZero() && !now.Before(job.ExpiresAt):
+		// Too late to deliver: no retry, and not a dead letter worth replaying.
+		job.State = StateExpired
+		job.LastError = err.Error()
+	case errors.As(err, &perm) || job.Attempts >= q.opts.MaxAttempts:
+		job.State = StateFailed
+		job.LastError = err.Error()
+	default:
+		job.State = StatePending
+		job.LastError = err.Error()
+		wait := q.backoff(job.Attempts)
+		var ra *retryAfterError
+		if errors.As(err, &ra) {
+			wait = ra.delay
+		}
+		job.NotBefore = now.Add(wait)
+	}
+	q.persist(job)
+	// Wake the dispatcher: a retry may now be the earliest pending job.
+	q.notify()
+}
+
+// Cancel cancels the pending jobs caller sent with idempotency key and returns them. Jobs of
+// other callers are ignored, so a key cannot be used to cancel someone else's sends. It returns
+// ErrNotFound if no job of caller has the key and ErrNotPending if they all started or finished
+// already.
+func (q *Queue) Cancel(key, caller string) ([]Job, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	var canceled []Job
+	found := false
+	now := time.Now()
+	for _, job := range q.jobs {
+		if key == "" || job.Request.IdempotencyKey != key || job.Caller != caller {
+			continue
+		}
+		found = true
+		if job.State != StatePending {
+			continue
+		}
+		job.State = StateCanceled
+		job.UpdatedAt = now
+		q.persist(job)
+		canceled = append(canceled, *job)
+	}
+	switch {
+	case !found:
+		return nil, ErrNotFound
+	case len(canceled) == 0:
+		return nil, ErrNotPending
+	}
+	return canceled, nil
+}
+
+// DeadLetters returns the failed jobs, most recently failed first.
+func (q *Queue) DeadLetters() []Job {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	var dead []Job
+	for _, job := range q.jobs {
+		if job.State == StateFailed {
+			dead = append(dead, *job)
+		}
+	}
+	slices.SortFunc(dead, func(a, b Job) int { return b.UpdatedAt.Compare(a.UpdatedAt) })
+	return dead
+}
+
+// Replay makes the dead letter id pending again with a fresh attempt budget. Its history is kept.
+func (q *Queue) Replay(id string) (Job, error) {
+	q.mu.Lock()
+	job, ok := q.jobs[id]
+	if !ok {
+		q.mu.Unlock()
+		return Job{}, ErrNotFound
+	}
+	if job.State != StateFailed {
+		q.mu.Unlock()
+		return Job{}, ErrNotDead
+	}
+	now := time.Now()
+	job.State = StatePending
+	job.Attempts = 0
+	job.NotBefore = now
+	job.UpdatedAt = now
+	q.persist(job)
+	replayed := *job
+	q.mu.Unlock()
+	q.notify()
+	return replayed, nil
+}
+
+// Purge deletes the dead letter id.
+func (q *Queue) Purge(id string) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	job, ok := q.jobs[id]
+	if !ok {
+		return ErrNotFound
+	}
+	if job.State != StateFailed {
+		return ErrNotDead
+	}
+	delete(q.jobs, id)
+	return q.wal.del(id)
+}
+
+// PurgeDeadLetters deletes all dead letters and returns how many were removed.
+func (q *Queue) PurgeDeadLetters() (int, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	n := 0
+	for id, job := range q.jobs {
+		if job.State != StateFailed {
+			continue
+		}
+		delete(q.jobs, id)
+		if err := q.wal.del(id); err != nil {
+			return n, err
+		}
+		n++
+	}
+	return n, nil
+}
+
+// backoff returns the delay before attempt+1: RetryBase doubled per attempt up to RetryMax,
+// with equal jitter.
+func (q *Queue) backoff(attempt int) time.Duration {
+	d := q.opts.RetryBase
+	for i := 1; i < attempt && d < q.opts.RetryMax; i++ {
+		d *= 2
+	}
+	d = min(d, q.opts.RetryMax)
+	return d/2 + rand.N(d/2+1)
+}
+
+// persist writes job to the WAL. Caller holds q.mu.
+func (q *Queue) persist(job *Job) {
+	if err := q.wal.put(job); err != nil {
+		q.reportError(err)
+	}
+}
+
+func (q *Queue) reportError(err error) {
+	if q.opts.OnError != nil {
+		q.opts.OnError(err)
+	}
+}
+
+func (q *Queue) notify() {
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+}
+
+// newID returns a random 128-bit hex job id.
+func newID() string {
+	var b [16]byte
+	_, _ = crand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
@@ -0,0 +1,253 @@
+package queue
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/soulteary/provider-kit"
+)
+
+func waitState(t *testing.T, q *Queue, id string, want State) Job {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		if job, ok := q.Get(id); ok && job.State == want {
+			return job
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	job, _ := q.Get(id)
+	t.Fatalf("job %s state = %s, want %s", id, job.State, want)
+	return job
+}
+
+func TestQueue_DeliversWithRetries(t *testing.T) {
+	q, err := Open(filepath.Join(t.TempDir(), "queue.wal"), Options{MaxAttempts: 3, RetryBase: time.Millisecond, RetryMax: 2 * time.Millisecond})
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	defer func() { _ = q.Close() }()
+	var calls int32
+	q.Start(func(_ context.Context, job Job) (Delivery, error) {
+		if atomic.AddInt32(&calls, 1) < 3 {
+			return Delivery{}, errors.New("busy")
+		}
+		return Delivery{MessageID: "task-" + job.Request.To, UserID: job.Request.To}, nil
+	})
+	job, err := q.Enqueue(provider.HTTPSendRequest{To: "u1", Body: "hi"}, "", time.Time{}, time.Time{})
+	if err != nil {
+		t.Fatalf("Enqueue: %v", err)
+	}
+	done := waitState(t, q, job.ID, StateSucceeded)
+	if done.Attempts != 3 || done.MessageID != "task-u1" || done.UserID != "u1" || done.LastError != "" || len(done.History) != 3 {
+		t.Errorf("job = %+v", done)
+	}
+}
+
+func TestQueue_PermanentAndExhausted(t *testing.T) {
+	q, err := Open(filepath.Join(t.TempDir(), "queue.wal"), Options{MaxAttempts: 2, RetryBase: time.Millisecond, RetryMax: time.Millisecond})
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	defer func() { _ = q.Close() }()
+	q.Start(func(_ context.Context, job Job) (Delivery, error) {
+		if job.Request.To == "bad" {
+			return Delivery{}, Permanent(errors.New("no such user"))
+		}
+		return Delivery{}, errors.New("busy")
+	})
+	bad, _ := q.Enqueue(provider.HTTPSendRequest{To: "bad"}, "", time.Time{}, time.Time{})
+	busy, _ := q.Enqueue(provider.HTTPSendRequest{To: "busy"}, "", time.Time{}, time.Time{})
+	if job := waitState(t, q, bad.ID, StateFailed); job.Attempts != 1 || job.LastError != "no such user" {
+		t.Errorf("permanent failure = %+v, want 1 attempt", job)
+	}
+	if job := waitState(t, q, busy.ID, StateFailed); job.Attempts != 2 {
+		t.Errorf("exhausted = %+v, want 2 attempts", job)
+	}
+}
+
+func TestQueue_SurvivesRestart(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "queue.wal")
+	q, err := Open(path, Options{})
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	job, err := q.Enqueue(provider.HTTPSendRequest{To: "u1", Body: "hi"}, "", time.Time{}, time.Time{})
+	if err != nil {
+		t.Fatalf("Enqueue: %v", err)
+	}
+	// Simulate a crash while the job was being delivered.
+	if claimed, _ := q.claim(time.Now()); claimed == nil || claimed.ID != job.ID {
+		t.Fatalf("claim = %v", claimed)
+	}
+	_ = q.Close()
+
+	q, err = Open(path, Options{})
+	if err != nil {
+		t.Fatalf("reopen: %v", err)
+	}
+	defer func() { _ = q.Close() }()
+	got, ok := q.Get(job.ID)
+	if !ok || got.State != StatePending || got.Request.Body != "hi" || got.Attempts != 1 {
+		t.Fatalf("after restart job = %+v, %v; want pending with request kept", got, ok)
+	}
+	q.Start(func(context.Context, Job) (Delivery, error) { return Delivery{MessageID: "task-1"}, nil })
+	waitState(t, q, job.ID, StateSucceeded)
+}
+
+func TestQueue_PrunesFinishedJobs(t *testing.T) {
+	q, err := Open(filepath.Join(t.TempDir(), "queue.wal"), Options{Retention: time.Minute})
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	defer func() { _ = q.Close() }()
+	job, _ := q.Enqueue(provider.HTTPSendRequest{To: "u1"}, "", time.Time{}, time.Time{})
+	claimed, _ := q.claim(time.Now())
+	q.finish(claimed.ID, Delivery{MessageID: "task-1"}, nil, time.Now())
+	q.claim(time.Now().Add(2 * time.Minute))
+	if _, ok := q.Get(job.ID); ok {
+		t.Error("finished job not pruned after retention")
+	}
+}
+
+func TestQueue_DeadLetterReplayAndPurge(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "queue.wal")
+	q, err := Open(path, Options{MaxAttempts: 1, Retention: time.Minute})
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	a, _ := q.Enqueue(provider.HTTPSendRequest{To: "a"}, "", time.Time{}, time.Time{})
+	b, _ := q.Enqueue(provider.HTTPSendRequest{To: "b"}, "", time.Time{}, time.Time{})
+	for range 2 {
+		claimed, _ := q.claim(time.Now())
+		q.finish(claimed.ID, Delivery{UserID: "uid-" + claimed.Request.To}, errors.New("errcode=60020"), time.Now())
+	}
+	// Dead letters outlive the retention of succeeded jobs and survive a restart.
+	q.claim(time.Now().Add(time.Hour))
+	_ = q.Close()
+	q, err = Open(path, Options{MaxAttempts: 1})
+	if err != nil {
+		t.Fatalf("reopen: %v", err)
+	}
+	defer func() { _ = q.Close() }()
+	dead := q.DeadLetters()
+	if len(dead) != 2 || dead[0].LastError != "errcode=60020" || dead[0].UserID == "" || len(dead[0].History) != 1 {
+		t.Fatalf("DeadLetters = %+v", dead)
+	}
+
+	if _, err := q.Replay("missing"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Replay(missing) = %v, want ErrNotFound", err)
+	}
+	job, err := q.Replay(a.ID)
+	if err != nil || job.State != StatePending || job.Attempts != 0 {
+		t.Fatalf("Replay = %+v, %v", job, err)
+	}
+	if _, err := q.Replay(a.ID); !errors.Is(err, ErrNotDead) {
+		t.Errorf("Replay(pending) = %v, want ErrNotDead", err)
+	}
+	if err := q.Purge(a.ID); !errors.Is(err, ErrNotDead) {
+		t.Errorf("Purge(pending) = %v, want ErrNotDead", err)
+	}
+	if n, err := q.PurgeDeadLetters(); err != nil || n != 1 {
+		t.Errorf("PurgeDeadLetters = %d, %v; want 1", n, err)
+	}
+	if _, ok := q.Get(b.ID); ok {
+		t.Error("purged dead letter still present")
+	}
+}
+
+func TestQueue_ScheduledAndCancel(t *testing.T) {
+	q, err := Open(filepath.Join(t.TempDir(), "queue.wal"), Options{})
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	defer func() { _ = q.Close() }()
+	var delivered int32
+	q.Start(func(context.Context, Job) (Delivery, error) {
+		atomic.AddInt32(&delivered, 1)
+		return Delivery{MessageID: "task"}, nil
+	})
+	soon, _ := q.Enqueue(provider.HTTPSendRequest{To: "u1", IdempotencyKey: "soon"}, "", time.Now().Add(50*time.Millisecond), time.Time{})
+	later, _ := q.Enqueue(provider.HTTPSendRequest{To: "u1", IdempotencyKey: "later"}, "herald-prod", time.Now().Add(time.Hour), time.Time{})
+	if dup, _ := q.Enqueue(provider.HTTPSendRequest{To: "u1", IdempotencyKey: "later"}, "herald-prod", time.Now(), time.Time{}); dup.ID != later.ID {
+		t.Errorf("Enqueue with a pending key = %s, want existing job %s", dup.ID, later.ID)
+	}
+	if job, _ := q.Get(soon.ID); job.State != StatePending {
+		t.Errorf("scheduled job ran early: %s", job.State)
+	}
+	waitState(t, q, soon.ID, StateSucceeded)
+
+	if _, err := q.Cancel("later", "intruder"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Cancel by another caller = %v, want ErrNotFound", err)
+	}
+	canceled, err := q.Cancel("later", "herald-prod")
+	if err != nil || len(canceled) != 1 || canceled[0].State != StateCanceled {
+		t.Fatalf("Cancel = %+v, %v", canceled, err)
+	}
+	if _, err := q.Cancel("soon", ""); !errors.Is(err, ErrNotPending) {
+		t.Errorf("Cancel(delivered) = %v, want ErrNotPending", err)
+	}
+	if _, err := q.Cancel("unknown", ""); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Cancel(unknown) = %v, want ErrNotFound", err)
+	}
+	if got := atomic.LoadInt32(&delivered); got != 1 {
+		t.Errorf("delivered = %d, want 1", got)
+	}
+}
+
+func TestQueue_ExpiredJobsAreDropped(t *testing.T) {
+	q, err := Open(filepath.Join(t.TempDir(), "queue.wal"), Options{RetryBase: time.Hour})
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	defer func() { _ = q.Close() }()
+	now := time.Now()
+	stale, _ := q.Enqueue(provider.HTTPSendRequest{To: "u1"}, "", now.Add(time.Minute), now.Add(30*time.Second))
+	if job, _ := q.claim(now.Add(time.Minute)); job != nil {
+		t.Fatalf("claimed expired job %+v", job)
+	}
+	if job, _ := q.Get(stale.ID); job.State != StateExpired {
+		t.Errorf("state = %s, want expired", job.State)
+	}
+
+	// A failure after the expiry passed ends the job as expired instead of scheduling a retry.
+	late, _ := q.Enqueue(provider.HTTPSendRequest{To: "u2"}, "", time.Time{}, time.Now().Add(20*time.Millisecond))
+	claimed, _ := q.claim(time.Now())
+	if claimed == nil || claimed.ID != late.ID {
+		t.Fatalf("claim = %+v", claimed)
+	}
+	time.Sleep(30 * time.Millisecond)
+	q.finish(late.ID, Delivery{}, errors.New("message expired"), time.Now())
+	if job, _ := q.Get(late.ID); job.State != StateExpired || len(q.DeadLetters()) != 0 {
+		t.Errorf("state = %s, dead letters = %d; want expired and no dead letter", job.State, len(q.DeadLetters()))
+	}
+
+	// A delivery refused as too late ends the job as expired even before ExpiresAt passes.
+	early, _ := q.Enqueue(provider.HTTPSendRequest{To: "u3"}, "", time.Time{}, time.Now().Add(time.Hour))
+	if claimed, _ := q.claim(time.Now()); claimed == nil || claimed.ID != early.ID {
+		t.Fatalf("claim = %+v", claimed)
+	}
+	q.finish(early.ID, Delivery{}, Permanent(Expired(errors.New("message expired"))), time.Now())
+	if job, _ := q.Get(early.ID); job.State != StateExpired || len(q.DeadLetters()) != 0 {
+		t.Errorf("state = %s, dead letters = %d; want expired and no dead letter", job.State, len(q.DeadLetters()))
+	}
+}
+
+func TestQueue_RetryAfter(t *testing.T) {
+	q, err := Open(filepath.Join(t.TempDir(), "queue.wal"), Options{RetryBase: time.Millisecond})
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	defer func() { _ = q.Close() }()
+	job, _ := q.Enqueue(provider.HTTPSendRequest{To: "u1"}, "", time.Time{}, time.Time{})
+	claimed, _ := q.claim(time.Now())
+	q.finish(claimed.ID, Delivery{}, RetryAfter(errors.New("limit"), time.Hour), time.Now())
+	got, _ := q.Get(job.ID)
+	if got.State != StatePending || time.Until(got.NotBefore) < 59*time.Minute || got.LastError != "limit" {
+		t.Errorf("job = %+v, want pending for about an hour", got)
+	}
+}
@@ -0,0 +1,156 @@
+package queue
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+// walRecord is one append-only log record: put stores the full job, del removes it.
+type walRecord struct {
+	Op  string `json:"op"`
+	Job *Job   `json:"job,omitempty"`
+	ID  string `json:"id,omitempty"`
+}
+
+const (
+	opPut = "put"
+	opDel = "del"
+	// compactMin is the minimum number of records before the log is rewritten.
+	compactMin = 1000
+)
+
+// wal is a JSON-lines write-ahead log of job snapshots. Every record is fsynced before the
+// caller proceeds, so an acknowledged job survives a crash. The log is compacted into one
+// put per live job on open and whenever it grows well beyond the live set.
+type wal struct {
+	path    string
+	f       *os.File
+	records int
+}
+
+// openWAL replays path into a map of jobs (last record per id wins) and compacts it.
+// A missing file starts an empty log and a truncated last line (crash mid-write) is ignored, but an
+// unreadable record before the last line is corruption: openWAL fails and leaves the file as is.
+func openWAL(path string) (*wal, map[string]*Job, error) {
+	jobs := make(map[string]*Job)
+	f, err := os.Open(path)
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+	case err != nil:
+		return nil, nil, err
+	default:
+		sc := bufio.NewScanner(f)
+		sc.Buffer(make([]byte, 0, 64*1024), 16*1024*1024)
+		var corrupt error
+		for line := 1; sc.Scan(); line++ {
+			if corrupt != nil {
+				_ = f.Close()
+				return nil, nil, corrupt
+			}
+			var rec walRecord
+			if err := json.Unmarshal(sc.Bytes(), &rec); err != nil {
+				corrupt = fmt.Errorf("queue WAL %s: corrupt record on line %d: %w", path, line, err)
+				continue
+			}
+			switch rec.Op {
+			case opPut:
+				if rec.Job != nil {
+					jobs[rec.Job.ID] = rec.Job
+				}
+			case opDel:
+				delete(jobs, rec.ID)
+			}
+		}
+		err = sc.Err()
+		_ = f.Close()
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	w := &wal{path: path}
+	if err := w.compact(jobs); err != nil {
+		return nil, nil, err
+	}
+	return w, jobs, nil
+}
+
+// put appends a snapshot of job.
+func (w *wal) put(job *Job) error {
+	return w.append(walRecord{Op: opPut, Job: job})
+}
+
+// del appends a removal of id.
+func (w *wal) del(id string) error {
+	return w.append(walRecord{Op: opDel, ID: id})
+}
+
+func (w *wal) append(rec walRecord) error {
+	raw, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	if _, err := w.f.Write(append(raw, '\n')); err != nil {
+		return err
+	}
+	w.records++
+	return w.f.Sync()
+}
+
+// needsCompact reports whether the log holds many more records than live jobs.
+func (w *wal) needsCompact(live int) bool {
+	return w.records > compactMin && w.records > 4*live
+}
+
+// compact atomically rewrites the log with one put per job and reopens it for appending.
+func (w *wal) compact(jobs map[string]*Job) error {
+	if err := os.MkdirAll(filepath.Dir(w.path), 0o700); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(w.path), filepath.Base(w.path)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer func() { _ = os.Remove(tmp.Name()) }()
+	bw := bufio.NewWriter(tmp)
+	for _, job := range jobs {
+		raw, err := json.Marshal(walRecord{Op: opPut, Job: job})
+		if err != nil {
+			_ = tmp.Close()
+			return err
+		}
+		_, _ = bw.Write(append(raw, '\n'))
+	}
+	if err := bw.Flush(); err != nil {
+		_ = tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		_ = tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), w.path); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(w.path, os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		return err
+	}
+	if w.f != nil {
+		_ = w.f.Close()
+	}
+	w.f = f
+	w.records = len(jobs)
+	return nil
+}
+
+func (w *wal) close() error {
+	return w.f.Close()
+}
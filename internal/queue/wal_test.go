@@ -0,0 +1,62 @@
+package queue
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWAL_ReplayAndCompact(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "queue.wal")
+	w, jobs, err := openWAL(path)
+	if err != nil || len(jobs) != 0 {
+		t.Fatalf("openWAL on missing file = %v, %d jobs", err, len(jobs))
+	}
+	a := &Job{ID: "a", State: StatePending, CreatedAt: time.Now()}
+	b := &Job{ID: "b", State: StatePending}
+	for _, err := range []error{w.put(a), w.put(b), w.del("b")} {
+		if err != nil {
+			t.Fatalf("append: %v", err)
+		}
+	}
+	a.State = StateSucceeded
+	if err := w.put(a); err != nil {
+		t.Fatal(err)
+	}
+	_ = w.close()
+
+	// A crash mid-write leaves a truncated last line; it must be ignored.
+	f, _ := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0o600)
+	_, _ = f.WriteString(`{"op":"put","job":{"id":"c"`)
+	_ = f.Close()
+
+	w, jobs, err = openWAL(path)
+	if err != nil {
+		t.Fatalf("reopen: %v", err)
+	}
+	defer func() { _ = w.close() }()
+	if len(jobs) != 1 || jobs["a"] == nil || jobs["a"].State != StateSucceeded {
+		t.Fatalf("replayed jobs = %v, want only a (succeeded)", jobs)
+	}
+	if w.records != 1 {
+		t.Errorf("records after compaction = %d, want 1", w.records)
+	}
+}
+
+func TestWAL_RejectsCorruptionBeforeLastLine(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "queue.wal")
+	content := `{"op":"put","job":{"id":"a","state":"pending"}}` + "\n" +
+		`not json` + "\n" +
+		`{"op":"put","job":{"id":"b","state":"pending"}}` + "\n"
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := openWAL(path); err == nil || !strings.Contains(err.Error(), "line 2") {
+		t.Fatalf("openWAL = %v, want a corrupt record error for line 2", err)
+	}
+	if raw, _ := os.ReadFile(path); string(raw) != content {
+		t.Errorf("corrupt WAL was rewritten:\n%s", raw)
+	}
+}
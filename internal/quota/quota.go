@@ -0,0 +1,121 @@
+package quota
+
+import (
+	"crypto/sha256"
+	"errors"
+	"sync"
+	"time"
+)
+
+// dingtalkDayOffset aligns windows to China Standard Time (UTC+8, no DST), where DingTalk
+// resets its daily work notification limits at midnight.
+const dingtalkDayOffset = 8 * time.Hour
+
+// Errors returned by Reserve. DingTalk silently drops work notifications beyond these limits.
+var (
+	// ErrUserLimit means the user already received the maximum number of messages this window.
+	ErrUserLimit = errors.New("per-user message limit reached")
+	// ErrDuplicate means the user already received identical content this window.
+	ErrDuplicate = errors.New("identical content already sent to this user")
+)
+
+type usage struct {
+	count  int
+	hashes map[[sha256.Size]byte]int
+}
+
+// Limiter tracks, per DingTalk userid, how many work notifications were sent and which
+// contents, in fixed windows (one day by default). All users share the window boundaries,
+// so the whole table is reset when a window ends.
+type Limiter struct {
+	mu     sync.Mutex
+	limit  int
+	window time.Duration
+	dedupe bool
+	cur    int64
+	users  map[string]*usage
+}
+
+// New creates a limiter allowing limit messages per user per window (limit <= 0 = unlimited)
+// and, when dedupe is set, rejecting identical content to the same user within a window.
+func New(limit int, window time.Duration, dedupe bool) *Limiter {
+	if window <= 0 {
+		window = 24 * time.Hour
+	}
+	return &Limiter{limit: limit, window: window, dedupe: dedupe, users: make(map[string]*usage)}
+}
+
+// Reserve counts a send of content to userID at now. If DingTalk would drop it, nothing is
+// counted and the error says why, with how long until the window resets. Call Cancel with the
+// same arguments if the send then fails.
+func (l *Limiter) Reserve(userID, content string, now time.Time) (retryAfter time.Duration, err error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.roll(now)
+	u := l.users[userID]
+	if u == nil {
+		u = &usage{hashes: make(map[[sha256.Size]byte]int)}
+		l.users[userID] = u
+	}
+	sum := sha256.Sum256([]byte(content))
+	switch {
+	case l.dedupe && u.hashes[sum] > 0:
+		return l.untilReset(now), ErrDuplicate
+	case l.limit > 0 && u.count >= l.limit:
+		return l.untilReset(now), ErrUserLimit
+	}
+	u.count++
+	u.hashes[sum]++
+	return 0, nil
+}
+
+// Cancel undoes a Reserve made in the current window.
+func (l *Limiter) Cancel(userID, content string, now time.Time) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.roll(now)
+	u := l.users[userID]
+	if u == nil {
+		return
+	}
+	sum := sha256.Sum256([]byte(content))
+	if u.hashes[sum] == 0 {
+		return
+	}
+	u.count--
+	if u.hashes[sum]--; u.hashes[sum] == 0 {
+		delete(u.hashes, sum)
+	}
+	if u.count == 0 {
+		delete(l.users, userID)
+	}
+}
+
+// Count returns how many sends to userID are counted in the current window.
+func (l *Limiter) Count(userID string, now time.Time) int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.roll(now)
+	if u := l.users[userID]; u != nil {
+		return u.count
+	}
+	return 0
+}
+
+// roll resets the table when now is in a new window. Caller holds l.mu.
+func (l *Limiter) roll(now time.Time) {
+	if w := l.index(now); w != l.cur {
+		l.cur = w
+		clear(l.users)
+	}
+}
+
+func (l *Limiter) index(now time.Time) int64 {
+	return int64(time.Duration(now.UnixNano())+dingtalkDayOffset) / int64(l.window)
+}
+
+// untilReset returns the time from now to the end of the current window.
+func (l *Limiter) untilReset(now time.Time) time.Duration {
+	end := time.Duration((l.index(now)+1)*int64(l.window)) - dingtalkDayOffset
+	return end - time.Duration(now.UnixNano())
+}
@@ -0,0 +1,50 @@
+package quota
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestLimiter_UserLimitAndReset(t *testing.T) {
+	l := New(2, 24*time.Hour, false)
+	// 2026-01-01 23:00 in UTC+8.
+	now := time.Date(2026, 1, 1, 15, 0, 0, 0, time.UTC)
+	for i := range 2 {
+		if _, err := l.Reserve("u1", "msg", now); err != nil {
+			t.Fatalf("reserve %d: %v", i, err)
+		}
+	}
+	retryAfter, err := l.Reserve("u1", "msg", now)
+	if !errors.Is(err, ErrUserLimit) || retryAfter != time.Hour {
+		t.Fatalf("third reserve = %v, %v; want ErrUserLimit with 1h until midnight UTC+8", retryAfter, err)
+	}
+	if _, err := l.Reserve("u2", "msg", now); err != nil {
+		t.Errorf("other user: %v", err)
+	}
+	if _, err := l.Reserve("u1", "msg", now.Add(time.Hour)); err != nil {
+		t.Errorf("after daily reset: %v", err)
+	}
+}
+
+func TestLimiter_DuplicateContentAndCancel(t *testing.T) {
+	l := New(0, time.Hour, true)
+	now := time.Now()
+	if _, err := l.Reserve("u1", "验证码：123456", now); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := l.Reserve("u1", "验证码：123456", now); !errors.Is(err, ErrDuplicate) {
+		t.Fatalf("duplicate = %v, want ErrDuplicate", err)
+	}
+	if _, err := l.Reserve("u1", "验证码：654321", now); err != nil {
+		t.Errorf("different content: %v", err)
+	}
+	// A failed send is not counted by DingTalk, so it must not block the retry.
+	l.Cancel("u1", "验证码：123456", now)
+	if _, err := l.Reserve("u1", "验证码：123456", now); err != nil {
+		t.Errorf("after cancel: %v", err)
+	}
+	if got := l.Count("u1", now); got != 2 {
+		t.Errorf("Count = %d, want 2", got)
+	}
+}
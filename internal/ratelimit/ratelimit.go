@@ -0,0 +1,172 @@
+package ratelimit
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"math"
+	"sync"
+	"time"
+)
+
+// Rule is a token bucket: up to Limit requests at once, refilled at Limit per Window.
+// A zero Limit disables the rule.
+type Rule struct {
+	Limit  int
+	Window time.Duration
+}
+
+// Enabled reports whether the rule limits anything.
+func (r Rule) Enabled() bool {
+	return r.Limit > 0 && r.Window > 0
+}
+
+// interval is the time it takes to refill one token.
+func (r Rule) interval() time.Duration {
+	return r.Window / time.Duration(r.Limit)
+}
+
+// Store keeps token buckets so several replicas (e.g. sharing Redis) enforce one limit.
+type Store interface {
+	// Take removes one token from the bucket for key under rule. It returns 0 when the request
+	// is allowed, or how long until a token is available when it is not.
+	Take(ctx context.Context, key string, rule Rule, now time.Time) (retryAfter time.Duration, err error)
+}
+
+// sweepEvery is how often MemoryStore drops buckets that have refilled completely.
+const sweepEvery = time.Minute
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+	full   time.Time
+}
+
+// MemoryStore is the default process-local Store.
+type MemoryStore struct {
+	mu      sync.Mutex
+	buckets map[string]*bucket
+	swept   time.Time
+}
+
+// NewMemoryStore creates an empty in-memory bucket store.
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{buckets: make(map[string]*bucket)}
+}
+
+// Take implements Store.
+func (m *MemoryStore) Take(_ context.Context, key string, rule Rule, now time.Time) (time.Duration, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if now.Sub(m.swept) >= sweepEvery {
+		m.sweep(now)
+	}
+	limit := float64(rule.Limit)
+	b := m.buckets[key]
+	if b == nil {
+		b = &bucket{tokens: limit, last: now}
+		m.buckets[key] = b
+	} else if now.After(b.last) {
+		b.tokens = math.Min(limit, b.tokens+float64(now.Sub(b.last))/float64(rule.interval()))
+		b.last = now
+	}
+	if b.tokens < 1 {
+		return time.Duration((1 - b.tokens) * float64(rule.interval())), nil
+	}
+	b.tokens--
+	b.full = now.Add(time.Duration((limit - b.tokens) * float64(rule.interval())))
+	return 0, nil
+}
+
+// Len returns the number of tracked buckets.
+func (m *MemoryStore) Len() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return len(m.buckets)
+}
+
+// sweep removes buckets that are full again, which behave exactly like missing ones. Caller holds m.mu.
+func (m *MemoryStore) sweep(now time.Time) {
+	m.swept = now
+	for k, b := range m.buckets {
+		if !now.Before(b.full) {
+			delete(m.buckets, k)
+		}
+	}
+}
+
+// Dimension names what a request was limited by.
+type Dimension string
+
+// Dimensions a Limiter checks, in this order.
+const (
+	DimensionCaller Dimension = "caller"
+	DimensionIP     Dimension = "ip"
+	DimensionTo     Dimension = "to"
+)
+
+// Limits holds one rule per dimension.
+type Limits struct {
+	Caller Rule
+	IP     Rule
+	To     Rule
+}
+
+// Subject identifies a request: the authenticated caller's name (empty when auth is off), client IP
+// and destination.
+type Subject struct {
+	Caller string
+	IP     string
+	To     string
+}
+
+// Limiter applies Limits to requests using a Store.
+type Limiter struct {
+	store  Store
+	limits Limits
+}
+
+// New creates a limiter. Dimensions whose rule is disabled are not checked.
+func New(store Store, limits Limits) *Limiter {
+	return &Limiter{store: store, limits: limits}
+}
+
+// Allow takes a token for each enabled dimension of s. When a bucket is empty it returns that
+// dimension and how long until the request would be allowed; tokens already taken for earlier
+// dimensions are not returned. The caller and destination are hashed before they are used as store
+// keys.
+func (l *Limiter) Allow(ctx context.Context, s Subject, now time.Time) (Dimension, time.Duration, error) {
+	checks := []struct {
+		dim   Dimension
+		rule  Rule
+		value string
+	}{
+		{DimensionCaller, l.limits.Caller, hashKey(s.Caller)},
+		{DimensionIP, l.limits.IP, s.IP},
+		{DimensionTo, l.limits.To, hashKey(s.To)},
+	}
+	for _, chk := range checks {
+		if !chk.rule.Enabled() || chk.value == "" {
+			continue
+		}
+		wait, err := l.store.Take(ctx, string(chk.dim)+":"+chk.value, chk.rule, now)
+		if err != nil {
+			return chk.dim, 0, err
+		}
+		if wait > 0 {
+			return chk.dim, wait, nil
+		}
+	}
+	return "", 0, nil
+}
+
+// hashKey turns a caller name or destination into a short fixed-length store key, so mobiles and
+// userids never reach memory or Redis in the clear and caller names may hold any characters a
+// certificate or JWT put in them.
+func hashKey(value string) string {
+	if value == "" {
+		return ""
+	}
+	sum := sha256.Sum256([]byte(value))
+	return hex.EncodeToString(sum[:8])
+}
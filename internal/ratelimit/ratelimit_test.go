@@ -0,0 +1,101 @@
+package ratelimit
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testStore(t *testing.T, store Store) {
+	t.Helper()
+	ctx := context.Background()
+	rule := Rule{Limit: 2, Window: 10 * time.Second}
+	now := time.Unix(1_700_000_000, 0)
+	for i := range 2 {
+		if wait, err := store.Take(ctx, "a", rule, now); err != nil || wait != 0 {
+			t.Fatalf("take %d: wait=%v err=%v", i, wait, err)
+		}
+	}
+	wait, err := store.Take(ctx, "a", rule, now)
+	if err != nil || wait != 5*time.Second {
+		t.Fatalf("take on empty bucket: wait=%v err=%v, want 5s", wait, err)
+	}
+	if wait, _ := store.Take(ctx, "b", rule, now); wait != 0 {
+		t.Fatalf("other key limited: wait=%v", wait)
+	}
+	if wait, _ := store.Take(ctx, "a", rule, now.Add(2*time.Second)); wait != 3*time.Second {
+		t.Fatalf("partially refilled: wait=%v, want 3s", wait)
+	}
+	if wait, _ := store.Take(ctx, "a", rule, now.Add(5*time.Second)); wait != 0 {
+		t.Fatalf("after one interval: wait=%v, want 0", wait)
+	}
+	if wait, _ := store.Take(ctx, "a", rule, now.Add(5*time.Second)); wait == 0 {
+		t.Fatal("bucket refilled more than one token in one interval")
+	}
+	if wait, _ := store.Take(ctx, "a", rule, now.Add(time.Hour)); wait != 0 {
+		t.Fatalf("long idle: wait=%v, want 0", wait)
+	}
+	if wait, _ := store.Take(ctx, "a", rule, now.Add(time.Hour)); wait != 0 {
+		t.Fatalf("refill must be capped at Limit, not exceed it; second take: wait=%v", wait)
+	}
+	if wait, _ := store.Take(ctx, "a", rule, now.Add(time.Hour)); wait == 0 {
+		t.Fatal("refill exceeded Limit")
+	}
+}
+
+func TestMemoryStore(t *testing.T) {
+	testStore(t, NewMemoryStore())
+}
+
+func TestMemoryStore_SweepsFullBuckets(t *testing.T) {
+	m := NewMemoryStore()
+	rule := Rule{Limit: 1, Window: time.Second}
+	now := time.Unix(1_700_000_000, 0)
+	_, _ = m.Take(context.Background(), "a", rule, now)
+	_, _ = m.Take(context.Background(), "b", rule, now.Add(sweepEvery))
+	if n := m.Len(); n != 1 {
+		t.Fatalf("Len = %d after sweep, want 1 (only the fresh bucket)", n)
+	}
+}
+
+func TestLimiter_Allow(t *testing.T) {
+	store := NewMemoryStore()
+	l := New(store, Limits{
+		Caller: Rule{Limit: 2, Window: time.Minute},
+		IP:     Rule{Limit: 100, Window: time.Minute},
+		To:     Rule{Limit: 1, Window: time.Minute},
+	})
+	ctx := context.Background()
+	now := time.Now()
+	if dim, wait, err := l.Allow(ctx, Subject{Caller: "k", IP: "1.2.3.4", To: "u1"}, now); dim != "" || wait != 0 || err != nil {
+		t.Fatalf("first = %q %v %v, want allowed", dim, wait, err)
+	}
+	dim, wait, _ := l.Allow(ctx, Subject{Caller: "k", IP: "1.2.3.4", To: "u1"}, now)
+	if dim != DimensionTo || wait != time.Minute {
+		t.Fatalf("same to = %q %v, want to/1m", dim, wait)
+	}
+	if dim, _, _ := l.Allow(ctx, Subject{Caller: "k", IP: "1.2.3.4", To: "u2"}, now); dim != DimensionCaller {
+		t.Fatalf("third request for caller = %q, want caller (the limited second one still took a caller token)", dim)
+	}
+	if dim, _, _ := l.Allow(ctx, Subject{Caller: "other", IP: "1.2.3.4", To: "u3"}, now); dim != "" {
+		t.Fatalf("other caller = %q, want allowed", dim)
+	}
+	if dim, _, _ := l.Allow(ctx, Subject{IP: "1.2.3.4", To: "u4"}, now); dim != "" {
+		t.Fatalf("no caller = %q, want allowed (dimension skipped)", dim)
+	}
+	for key := range store.buckets {
+		if strings.Contains(key, "u1") || strings.Contains(key, ":k") {
+			t.Errorf("store key %q holds a raw destination or caller", key)
+		}
+	}
+}
+
+func TestHashKey(t *testing.T) {
+	if hashKey("") != "" {
+		t.Error("empty key must stay empty")
+	}
+	if h := hashKey("secret"); h == "secret" || len(h) != 16 || h != hashKey("secret") {
+		t.Errorf("hashKey(secret) = %q", h)
+	}
+}
@@ -0,0 +1,52 @@
+package ratelimit
+
+import (
+	"context"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// takeScript refills and takes from a token bucket stored as a hash (tokens, ts in unix ms).
+// ARGV: limit, refill interval in ms (may be fractional), now in unix ms. Returns the wait in ms (0 = allowed).
+// The key expires once the bucket would be full again, which is the same as a missing key.
+var takeScript = redis.NewScript(`
+local limit = tonumber(ARGV[1])
+local interval = tonumber(ARGV[2])
+local now = tonumber(ARGV[3])
+local v = redis.call("HMGET", KEYS[1], "tokens", "ts")
+local tokens = tonumber(v[1]) or limit
+local ts = tonumber(v[2]) or now
+if now > ts then
+	tokens = math.min(limit, tokens + (now - ts) / interval)
+	ts = now
+end
+if tokens < 1 then
+	return math.ceil((1 - tokens) * interval)
+end
+tokens = tokens - 1
+redis.call("HSET", KEYS[1], "tokens", tostring(tokens), "ts", tostring(ts))
+redis.call("PEXPIRE", KEYS[1], math.ceil((limit - tokens) * interval))
+return 0`)
+
+// RedisStore is a Store shared by all replicas through Redis. Each bucket is updated atomically by
+// a Lua script; the caller's clock is used, so replicas should be NTP-synced.
+type RedisStore struct {
+	rdb    redis.UniversalClient
+	prefix string
+}
+
+// NewRedisStore creates a Redis-backed bucket store. prefix is prepended to every key.
+func NewRedisStore(rdb redis.UniversalClient, prefix string) *RedisStore {
+	return &RedisStore{rdb: rdb, prefix: prefix}
+}
+
+// Take implements Store.
+func (r *RedisStore) Take(ctx context.Context, key string, rule Rule, now time.Time) (time.Duration, error) {
+	interval := float64(rule.interval()) / float64(time.Millisecond)
+	ms, err := takeScript.Run(ctx, r.rdb, []string{r.prefix + "ratelimit:" + key}, rule.Limit, interval, now.UnixMilli()).Int64()
+	if err != nil {
+		return 0, err
+	}
+	return time.Duration(ms) * time.Millisecond, nil
+}
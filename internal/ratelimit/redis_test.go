@@ -0,0 +1,37 @@
+package ratelimit
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+)
+
+func TestRedisStore(t *testing.T) {
+	mr := miniredis.RunT(t)
+	rdb := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	defer func() { _ = rdb.Close() }()
+	testStore(t, NewRedisStore(rdb, "test:"))
+}
+
+func TestRedisStore_SharedAcrossStores(t *testing.T) {
+	mr := miniredis.RunT(t)
+	rdb := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	defer func() { _ = rdb.Close() }()
+	rule := Rule{Limit: 1, Window: time.Minute}
+	now := time.Now()
+	if wait, err := NewRedisStore(rdb, "p:").Take(context.Background(), "a", rule, now); err != nil || wait != 0 {
+		t.Fatalf("first replica: wait=%v err=%v", wait, err)
+	}
+	if wait, _ := NewRedisStore(rdb, "p:").Take(context.Background(), "a", rule, now); wait == 0 {
+		t.Fatal("second replica was not limited by the shared bucket")
+	}
+	if !mr.Exists("p:ratelimit:a") {
+		t.Fatal("bucket key not stored under prefix")
+	}
+	if ttl := mr.TTL("p:ratelimit:a"); ttl <= 0 || ttl > time.Minute {
+		t.Fatalf("bucket TTL = %v, want (0, 1m]", ttl)
+	}
+}
@@ -0,0 +1,77 @@
+package redact
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseLevel(t *testing.T) {
+	for in, want := range map[string]Level{"": Partial, "off": Off, "Partial": Partial, " full ": Full} {
+		if got, err := ParseLevel(in); got != want || err != nil {
+			t.Errorf("ParseLevel(%q) = %q, %v; want %q", in, got, err, want)
+		}
+	}
+	if _, err := ParseLevel("some"); err == nil {
+		t.Error("expected error for unknown level")
+	}
+}
+
+func TestIdentifiers(t *testing.T) {
+	tests := []struct {
+		fn    func(string, Level) string
+		in    string
+		level Level
+		want  string
+	}{
+		{To, "13812345678", Off, "13812345678"},
+		{To, "13812345678", Partial, "138****5678"},
+		{To, "13812345678", Full, "***"},
+		{To, "+8613812345678", Partial, "+86*******5678"},
+		{To, "manager4521", Partial, "ma***21"},
+		{To, "manager4521", Full, "***"},
+		{To, "abc", Partial, "***"},
+		{To, "", Full, ""},
+		{Mobile, "12345", Partial, "***"},
+		{UserID, "01234567", Partial, "01***67"},
+		{Secret, "auth-code-123", Partial, "***"},
+		{Secret, "auth-code-123", Off, "auth-code-123"},
+		{Body, "您的验证码是 123456", Off, "您的验证码是 123456"},
+		{Body, "code 123456", Partial, "[11 bytes]"},
+		{Body, "code 123456", Full, "[11 bytes]"},
+	}
+	for _, tt := range tests {
+		if got := tt.fn(tt.in, tt.level); got != tt.want {
+			t.Errorf("(%q, %s) = %q, want %q", tt.in, tt.level, got, tt.want)
+		}
+	}
+}
+
+func TestURL(t *testing.T) {
+	tests := map[string]string{
+		"https://oapi.dingtalk.com/topapi/v2/user/getbymobile?access_token=tok123&mobile=13812345678": "https://oapi.dingtalk.com/topapi/v2/user/getbymobile?access_token=%2A%2A%2A&mobile=%2A%2A%2A",
+		"https://oapi.dingtalk.com/gettoken?appkey=key&appsecret=s3cret":                              "https://oapi.dingtalk.com/gettoken?appkey=key&appsecret=%2A%2A%2A",
+		"https://api.dingtalk.com/v1.0/contact/users/me":                                              "https://api.dingtalk.com/v1.0/contact/users/me",
+		"https://example.com/?q=1":                                                                    "https://example.com/?q=1",
+	}
+	for in, want := range tests {
+		got := URL(in)
+		if got != want {
+			t.Errorf("URL(%q) = %q, want %q", in, got, want)
+		}
+		for _, secret := range []string{"tok123", "s3cret", "13812345678"} {
+			if strings.Contains(got, secret) {
+				t.Errorf("URL(%q) still contains %q", in, secret)
+			}
+		}
+	}
+}
+
+func TestHash(t *testing.T) {
+	if Hash("") != "" {
+		t.Error("Hash of empty must stay empty")
+	}
+	h := Hash("13812345678")
+	if len(h) != 16 || strings.Contains(h, "1381234") || h != Hash("13812345678") || h == Hash("13812345679") {
+		t.Errorf("Hash(13812345678) = %q", h)
+	}
+}
@@ -3,39 +3,95 @@ package router
 import (
 	"github.com/gofiber/fiber/v2"
 	"github.com/soulteary/health-kit"
-	"github.com/soulteary/herald-dingtalk/internal/config"
+	"github.com/soulteary/herald-dingtalk/internal/auth"
 	"github.com/soulteary/herald-dingtalk/internal/dingtalk"
 	"github.com/soulteary/herald-dingtalk/internal/handler"
 	"github.com/soulteary/herald-dingtalk/internal/idempotency"
+	"github.com/soulteary/herald-dingtalk/internal/metrics"
 	"github.com/soulteary/logger-kit"
 	"github.com/soulteary/provider-kit"
 )
 
-// Setup mounts routes. dingtalkClient and idemStore can be nil if config invalid (send will return 503).
-func Setup(app *fiber.App, log *logger.Logger) {
-	idemStore := idempotency.NewStore(config.IdemTTLSec)
-	var dingtalkClient *dingtalk.Client
-	if config.Valid() {
-		dingtalkClient = dingtalk.NewClient(config.AppKey, config.AppSecret, config.AgentID)
+// route is an authenticated /v1 endpoint. Responses of routes with a metric name are recorded
+// by handler.Instrument under that name.
+type route struct {
+	method, path string
+	scope        auth.Scope
+	metric       string
+	handler      fiber.Handler
+}
+
+// Setup mounts routes. dingtalkClient, idemStore and the dependencies in opts (queue, quota, keys, ...) are owned
+// by the caller (started/stopped in main). dingtalkClient is nil if config invalid (send will return 503).
+// Every /v1 route is guarded by handler.Authenticate for its scope; /healthz is public, and so is
+// /metrics (served with handler.WithMetrics) unless requireMetricsAuth is set.
+func Setup(app *fiber.App, log *logger.Logger, dingtalkClient *dingtalk.Client, idemStore *idempotency.Store, requireMetricsAuth bool, opts ...handler.Option) {
+	app.Use(handler.TrackInFlight(opts...))
+	routes := []route{
+		{fiber.MethodPost, "/send", auth.ScopeSend, metrics.RouteSend, func(c *fiber.Ctx) error {
+			if dingtalkClient == nil {
+				log.Warn().Msg("send 503: dingtalk not configured")
+				return c.Status(fiber.StatusServiceUnavailable).JSON(provider.HTTPSendResponse{
+					OK: false, ErrorCode: "provider_down", ErrorMessage: "dingtalk not configured",
+				})
+			}
+			return handler.SendHandler(c, dingtalkClient, idemStore, log, opts...)
+		}},
+		{fiber.MethodGet, "/jobs/:id", auth.ScopeSend, "", func(c *fiber.Ctx) error {
+			return handler.JobHandler(c, log, opts...)
+		}},
+		{fiber.MethodPost, "/resolve", auth.ScopeResolve, metrics.RouteResolve, func(c *fiber.Ctx) error {
+			if dingtalkClient == nil {
+				log.Warn().Msg("resolve 503: dingtalk not configured")
+				return c.Status(fiber.StatusServiceUnavailable).JSON(fiber.Map{
+					"ok": false, "error_code": "provider_down", "error_message": "dingtalk not configured",
+				})
+			}
+			return handler.ResolveHandler(c, dingtalkClient, log)
+		}},
+		{fiber.MethodDelete, "/scheduled/:key", auth.ScopeSend, "", func(c *fiber.Ctx) error {
+			return handler.CancelScheduledHandler(c, log, opts...)
+		}},
+		{fiber.MethodGet, "/admin/dead-letters", auth.ScopeAdmin, "", func(c *fiber.Ctx) error {
+			return handler.DeadLettersHandler(c, log, opts...)
+		}},
+		{fiber.MethodGet, "/admin/dead-letters/:id", auth.ScopeAdmin, "", func(c *fiber.Ctx) error {
+			return handler.DeadLetterHandler(c, log, opts...)
+		}},
+		{fiber.MethodPost, "/admin/dead-letters/:id/replay", auth.ScopeAdmin, "", func(c *fiber.Ctx) error {
+			return handler.ReplayDeadLetterHandler(c, log, opts...)
+		}},
+		{fiber.MethodDelete, "/admin/dead-letters/:id?", auth.ScopeAdmin, "", func(c *fiber.Ctx) error {
+			return handler.PurgeDeadLettersHandler(c, log, opts...)
+		}},
+		{fiber.MethodGet, "/idempotency/stats", auth.ScopeAdmin, "", func(c *fiber.Ctx) error {
+			return handler.IdempotencyStatsHandler(c, idemStore)
+		}},
 	}
 	v1 := app.Group("/v1")
-	v1.Post("/send", func(c *fiber.Ctx) error {
-		if dingtalkClient == nil {
-			log.Warn().Msg("send 503: dingtalk not configured")
-			return c.Status(fiber.StatusServiceUnavailable).JSON(provider.HTTPSendResponse{
-				OK: false, ErrorCode: "provider_down", ErrorMessage: "dingtalk not configured",
-			})
+	for _, r := range routes {
+		handlers := []fiber.Handler{handler.Authenticate(r.scope, log, opts...), r.handler}
+		if r.metric != "" {
+			handlers = append([]fiber.Handler{handler.Instrument(r.metric, opts...)}, handlers...)
 		}
-		return handler.SendHandler(c, dingtalkClient, idemStore, log)
-	})
-	v1.Post("/resolve", func(c *fiber.Ctx) error {
-		if dingtalkClient == nil {
-			log.Warn().Msg("resolve 503: dingtalk not configured")
-			return c.Status(fiber.StatusServiceUnavailable).JSON(fiber.Map{
-				"ok": false, "error_code": "provider_down", "error_message": "dingtalk not configured",
-			})
-		}
-		return handler.ResolveHandler(c, dingtalkClient, log)
+		v1.Add(r.method, r.path, handlers...)
+	}
+	// Unknown /v1 paths need admin credentials too, so probing does not reveal which routes exist.
+	v1.Use(handler.Authenticate(auth.ScopeAdmin, log, opts...))
+
+	metricsHandlers := []fiber.Handler{func(c *fiber.Ctx) error {
+		return handler.MetricsHandler(c, opts...)
+	}}
+	if requireMetricsAuth {
+		metricsHandlers = append([]fiber.Handler{handler.Authenticate(auth.ScopeMetrics, log, opts...)}, metricsHandlers...)
+	}
+	app.Get("/metrics", metricsHandlers...)
+
+	if dingtalkClient == nil {
+		app.Get("/healthz", health.SimpleFiberHandler("herald-dingtalk"))
+		return
+	}
+	app.Get("/healthz", func(c *fiber.Ctx) error {
+		return handler.HealthHandler(c, dingtalkClient)
 	})
-	app.Get("/healthz", health.SimpleFiberHandler("herald-dingtalk"))
 }
@@ -0,0 +1,128 @@
+package router
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/soulteary/herald-dingtalk/internal/auth"
+	"github.com/soulteary/herald-dingtalk/internal/handler"
+	"github.com/soulteary/herald-dingtalk/internal/idempotency"
+	"github.com/soulteary/herald-dingtalk/internal/metrics"
+	"github.com/soulteary/logger-kit"
+)
+
+func TestSetup_EveryV1RouteRequiresAuth(t *testing.T) {
+	keys, err := auth.NewKeyRing("", auth.Key{Name: "herald-prod", Key: "send-key", Scopes: []auth.Scope{auth.ScopeSend}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	app := fiber.New()
+	Setup(app, logger.New(logger.Config{Level: logger.ErrorLevel}), nil, idempotency.NewStore(300), false, handler.WithKeyRing(keys))
+
+	for _, r := range app.GetRoutes(true) {
+		if r.Method == fiber.MethodHead || r.Path == "/healthz" || r.Path == "/metrics" {
+			continue
+		}
+		req := httptest.NewRequest(r.Method, r.Path, nil)
+		resp, err := app.Test(req)
+		if err != nil {
+			t.Fatalf("app.Test: %v", err)
+		}
+		_ = resp.Body.Close()
+		if resp.StatusCode != http.StatusUnauthorized {
+			t.Errorf("%s %s without credentials = %d, want 401", r.Method, r.Path, resp.StatusCode)
+		}
+	}
+
+	tests := []struct {
+		method, path string
+		want         int
+	}{
+		{http.MethodGet, "/healthz", http.StatusOK},
+		{http.MethodGet, "/v1/jobs/unknown", http.StatusNotFound},
+		{http.MethodGet, "/v1/idempotency/stats", http.StatusForbidden},
+		{http.MethodGet, "/v1/no-such-route", http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(tt.method, tt.path, nil)
+		req.Header.Set("X-API-Key", "send-key")
+		resp, err := app.Test(req)
+		if err != nil {
+			t.Fatalf("app.Test: %v", err)
+		}
+		_ = resp.Body.Close()
+		if resp.StatusCode != tt.want {
+			t.Errorf("%s %s with send key = %d, want %d", tt.method, tt.path, resp.StatusCode, tt.want)
+		}
+	}
+}
+
+func TestSetup_Metrics(t *testing.T) {
+	keys, err := auth.NewKeyRing("",
+		auth.Key{Name: "herald-prod", Key: "send-key", Scopes: []auth.Scope{auth.ScopeSend}},
+		auth.Key{Name: "prometheus", Key: "scrape-key", Scopes: []auth.Scope{auth.ScopeMetrics}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	get := func(app *fiber.App, path, key string) (int, string) {
+		t.Helper()
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		if key != "" {
+			req.Header.Set("X-API-Key", key)
+		}
+		resp, err := app.Test(req)
+		if err != nil {
+			t.Fatalf("app.Test: %v", err)
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		return resp.StatusCode, string(body)
+	}
+	log := logger.New(logger.Config{Level: logger.ErrorLevel})
+
+	disabled := fiber.New()
+	Setup(disabled, log, nil, idempotency.NewStore(300), false, handler.WithKeyRing(keys))
+	if status, _ := get(disabled, "/metrics", ""); status != http.StatusNotFound {
+		t.Errorf("GET /metrics without WithMetrics = %d, want 404", status)
+	}
+
+	m := metrics.New()
+	public := fiber.New()
+	Setup(public, log, nil, idempotency.NewStore(300), false, handler.WithKeyRing(keys), handler.WithMetrics(m))
+	for _, key := range []string{"", "send-key"} {
+		req := httptest.NewRequest(http.MethodPost, "/v1/send", strings.NewReader(`{"to":"13800138000"}`))
+		if key != "" {
+			req.Header.Set("X-API-Key", key)
+		}
+		resp, err := public.Test(req)
+		if err != nil {
+			t.Fatalf("app.Test: %v", err)
+		}
+		_ = resp.Body.Close()
+	}
+	status, body := get(public, "/metrics", "")
+	if status != http.StatusOK {
+		t.Fatalf("GET /metrics = %d, want 200", status)
+	}
+	if !strings.Contains(body, `herald_dingtalk_requests_total{caller="anonymous",error_code="unauthorized",route="send"} 1`) {
+		t.Errorf("rejected send not recorded:\n%s", body)
+	}
+	if !strings.Contains(body, `herald_dingtalk_requests_total{caller="herald-prod",error_code="provider_down",route="send"} 1`) {
+		t.Errorf("send by herald-prod not recorded under its caller name:\n%s", body)
+	}
+	if strings.Contains(body, "13800138000") {
+		t.Errorf("metrics leak the destination:\n%s", body)
+	}
+
+	guarded := fiber.New()
+	Setup(guarded, log, nil, idempotency.NewStore(300), true, handler.WithKeyRing(keys), handler.WithMetrics(m))
+	for key, want := range map[string]int{"": http.StatusUnauthorized, "send-key": http.StatusForbidden, "scrape-key": http.StatusOK} {
+		if status, _ := get(guarded, "/metrics", key); status != want {
+			t.Errorf("GET /metrics with key %q = %d, want %d", key, status, want)
+		}
+	}
+}
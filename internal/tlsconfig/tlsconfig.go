@@ -0,0 +1,146 @@
+package tlsconfig
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// DefaultCheckInterval is how often CertReloader looks for a renewed certificate.
+const DefaultCheckInterval = 10 * time.Second
+
+// ClientAuth modes for mutual TLS.
+const (
+	// ClientAuthRequire rejects connections without a client certificate signed by the CA.
+	ClientAuthRequire = "require"
+	// ClientAuthOptional verifies a client certificate if one is sent, and allows none.
+	ClientAuthOptional = "optional"
+)
+
+// CertReloader serves a certificate/key pair from files and picks up renewed files (e.g. from
+// cert-manager or certbot) without a restart. If a renewed pair cannot be loaded the previous
+// one keeps being served.
+type CertReloader struct {
+	certFile, keyFile string
+	interval          time.Duration
+	// OnError, if set, is called when a changed pair fails to load.
+	OnError func(error)
+
+	mu      sync.Mutex
+	cert    *tls.Certificate
+	modTime time.Time
+	checked time.Time
+}
+
+// NewCertReloader loads the pair once and returns a reloader that checks the files' modification
+// times at most every interval (<= 0 means DefaultCheckInterval).
+func NewCertReloader(certFile, keyFile string, interval time.Duration) (*CertReloader, error) {
+	if interval <= 0 {
+		interval = DefaultCheckInterval
+	}
+	r := &CertReloader{certFile: certFile, keyFile: keyFile, interval: interval}
+	mod, err := r.modified()
+	if err != nil {
+		return nil, err
+	}
+	if err := r.load(mod); err != nil {
+		return nil, err
+	}
+	r.checked = time.Now()
+	return r, nil
+}
+
+// GetCertificate implements tls.Config.GetCertificate.
+func (r *CertReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if now := time.Now(); now.Sub(r.checked) >= r.interval {
+		r.checked = now
+		if err := r.reloadIfChanged(); err != nil && r.OnError != nil {
+			r.OnError(err)
+		}
+	}
+	return r.cert, nil
+}
+
+// reloadIfChanged reloads the pair when either file is newer than the loaded one. Caller holds r.mu.
+func (r *CertReloader) reloadIfChanged() error {
+	mod, err := r.modified()
+	if err != nil {
+		return err
+	}
+	if !mod.After(r.modTime) {
+		return nil
+	}
+	return r.load(mod)
+}
+
+// load parses the pair and installs it. Caller holds r.mu (or owns r).
+func (r *CertReloader) load(mod time.Time) error {
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return fmt.Errorf("load TLS certificate: %w", err)
+	}
+	r.cert = &cert
+	r.modTime = mod
+	return nil
+}
+
+// modified returns the later modification time of the two files.
+func (r *CertReloader) modified() (time.Time, error) {
+	var latest time.Time
+	for _, f := range []string{r.certFile, r.keyFile} {
+		st, err := os.Stat(f)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if st.ModTime().After(latest) {
+			latest = st.ModTime()
+		}
+	}
+	return latest, nil
+}
+
+// Server returns a TLS 1.2+ server config serving certificates from r. With a non-empty
+// clientCAFile, client certificates are verified against that CA bundle: required or, with
+// clientAuth ClientAuthOptional, only when sent.
+func Server(r *CertReloader, clientCAFile, clientAuth string) (*tls.Config, error) {
+	cfg := &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: r.GetCertificate,
+	}
+	if clientCAFile == "" {
+		return cfg, nil
+	}
+	pem, err := os.ReadFile(clientCAFile)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, errors.New("no certificates found in " + clientCAFile)
+	}
+	cfg.ClientCAs = pool
+	switch clientAuth {
+	case ClientAuthRequire, "":
+		cfg.ClientAuth = tls.RequireAndVerifyClientCert
+	case ClientAuthOptional:
+		cfg.ClientAuth = tls.VerifyClientCertIfGiven
+	default:
+		return nil, fmt.Errorf("unknown client auth mode %q", clientAuth)
+	}
+	return cfg, nil
+}
+
+// PeerCommonName returns the subject common name of the verified client certificate, or "" if
+// the connection has none (plain HTTP, or no client certificate was sent).
+func PeerCommonName(state *tls.ConnectionState) string {
+	if state == nil || len(state.VerifiedChains) == 0 || len(state.VerifiedChains[0]) == 0 {
+		return ""
+	}
+	return state.VerifiedChains[0][0].Subject.CommonName
+}
@@ -0,0 +1,196 @@
+package tlsconfig
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pem  []byte
+}
+
+func newCA(t *testing.T) testCA {
+	t.Helper()
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test-ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	return testCA{cert: cert, key: key, pem: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})}
+}
+
+// issue returns PEM cert and key for cn signed by ca.
+func (ca testCA) issue(t *testing.T, cn string, serial int64, usage x509.ExtKeyUsage) ([]byte, []byte) {
+	t.Helper()
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: cn},
+		DNSNames:     []string{"localhost"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, _ := x509.MarshalECPrivateKey(key)
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+}
+
+func writeFile(t *testing.T, path string, data []byte, mod time.Time) {
+	t.Helper()
+	if err := os.WriteFile(path, data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(path, mod, mod); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCertReloader_PicksUpRenewedPair(t *testing.T) {
+	ca := newCA(t)
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "tls.crt"), filepath.Join(dir, "tls.key")
+	c1, k1 := ca.issue(t, "v1", 2, x509.ExtKeyUsageServerAuth)
+	mod := time.Now().Add(-time.Minute)
+	writeFile(t, certFile, c1, mod)
+	writeFile(t, keyFile, k1, mod)
+
+	var loadErr error
+	r, err := NewCertReloader(certFile, keyFile, time.Millisecond)
+	if err != nil {
+		t.Fatalf("NewCertReloader: %v", err)
+	}
+	r.OnError = func(err error) { loadErr = err }
+	leafCN := func() string {
+		time.Sleep(2 * time.Millisecond)
+		cert, _ := r.GetCertificate(nil)
+		leaf, _ := x509.ParseCertificate(cert.Certificate[0])
+		return leaf.Subject.CommonName
+	}
+	if cn := leafCN(); cn != "v1" {
+		t.Fatalf("initial CN = %q", cn)
+	}
+
+	// A half-written renewal (new cert, old key) is rejected and v1 keeps being served.
+	c2, k2 := ca.issue(t, "v2", 3, x509.ExtKeyUsageServerAuth)
+	writeFile(t, certFile, c2, mod.Add(time.Second))
+	if cn := leafCN(); cn != "v1" || loadErr == nil {
+		t.Fatalf("mismatched pair: CN = %q, err = %v; want v1 and an error", cn, loadErr)
+	}
+	writeFile(t, keyFile, k2, mod.Add(2*time.Second))
+	if cn := leafCN(); cn != "v2" {
+		t.Fatalf("after renewal CN = %q, want v2", cn)
+	}
+
+	if _, err := NewCertReloader(filepath.Join(dir, "missing"), keyFile, 0); err == nil {
+		t.Error("expected error for missing certificate file")
+	}
+}
+
+func TestServer_MutualTLS(t *testing.T) {
+	ca := newCA(t)
+	dir := t.TempDir()
+	certFile, keyFile, caFile := filepath.Join(dir, "tls.crt"), filepath.Join(dir, "tls.key"), filepath.Join(dir, "ca.pem")
+	sc, sk := ca.issue(t, "server", 2, x509.ExtKeyUsageServerAuth)
+	writeFile(t, certFile, sc, time.Now())
+	writeFile(t, keyFile, sk, time.Now())
+	writeFile(t, caFile, ca.pem, time.Now())
+	r, err := NewCertReloader(certFile, keyFile, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientPEM, clientKey := ca.issue(t, "herald-prod", 3, x509.ExtKeyUsageClientAuth)
+	clientCert, err := tls.X509KeyPair(clientPEM, clientKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+
+	for _, mode := range []string{ClientAuthRequire, ClientAuthOptional} {
+		cfg, err := Server(r, caFile, mode)
+		if err != nil {
+			t.Fatalf("Server(%s): %v", mode, err)
+		}
+		ln, err := tls.Listen("tcp", "127.0.0.1:0", cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		peers := make(chan string, 4)
+		go func() {
+			for {
+				conn, err := ln.Accept()
+				if err != nil {
+					return
+				}
+				tc := conn.(*tls.Conn)
+				if tc.Handshake() != nil {
+					peers <- "handshake failed"
+				} else {
+					state := tc.ConnectionState()
+					peers <- PeerCommonName(&state)
+				}
+				_ = conn.Close()
+			}
+		}()
+		dial := func(certs []tls.Certificate) string {
+			conn, err := tls.Dial("tcp", ln.Addr().String(), &tls.Config{RootCAs: roots, Certificates: certs})
+			if err == nil {
+				_, _ = conn.Read(make([]byte, 1))
+				_ = conn.Close()
+			}
+			return <-peers
+		}
+		if cn := dial([]tls.Certificate{clientCert}); cn != "herald-prod" {
+			t.Errorf("%s with client cert: peer CN = %q, want herald-prod", mode, cn)
+		}
+		want := map[string]string{ClientAuthRequire: "handshake failed", ClientAuthOptional: ""}[mode]
+		if cn := dial(nil); cn != want {
+			t.Errorf("%s without client cert: peer = %q, want %q", mode, cn, want)
+		}
+		_ = ln.Close()
+	}
+
+	if _, err := Server(r, caFile, "sometimes"); err == nil {
+		t.Error("expected error for unknown client auth mode")
+	}
+	writeFile(t, filepath.Join(dir, "empty.pem"), []byte("nothing"), time.Now())
+	if _, err := Server(r, filepath.Join(dir, "empty.pem"), ClientAuthRequire); err == nil {
+		t.Error("expected error for CA file without certificates")
+	}
+	if cfg, err := Server(r, "", ""); err != nil || cfg.ClientAuth != tls.NoClientCert {
+		t.Errorf("no CA: %v, ClientAuth = %v", err, cfg.ClientAuth)
+	}
+	if PeerCommonName(nil) != "" {
+		t.Error("PeerCommonName(nil) should be empty")
+	}
+}
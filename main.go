@@ -2,6 +2,9 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
+	"errors"
+	"net"
 	"os"
 	"os/signal"
 	"strings"
@@ -11,8 +14,19 @@ import (
 	"github.com/gofiber/fiber/v2"
 	"github.com/pterm/pterm"
 	"github.com/pterm/pterm/putils"
+	"github.com/redis/go-redis/v9"
+	"github.com/soulteary/herald-dingtalk/internal/auth"
 	"github.com/soulteary/herald-dingtalk/internal/config"
+	"github.com/soulteary/herald-dingtalk/internal/dingtalk"
+	"github.com/soulteary/herald-dingtalk/internal/handler"
+	"github.com/soulteary/herald-dingtalk/internal/idempotency"
+	"github.com/soulteary/herald-dingtalk/internal/metrics"
+	"github.com/soulteary/herald-dingtalk/internal/queue"
+	"github.com/soulteary/herald-dingtalk/internal/quota"
+	"github.com/soulteary/herald-dingtalk/internal/ratelimit"
+	"github.com/soulteary/herald-dingtalk/internal/redact"
 	"github.com/soulteary/herald-dingtalk/internal/router"
+	"github.com/soulteary/herald-dingtalk/internal/tlsconfig"
 	"github.com/soulteary/logger-kit"
 	version "github.com/soulteary/version-kit"
 )
@@ -40,6 +54,19 @@ func main() {
 		ServiceVersion: version.Version,
 	})
 
+	redaction, err := redact.ParseLevel(config.LogRedaction)
+	if err != nil {
+		log.Fatal().Err(err).Msg("invalid LOG_REDACTION")
+	}
+	config.LogRedaction = string(redaction)
+	if redaction == redact.Off {
+		log.Warn().Msg("LOG_REDACTION=off: logs contain mobiles, userids, auth codes and message bodies")
+	}
+
+	if err := config.Validate(); err != nil {
+		log.Fatal().Err(err).Msg("invalid configuration")
+	}
+
 	port := config.Port
 	if !strings.HasPrefix(port, ":") {
 		port = ":" + port
@@ -47,15 +74,194 @@ func main() {
 	if !config.Valid() {
 		log.Warn().Msg("DINGTALK_APP_KEY / DINGTALK_APP_SECRET / DINGTALK_AGENT_ID not set; /v1/send will return 503")
 	}
-	app := fiber.New(fiber.Config{DisableStartupMessage: false})
-	router.Setup(app, log)
+	idemStore := idempotency.NewStoreWithLimit(config.IdemTTLSec, config.IdemMaxEntries)
+	if config.IdemPersistFile != "" {
+		n, err := idemStore.LoadFile(config.IdemPersistFile)
+		if err != nil {
+			log.Warn().Err(err).Str("file", config.IdemPersistFile).Msg("idempotency snapshot load failed; starting empty")
+		} else {
+			log.Info().Int("entries", n).Str("file", config.IdemPersistFile).Msg("idempotency snapshot loaded")
+		}
+	}
+	idemStore.StartJanitor(time.Duration(config.IdemSweepSec) * time.Second)
+
+	var appMetrics *metrics.Metrics
+	if config.MetricsEnabled {
+		appMetrics = metrics.New()
+		appMetrics.TrackIdempotency(idemStore)
+	}
+
+	var rdb *redis.Client
+	if config.RedisURL != "" {
+		opt, err := redis.ParseURL(config.RedisURL)
+		if err != nil {
+			log.Fatal().Err(err).Msg("invalid REDIS_URL")
+		}
+		rdb = redis.NewClient(opt)
+	}
+
+	var dingtalkClient *dingtalk.Client
+	if config.Valid() {
+		dingtalkClient = dingtalk.NewClient(config.AppKey, config.AppSecret, config.AgentID)
+		if config.TokenCache == config.TokenCacheRedis {
+			if rdb == nil {
+				log.Fatal().Msg("DINGTALK_TOKEN_CACHE=redis requires REDIS_URL")
+			}
+			dingtalkClient.SetTokenCache(dingtalk.NewRedisTokenCache(rdb, config.RedisKeyPrefix))
+		}
+		dingtalkClient.SetRetryPolicy(dingtalk.RetryPolicy{
+			MaxAttempts: config.RetryMaxAttempts,
+			BaseDelay:   time.Duration(config.RetryBaseDelayMs) * time.Millisecond,
+			MaxDelay:    time.Duration(config.RetryMaxDelayMs) * time.Millisecond,
+			MaxElapsed:  time.Duration(config.RetryMaxElapsedMs) * time.Millisecond,
+		})
+		dingtalkClient.SetBreaker(config.BreakerThreshold, time.Duration(config.BreakerOpenSec)*time.Second)
+		dingtalkClient.SetRateLimit(dingtalk.RateClassSend, float64(config.QPSSend), config.QPSSend)
+		dingtalkClient.SetRateLimit(dingtalk.RateClassLookup, float64(config.QPSLookup), config.QPSLookup)
+		dingtalkClient.SetRateLimit(dingtalk.RateClassOAuth, float64(config.QPSOAuth), config.QPSOAuth)
+		dingtalkClient.SetAttemptObserver(func(endpoint string, attempt int, err error, elapsed time.Duration, willRetry bool) {
+			if appMetrics != nil {
+				appMetrics.ObserveAttempt(endpoint, attempt, err, elapsed, willRetry)
+			}
+			if err == nil {
+				if attempt > 1 {
+					log.Info().Str("endpoint", endpoint).Int("attempt", attempt).Dur("elapsed", elapsed).Msg("dingtalk call succeeded after retry")
+				}
+				return
+			}
+			log.Warn().Err(err).Str("endpoint", endpoint).Int("attempt", attempt).Dur("elapsed", elapsed).Bool("will_retry", willRetry).Msg("dingtalk call attempt failed")
+		})
+		if config.TokenRefreshAheadSec > 0 {
+			dingtalkClient.StartTokenRefresher(
+				time.Duration(config.TokenRefreshAheadSec)*time.Second,
+				time.Duration(config.TokenRefreshJitterSec)*time.Second,
+			)
+		}
+	}
+
+	var keys *auth.KeyRing
+	if config.APIKeysFile != "" {
+		keys, err = auth.LoadKeyRing(config.APIKeysFile, config.APIKey)
+	} else {
+		keys, err = auth.NewKeyRing(config.APIKey)
+	}
+	if err != nil {
+		log.Fatal().Err(err).Str("file", config.APIKeysFile).Msg("invalid API keys")
+	}
+	var jwtVerifier *auth.JWTVerifier
+	if config.JWTJWKSFile != "" || config.JWTPublicKeyFile != "" {
+		jwtVerifier, err = auth.NewJWTVerifier(auth.JWTConfig{
+			JWKSFile:      config.JWTJWKSFile,
+			PublicKeyFile: config.JWTPublicKeyFile,
+			Issuer:        config.JWTIssuer,
+			Audience:      config.JWTAudience,
+			ScopeClaim:    config.JWTScopeClaim,
+			ScopePrefix:   config.JWTScopePrefix,
+			CallerClaim:   config.JWTCallerClaim,
+			Leeway:        time.Duration(config.JWTLeewaySec) * time.Second,
+		})
+		if err != nil {
+			log.Fatal().Err(err).Msg("invalid JWT configuration")
+		}
+		log.Info().Str("issuer", config.JWTIssuer).Str("audience", config.JWTAudience).Msg("JWT bearer authentication enabled")
+	}
+	switch {
+	case keys.Enabled():
+		log.Info().Strs("callers", keys.Names()).Msg("API keys loaded")
+	case jwtVerifier == nil:
+		log.Warn().Msg("API_KEY / API_KEYS_FILE not set; endpoints accept unauthenticated requests")
+	}
+	handlerOpts := []handler.Option{handler.WithKeyRing(keys)}
+	if appMetrics != nil {
+		handlerOpts = append(handlerOpts, handler.WithMetrics(appMetrics))
+	}
+	if jwtVerifier != nil {
+		handlerOpts = append(handlerOpts, handler.WithJWT(jwtVerifier))
+	}
+	if config.RequestSigning != config.RequestSigningOff {
+		var nonces auth.NonceStore = auth.NewMemoryNonceStore()
+		if config.RequestSigningNonceStore == config.NonceStoreRedis {
+			if rdb == nil {
+				log.Fatal().Msg("REQUEST_SIGNING_NONCE_STORE=redis requires REDIS_URL")
+			}
+			nonces = auth.NewRedisNonceStore(rdb, config.RedisKeyPrefix)
+		}
+		verifier := auth.NewVerifier(keys, nonces, time.Duration(config.RequestSigningMaxSkewSec)*time.Second)
+		handlerOpts = append(handlerOpts, handler.WithSignatures(verifier, config.RequestSigning == config.RequestSigningRequired))
+		log.Info().Str("mode", config.RequestSigning).Msg("HMAC request signing enabled")
+	}
+	if config.QuotaPerUser > 0 || config.QuotaDedupContent {
+		handlerOpts = append(handlerOpts, handler.WithQuota(quota.New(
+			config.QuotaPerUser, time.Duration(config.QuotaWindowSec)*time.Second, config.QuotaDedupContent,
+		)))
+	}
+	var limitStore ratelimit.Store = ratelimit.NewMemoryStore()
+	if config.RateLimitStore == config.RateLimitStoreRedis {
+		if rdb == nil {
+			log.Fatal().Msg("RATE_LIMIT_STORE=redis requires REDIS_URL")
+		}
+		limitStore = ratelimit.NewRedisStore(rdb, config.RedisKeyPrefix)
+	}
+	limitWindow := time.Duration(config.RateLimitWindowSec) * time.Second
+	handlerOpts = append(handlerOpts, handler.WithRateLimit(ratelimit.New(limitStore, ratelimit.Limits{
+		Caller: ratelimit.Rule{Limit: config.RateLimitPerCaller, Window: limitWindow},
+		IP:     ratelimit.Rule{Limit: config.RateLimitPerIP, Window: limitWindow},
+		To:     ratelimit.Rule{Limit: config.RateLimitPerTo, Window: limitWindow},
+	})))
+
+	var jobQueue *queue.Queue
+	if dingtalkClient != nil && config.QueueFile != "" {
+		q, err := queue.Open(config.QueueFile, queue.Options{
+			Workers:     config.QueueWorkers,
+			MaxAttempts: config.QueueMaxAttempts,
+			RetryBase:   time.Duration(config.QueueRetryBaseSec) * time.Second,
+			RetryMax:    time.Duration(config.QueueRetryMaxSec) * time.Second,
+			Retention:   time.Duration(config.QueueRetentionSec) * time.Second,
+			OnError: func(err error) {
+				log.Error().Err(err).Str("file", config.QueueFile).Msg("queue WAL write failed")
+			},
+		})
+		if err != nil {
+			log.Fatal().Err(err).Str("file", config.QueueFile).Msg("queue open failed")
+		}
+		q.Start(handler.DeliverJob(dingtalkClient, log, handlerOpts...))
+		jobQueue = q
+		handlerOpts = append(handlerOpts, handler.WithQueue(q))
+		log.Info().Str("file", config.QueueFile).Int("workers", config.QueueWorkers).Msg("async send queue started")
+	}
+
+	app := fiber.New(fiber.Config{DisableStartupMessage: false, BodyLimit: config.BodyLimitBytes})
+	router.Setup(app, log, dingtalkClient, idemStore, config.MetricsRequireAuth, handlerOpts...)
 
+	ln, err := listen(port, log)
+	if err != nil {
+		log.Fatal().Err(err).Msg("listen failed")
+	}
 	go func() {
-		if err := app.Listen(port); err != nil {
+		if err := app.Listener(ln); err != nil {
 			log.Fatal().Err(err).Msg("listen failed")
 		}
 	}()
 
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			if jwtVerifier != nil {
+				if err := jwtVerifier.Reload(); err != nil {
+					log.Error().Err(err).Msg("JWT keys reload failed; keeping previous keys")
+				} else {
+					log.Info().Msg("JWT keys reloaded")
+				}
+			}
+			if err := keys.Reload(); err != nil {
+				log.Error().Err(err).Str("file", config.APIKeysFile).Msg("API keys reload failed; keeping previous keys")
+				continue
+			}
+			log.Info().Strs("callers", keys.Names()).Msg("API keys reloaded")
+		}
+	}()
+
 	quit := make(chan os.Signal, 1)
 	signal.Notify(quit, os.Interrupt, syscall.SIGTERM)
 	<-quit
@@ -65,4 +271,53 @@ func main() {
 	if err := app.ShutdownWithContext(ctx); err != nil {
 		log.Warn().Err(err).Msg("shutdown error")
 	}
+	if jobQueue != nil {
+		if err := jobQueue.Close(); err != nil {
+			log.Warn().Err(err).Msg("queue close error")
+		}
+	}
+	if dingtalkClient != nil {
+		dingtalkClient.Close()
+	}
+	idemStore.Close()
+	if rdb != nil {
+		_ = rdb.Close()
+	}
+	if config.IdemPersistFile != "" {
+		if err := idemStore.SaveFile(config.IdemPersistFile); err != nil {
+			log.Warn().Err(err).Str("file", config.IdemPersistFile).Msg("idempotency snapshot save failed")
+		} else {
+			log.Info().Str("file", config.IdemPersistFile).Msg("idempotency snapshot saved")
+		}
+	}
+}
+
+// listen opens the HTTP listener on port, wrapped in TLS when TLS_CERT_FILE and TLS_KEY_FILE are
+// set (with client certificate verification when TLS_CLIENT_CA_FILE is set).
+func listen(port string, log *logger.Logger) (net.Listener, error) {
+	if (config.TLSCertFile == "") != (config.TLSKeyFile == "") {
+		return nil, errors.New("TLS_CERT_FILE and TLS_KEY_FILE must be set together")
+	}
+	if config.TLSCertFile == "" && config.TLSClientCAFile != "" {
+		return nil, errors.New("TLS_CLIENT_CA_FILE requires TLS_CERT_FILE and TLS_KEY_FILE")
+	}
+	ln, err := net.Listen("tcp", port)
+	if err != nil || config.TLSCertFile == "" {
+		return ln, err
+	}
+	certs, err := tlsconfig.NewCertReloader(config.TLSCertFile, config.TLSKeyFile, tlsconfig.DefaultCheckInterval)
+	if err != nil {
+		_ = ln.Close()
+		return nil, err
+	}
+	certs.OnError = func(err error) {
+		log.Error().Err(err).Str("file", config.TLSCertFile).Msg("TLS certificate reload failed; keeping previous certificate")
+	}
+	cfg, err := tlsconfig.Server(certs, config.TLSClientCAFile, config.TLSClientAuth)
+	if err != nil {
+		_ = ln.Close()
+		return nil, err
+	}
+	log.Info().Str("cert", config.TLSCertFile).Bool("mtls", config.TLSClientCAFile != "").Str("client_auth", config.TLSClientAuth).Msg("serving HTTPS")
+	return tls.NewListener(ln, cfg), nil
 }